@@ -0,0 +1,37 @@
+package http
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// WithAdminToken sets the bearer token required by operator-only requests:
+// forced deletes and every /admin/* route. Without a token those requests
+// are refused.
+func WithAdminToken(token string) HandlerOption {
+	return func(h *Handler) {
+		h.adminToken = token
+	}
+}
+
+// authorizeAdmin writes 401 or 403 and reports false unless r carries the
+// admin token.
+func (h *Handler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if h.adminToken == "" {
+		http.Error(w, "Admin operations are disabled", http.StatusForbidden)
+		return false
+	}
+	if !bearerMatches(r, h.adminToken) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// bearerMatches reports whether r carries token as its bearer token.
+func bearerMatches(r *http.Request, token string) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,54 @@
+package http
+
+import (
+	"net/http"
+)
+
+// WithAuthToken makes RequireAuth demand token as a bearer token on every
+// request that changes state and, when protectReads is set, on reads and
+// exports too. Peers syncing from a node that protects reads must send the
+// token as their cluster token. The admin token is accepted as well. An
+// empty token leaves every route open.
+func WithAuthToken(token string, protectReads bool) HandlerOption {
+	return func(h *Handler) {
+		h.authToken = token
+		h.authReads = protectReads
+	}
+}
+
+// readOnlyPosts are POST routes that only read, so they are guarded as
+// reads.
+var readOnlyPosts = map[string]bool{
+	"/nodes/get-many": true,
+	"/nodes/exists":   true,
+}
+
+// probePaths stay open so load balancers can poll them without the token.
+var probePaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// RequireAuth is a mux middleware that answers 401 to requests that need
+// the token configured with WithAuthToken and do not carry it.
+func (h *Handler) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.authToken == "" || !h.needsAuth(r) || bearerMatches(r, h.authToken) ||
+			(h.adminToken != "" && bearerMatches(r, h.adminToken)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (h *Handler) needsAuth(r *http.Request) bool {
+	if probePaths[r.URL.Path] {
+		return false
+	}
+	if isMutating(r.Method) && !readOnlyPosts[r.URL.Path] {
+		return true
+	}
+	return h.authReads
+}
@@ -0,0 +1,92 @@
+package http
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// debugBodyLimit is how many bytes of each request and response body
+// LogBodies logs.
+const debugBodyLimit = 4096
+
+// LogBodies logs the request and response bodies of POST, PUT, PATCH and
+// DELETE requests at debug level, truncated to debugBodyLimit bytes. Bodies
+// may carry client data, so nothing is logged, buffered or wrapped unless
+// logger is at debug level.
+func LogBodies(logger *logrus.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !logger.IsLevelEnabled(logrus.DebugLevel) || !isMutating(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var reqBody []byte
+		if r.Body != nil {
+			head, err := io.ReadAll(io.LimitReader(r.Body, debugBodyLimit+1))
+			if err != nil {
+				logger.Debugf("Failed to read request body of %s %s: %v", r.Method, r.URL.Path, err)
+			}
+			reqBody = head
+			r.Body = replayBody{Reader: io.MultiReader(bytes.NewReader(head), r.Body), Closer: r.Body}
+		}
+
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		logger.WithFields(logrus.Fields{
+			"method":        r.Method,
+			"path":          r.URL.RequestURI(),
+			"status":        rec.status,
+			"request_body":  truncateBody(reqBody),
+			"response_body": truncateBody(rec.body.Bytes()),
+		}).Debug("HTTP request")
+	})
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+func truncateBody(b []byte) string {
+	if len(b) > debugBodyLimit {
+		return string(b[:debugBodyLimit]) + "...(truncated)"
+	}
+	return string(b)
+}
+
+// replayBody serves the bytes already read for logging before the rest of
+// the original body, and closes the original.
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// bodyRecorder copies up to debugBodyLimit+1 bytes of the response while
+// passing everything through.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bodyRecorder) WriteHeader(status int) {
+	b.status = status
+	b.ResponseWriter.WriteHeader(status)
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	if room := debugBodyLimit + 1 - b.body.Len(); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		b.body.Write(p[:room])
+	}
+	return b.ResponseWriter.Write(p)
+}
@@ -0,0 +1,185 @@
+package http
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/dag"
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// SnapshotSeqHeader carries the changefeed seq an export reflects, so a
+// backup can be brought up to date with GET /changes?since_seq=.
+const SnapshotSeqHeader = "X-Snapshot-Seq"
+
+// exportFormat writes a streamed export: begin once, node for each stored
+// node in key order, then end.
+type exportFormat struct {
+	contentType string
+	begin       func(w io.Writer) error
+	node        func(w io.Writer, n *store.Node, first bool) error
+	end         func(w io.Writer) error
+}
+
+var jsonExport = exportFormat{
+	contentType: "application/json",
+	begin: func(w io.Writer) error {
+		_, err := io.WriteString(w, "[")
+		return err
+	},
+	node: func(w io.Writer, n *store.Node, first bool) error {
+		data, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		_, err = w.Write(data)
+		return err
+	},
+	end: func(w io.Writer) error {
+		_, err := io.WriteString(w, "]\n")
+		return err
+	},
+}
+
+// ndjsonExport writes one node per line, the format POST /import reads.
+var ndjsonExport = exportFormat{
+	contentType: "application/x-ndjson",
+	begin:       func(w io.Writer) error { return nil },
+	node: func(w io.Writer, n *store.Node, first bool) error {
+		return json.NewEncoder(w).Encode(n)
+	},
+	end: func(w io.Writer) error { return nil },
+}
+
+// csvHeader lists the CSV export columns. Parents are joined with ";".
+var csvHeader = []string{"id", "type", "data", "parents", "weight", "cumulative_weight", "updated_at"}
+
+func csvExport() exportFormat {
+	var cw *csv.Writer
+	return exportFormat{
+		contentType: "text/csv",
+		begin: func(w io.Writer) error {
+			cw = csv.NewWriter(w)
+			return cw.Write(csvHeader)
+		},
+		node: func(w io.Writer, n *store.Node, first bool) error {
+			return cw.Write([]string{
+				n.ID,
+				n.Type,
+				n.Data,
+				strings.Join(n.Parents, ";"),
+				strconv.FormatFloat(n.Weight, 'g', -1, 64),
+				strconv.FormatFloat(n.CumulativeWeight, 'g', -1, 64),
+				n.UpdatedAt.Format(time.RFC3339Nano),
+			})
+		},
+		end: func(w io.Writer) error {
+			cw.Flush()
+			return cw.Error()
+		},
+	}
+}
+
+// dotExport draws an edge from each node to each of its parents.
+var dotExport = exportFormat{
+	contentType: "text/vnd.graphviz",
+	begin: func(w io.Writer) error {
+		_, err := io.WriteString(w, "digraph dag {\n")
+		return err
+	},
+	node: func(w io.Writer, n *store.Node, first bool) error {
+		if _, err := fmt.Fprintf(w, "  %s;\n", dotID(n.ID)); err != nil {
+			return err
+		}
+		for _, p := range n.Parents {
+			if _, err := fmt.Fprintf(w, "  %s -> %s;\n", dotID(n.ID), dotID(p)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	end: func(w io.Writer) error {
+		_, err := io.WriteString(w, "}\n")
+		return err
+	},
+}
+
+func dotID(id string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(id) + `"`
+}
+
+func (h *Handler) ExportJSON(w http.ResponseWriter, r *http.Request) {
+	h.export(w, r, jsonExport)
+}
+
+func (h *Handler) ExportNDJSON(w http.ResponseWriter, r *http.Request) {
+	h.export(w, r, ndjsonExport)
+}
+
+func (h *Handler) ExportCSV(w http.ResponseWriter, r *http.Request) {
+	h.export(w, r, csvExport())
+}
+
+func (h *Handler) ExportDOT(w http.ResponseWriter, r *http.Request) {
+	h.export(w, r, dotExport)
+}
+
+// export streams every node from a snapshot taken when the request starts,
+// so the dump reflects a single point in time while writes continue. The
+// snapshot is released when the stream ends or the client goes away. Once
+// streaming has begun an error can only cut the response short.
+func (h *Handler) export(w http.ResponseWriter, r *http.Request, format exportFormat) {
+	snap, err := h.dag.Snapshot()
+	if err != nil {
+		if errors.Is(err, dag.ErrStoreUnavailable) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "Failed to take snapshot", http.StatusInternalServerError)
+		return
+	}
+	defer snap.Release()
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set(SnapshotSeqHeader, strconv.FormatInt(snap.Seq(), 10))
+	logger := h.dag.Logger()
+	if err := format.begin(w); err != nil {
+		return
+	}
+
+	iter := snap.Iterator()
+	defer iter.Release()
+	first := true
+	for iter.Next() {
+		if r.Context().Err() != nil {
+			logger.Infof("Export cancelled by client")
+			return
+		}
+		var node store.Node
+		if err := json.Unmarshal(iter.Value(), &node); err != nil {
+			logger.Errorf("Failed to unmarshal node during export: %v", err)
+			continue
+		}
+		if err := format.node(w, &node, first); err != nil {
+			return
+		}
+		first = false
+	}
+	if err := iter.Error(); err != nil {
+		logger.Errorf("Export aborted: %v", err)
+		return
+	}
+	format.end(w)
+}
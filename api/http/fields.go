@@ -0,0 +1,124 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sivaram/dag-leveldb/internal/model"
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// nodeFields are the names accepted by ?fields=, matching the JSON names of
+// model.GetNodeResponse.
+var nodeFields = map[string]bool{
+	"id":                true,
+	"data":              true,
+	"parents":           true,
+	"weight":            true,
+	"cumulative_weight": true,
+	"is_tip":            true,
+	"is_genesis":        true,
+	"type":              true,
+	"confirmed":         true,
+	"weight_pending":    true,
+	"created_at":        true,
+	"updated_at":        true,
+}
+
+// parseFields splits a ?fields= value and rejects unknown names. An empty
+// value returns nil, meaning no projection.
+func parseFields(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	fields := []string{}
+	for _, f := range strings.Split(raw, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !nodeFields[f] {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		fields = append(fields, f)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields requested")
+	}
+	return fields, nil
+}
+
+func hasField(fields []string, name string) bool {
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// projectFields marshals v and keeps only the requested top-level fields.
+func projectFields(v interface{}, fields []string) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]interface{}{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	out := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		if val, ok := all[f]; ok {
+			out[f] = val
+		}
+	}
+	return out, nil
+}
+
+// projectNodes builds the ?fields= projection of a node list, computing the
+// tip and pending weight flags only when they were requested.
+func (h *Handler) projectNodes(nodes []store.Node, fields []string) ([]map[string]interface{}, error) {
+	var tips map[string]bool
+	if hasField(fields, "is_tip") {
+		ids := make([]string, len(nodes))
+		for i, n := range nodes {
+			ids[i] = n.ID
+		}
+		var err error
+		if tips, err = h.dag.TipFlags(ids); err != nil {
+			return nil, err
+		}
+	}
+	var pending map[string]bool
+	if hasField(fields, "weight_pending") {
+		var err error
+		if pending, err = h.dag.PendingWeights(""); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]map[string]interface{}, 0, len(nodes))
+	for _, n := range nodes {
+		p, err := projectFields(model.GetNodeResponse{
+			ID:               n.ID,
+			Data:             n.Data,
+			Parents:          n.Parents,
+			Weight:           n.Weight,
+			CumulativeWeight: n.CumulativeWeight,
+			Istip:            tips[n.ID],
+			IsGenesis:        len(n.Parents) == 0,
+			Type:             n.Type,
+			Confirmed:        h.dag.IsConfirmed(&n),
+			WeightPending:    pending[n.ID],
+			CreatedAt:        n.CreatedAt,
+			UpdatedAt:        n.UpdatedAt,
+		}, fields)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
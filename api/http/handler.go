@@ -1,133 +1,1177 @@
-package http
-
-import (
-	"encoding/json"
-	"net/http"
-	"strings"
-
-	"github.com/gorilla/mux"
-	"github.com/sivaram/dag-leveldb/internal/dag"
-	"github.com/sivaram/dag-leveldb/internal/model"
-	"github.com/sivaram/dag-leveldb/internal/store"
-)
-
-type Handler struct {
-	dag *dag.DAG
-}
-
-func NewHandler(dag *dag.DAG) *Handler {
-	return &Handler{dag: dag}
-}
-
-func (h *Handler) AddNode(w http.ResponseWriter, r *http.Request) {
-	var node store.Node
-	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
-	}
-
-	if err := h.dag.AddNode(&node); err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			http.Error(w, err.Error(), http.StatusConflict)
-			return
-		}
-		if strings.Contains(err.Error(), "cycle detected") || strings.Contains(err.Error(), "parent does not exist") {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		http.Error(w, "Failed to add node", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Node added successfully"})
-}
-
-func (h *Handler) GetNodes(w http.ResponseWriter, r *http.Request) {
-	nodes, err := h.dag.GetAllNodes()
-	if err != nil {
-		http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(nodes); err != nil {
-		http.Error(w, "Failed to encode nodes", http.StatusInternalServerError)
-		return
-	}
-}
-
-func (h *Handler) SyncNodes(w http.ResponseWriter, r *http.Request) {
-	var nodes []store.Node
-	if err := json.NewDecoder(r.Body).Decode(&nodes); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
-	}
-
-	for _, node := range nodes {
-		if err := h.dag.AddNode(&node); err != nil {
-			continue
-		}
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Nodes synced successfully"})
-}
-
-func (h *Handler) GetNode(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	node, err := h.dag.GetNode(id)
-	if err != nil {
-		http.Error(w, "Failed to fetch node", http.StatusInternalServerError)
-		return
-	}
-	if node == nil {
-		http.Error(w, "Node not found", http.StatusNotFound)
-		return
-	}
-
-	isTip, err := h.dag.IsTip(id)
-	if err != nil {
-		http.Error(w, "Failed to check if node is tip", http.StatusInternalServerError)
-		return
-	}
-
-	resp := model.GetNodeResponse{
-		ID:               node.ID,
-		Data:             node.Data,
-		Parents:          node.Parents,
-		Weight:           node.Weight,
-		CumulativeWeight: node.CumulativeWeight,
-		Istip:            isTip,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-		return
-	}
-}
-
-func (h *Handler) DeleteNode(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	if err := h.dag.DeleteNode(id); err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		if strings.Contains(err.Error(), "has children") {
-			http.Error(w, err.Error(), http.StatusConflict)
-			return
-		}
-		http.Error(w, "Failed to delete node", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Node deleted successfully"})
-}
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sivaram/dag-leveldb/internal/dag"
+	"github.com/sivaram/dag-leveldb/internal/model"
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+type Handler struct {
+	dag *dag.DAG
+
+	idempotencyTTL  time.Duration
+	idempotencyMu   sync.Mutex
+	idempotencyKeys map[string]*keyLock
+	adminToken      string
+	authToken       string
+	authReads       bool
+}
+
+func NewHandler(dag *dag.DAG, opts ...HandlerOption) *Handler {
+	h := &Handler{dag: dag, idempotencyTTL: defaultIdempotencyTTL}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// HandlerOption configures optional Handler behaviour in NewHandler.
+type HandlerOption func(*Handler)
+
+func (h *Handler) AddNode(w http.ResponseWriter, r *http.Request) {
+	// A dry run writes nothing, so it is neither saved under the key nor
+	// answered from it.
+	if key := r.Header.Get(IdempotencyKeyHeader); key != "" && r.URL.Query().Get("dry_run") != "true" {
+		h.idempotent(w, r, key, h.addNode)
+		return
+	}
+	h.addNode(w, r)
+}
+
+func (h *Handler) addNode(w http.ResponseWriter, r *http.Request) {
+	var node store.Node
+	if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	add := h.dag.AddNode
+	if dryRun {
+		add = h.dag.DryRunAddNode
+	}
+
+	if err := add(&node); err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		var missing *dag.ErrParentNotFound
+		if errors.As(err, &missing) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(model.ParentNotFoundResponse{Error: "parent not found", ParentID: missing.ParentID})
+			return
+		}
+		if strings.Contains(err.Error(), "cycle detected") || strings.Contains(err.Error(), "parent does not exist") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, dag.ErrMultipleGenesis) || errors.Is(err, dag.ErrTooFewParents) || errors.Is(err, dag.ErrNonTipParent) || errors.Is(err, dag.ErrTypeNotAllowed) || errors.Is(err, dag.ErrDepthSpread) || errors.Is(err, dag.ErrInvalidID) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, dag.ErrStoreFull) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if errors.Is(err, dag.ErrReadOnly) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, dag.ErrNotReady) || errors.Is(err, dag.ErrStoreUnavailable) || errors.Is(err, dag.ErrStoreCorrupt) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "Failed to add node", http.StatusInternalServerError)
+		return
+	}
+
+	if dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(model.DryRunResponse{DryRun: true, Node: node})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Node added successfully"})
+}
+
+// UpdateNode replaces a node's data or weight. The body may only hold "data"
+// and "weight"; any other field, such as parents, is rejected rather than
+// ignored.
+func (h *Handler) UpdateNode(w http.ResponseWriter, r *http.Request) {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	var update struct {
+		Data   *string  `json:"data"`
+		Weight *float64 `json:"weight"`
+	}
+	for field, raw := range fields {
+		var err error
+		switch field {
+		case "data":
+			err = json.Unmarshal(raw, &update.Data)
+		case "weight":
+			err = json.Unmarshal(raw, &update.Weight)
+		default:
+			http.Error(w, fmt.Sprintf("Field %q cannot be updated, only data and weight", field), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s", field), http.StatusBadRequest)
+			return
+		}
+	}
+	if update.Data == nil && update.Weight == nil {
+		http.Error(w, "Payload must set data or weight", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.dag.UpdateNode(mux.Vars(r)["id"], update.Data, update.Weight); err != nil {
+		switch {
+		case strings.Contains(err.Error(), "not found"):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, dag.ErrInvalidWeight):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errors.Is(err, dag.ErrContentAddressed):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, dag.ErrStoreFull):
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		case errors.Is(err, dag.ErrReadOnly):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case errors.Is(err, dag.ErrNotReady) || errors.Is(err, dag.ErrStoreUnavailable) || errors.Is(err, dag.ErrStoreCorrupt):
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "Failed to update node", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Node updated successfully"})
+}
+
+// NextCursorHeader carries the cursor for the next page of GET /nodes. The
+// body stays a plain array so peers syncing from /nodes are unaffected.
+// TotalCountHeader carries the number of nodes matching the query when it is
+// known without an extra scan.
+const (
+	NextCursorHeader = "X-Next-Cursor"
+	TotalCountHeader = "X-Total-Count"
+)
+
+// nodeStreamPageSize is how many nodes streamNodes reads per lock.
+const nodeStreamPageSize = 500
+
+// GetNodes lists nodes in ID order, which is LevelDB's bytewise key order,
+// so ?limit= with ?offset= or the X-Next-Cursor header pages
+// deterministically. Without a limit the listing is streamed.
+func (h *Handler) GetNodes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	fields, err := parseFields(query.Get("fields"))
+	if err != nil {
+		http.Error(w, "Invalid fields parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := dag.NodeQuery{After: query.Get("cursor"), Prefix: query.Get("prefix"), Type: query.Get("type")}
+	if v := query.Get("is_tip"); v != "" {
+		isTip, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid is_tip parameter", http.StatusBadRequest)
+			return
+		}
+		q.IsTip = &isTip
+	}
+	if v := query.Get("tipsOnly"); v != "" {
+		tipsOnly, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid tipsOnly parameter", http.StatusBadRequest)
+			return
+		}
+		if tipsOnly {
+			if q.IsTip != nil && !*q.IsTip {
+				http.Error(w, "tipsOnly conflicts with is_tip=false", http.StatusBadRequest)
+				return
+			}
+			q.IsTip = &tipsOnly
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid offset parameter", http.StatusBadRequest)
+			return
+		}
+		q.Offset = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		q.Limit = min(n, maxTraversalLimit)
+	}
+
+	// A full listing reports the seq it covers, read before the listing so
+	// a racing write is offered again to a cursor-based sync, not skipped.
+	var nodes []store.Node
+	if q == (dag.NodeQuery{Prefix: q.Prefix}) && query.Get("since_seq") == "" {
+		w.Header().Set(dag.LastSeqHeader, strconv.FormatInt(h.dag.LastSeq(), 10))
+	}
+	if v := query.Get("since_seq"); v != "" {
+		since, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			http.Error(w, "Invalid since_seq parameter", http.StatusBadRequest)
+			return
+		}
+		changed, lastSeq, err := h.dag.NodesChangedSince(since, q.Prefix)
+		if err != nil {
+			http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+			return
+		}
+		nodes = changed
+		if q.Type != "" {
+			nodes = nodes[:0]
+			for _, n := range changed {
+				if n.Type == q.Type {
+					nodes = append(nodes, n)
+				}
+			}
+		}
+		w.Header().Set(dag.LastSeqHeader, strconv.FormatInt(lastSeq, 10))
+	} else if q.Limit == 0 {
+		h.streamNodes(w, r, q, fields)
+		return
+	} else {
+		page, err := h.dag.ListNodes(q)
+		if err != nil {
+			http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+			return
+		}
+		nodes = page.Nodes
+		if page.NextCursor != "" {
+			w.Header().Set(NextCursorHeader, page.NextCursor)
+		}
+		if page.Total >= 0 {
+			w.Header().Set(TotalCountHeader, strconv.Itoa(page.Total))
+		}
+	}
+
+	if fields != nil {
+		projected, err := h.projectNodes(nodes, fields)
+		if err != nil {
+			http.Error(w, "Failed to project fields", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(projected)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(nodes); err != nil {
+		http.Error(w, "Failed to encode nodes", http.StatusInternalServerError)
+		return
+	}
+}
+
+// streamNodes writes every node matching q as one JSON array, listing them
+// a page at a time so neither the whole result nor the read lock is held
+// while the client reads. Writes made during the stream may or may not be
+// included. Once the array has begun an error can only cut it short.
+func (h *Handler) streamNodes(w http.ResponseWriter, r *http.Request, q dag.NodeQuery, fields []string) {
+	q.Limit = nodeStreamPageSize
+	page, err := h.dag.ListNodes(q)
+	if err != nil {
+		http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+		return
+	}
+	if page.Total >= 0 {
+		w.Header().Set(TotalCountHeader, strconv.Itoa(page.Total))
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	logger := h.dag.Logger()
+	first := true
+	write := func(v interface{}) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		sep := ","
+		if first {
+			sep, first = "[", false
+		}
+		_, err = io.WriteString(w, sep+string(b))
+		return err
+	}
+	for {
+		if fields != nil {
+			projected, err := h.projectNodes(page.Nodes, fields)
+			if err != nil {
+				logger.Errorf("Node listing aborted: %v", err)
+				return
+			}
+			for _, p := range projected {
+				if err := write(p); err != nil {
+					return
+				}
+			}
+		} else {
+			for i := range page.Nodes {
+				if err := write(&page.Nodes[i]); err != nil {
+					return
+				}
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+		q.After, q.Offset = page.NextCursor, 0
+		if page, err = h.dag.ListNodes(q); err != nil {
+			logger.Errorf("Node listing aborted: %v", err)
+			return
+		}
+	}
+	if first {
+		io.WriteString(w, "[")
+	}
+	io.WriteString(w, "]\n")
+}
+
+func (h *Handler) SyncNodes(w http.ResponseWriter, r *http.Request) {
+	var nodes []store.Node
+	if err := json.NewDecoder(r.Body).Decode(&nodes); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	resp := model.SyncResponse{
+		Added:           []string{},
+		SkippedExisting: []string{},
+		Failed:          []model.SyncFailure{},
+	}
+	for i, node := range nodes {
+		if err := h.dag.AddNode(&node); err != nil {
+			if strings.Contains(err.Error(), "already exists") {
+				resp.SkippedExisting = append(resp.SkippedExisting, node.ID)
+				continue
+			}
+			// Every later node would fail the same way, so the rest are
+			// reported with this reason, or the whole request fails if
+			// nothing was stored, letting the sender retry it as is.
+			if status := nodeWideStatus(err); status != 0 {
+				if len(resp.Added) == 0 {
+					http.Error(w, err.Error(), status)
+					return
+				}
+				for _, rest := range nodes[i:] {
+					resp.Failed = append(resp.Failed, model.SyncFailure{ID: rest.ID, Reason: err.Error()})
+				}
+				break
+			}
+			resp.Failed = append(resp.Failed, model.SyncFailure{ID: node.ID, Reason: err.Error()})
+			continue
+		}
+		resp.Added = append(resp.Added, node.ID)
+	}
+
+	status := http.StatusOK
+	if len(resp.Failed) > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// nodeWideStatus returns the status for errors that fail every write on the
+// node rather than one node, or 0.
+func nodeWideStatus(err error) int {
+	switch {
+	case errors.Is(err, dag.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, dag.ErrNotReady), errors.Is(err, dag.ErrStoreUnavailable), errors.Is(err, dag.ErrStoreCorrupt):
+		return http.StatusServiceUnavailable
+	}
+	return 0
+}
+
+func (h *Handler) ImportJSON(w http.ResponseWriter, r *http.Request) {
+	var nodes []store.Node
+	if err := json.NewDecoder(r.Body).Decode(&nodes); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	h.importNodes(w, nodes, r.URL.Query().Get("defer_validation") == "true")
+}
+
+// ImportNDJSON loads a dump written by GET /export, one node per line.
+// Validation is always deferred, so the order of the lines does not matter.
+func (h *Handler) ImportNDJSON(w http.ResponseWriter, r *http.Request) {
+	nodes := []store.Node{}
+	dec := json.NewDecoder(r.Body)
+	for line := 1; dec.More(); line++ {
+		var node store.Node
+		if err := dec.Decode(&node); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid node on line %d: %v", line, err), http.StatusBadRequest)
+			return
+		}
+		nodes = append(nodes, node)
+	}
+	h.importNodes(w, nodes, true)
+}
+
+func (h *Handler) importNodes(w http.ResponseWriter, nodes []store.Node, deferValidation bool) {
+	result, err := h.dag.ImportNodes(nodes, deferValidation)
+	if err != nil {
+		var batchErr *dag.BatchError
+		if errors.As(err, &batchErr) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(batchErr)
+			return
+		}
+		if status := nodeWideStatus(err); status != 0 {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		http.Error(w, "Failed to import nodes", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if len(result.Failed) > 0 || len(result.MissingParents) > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// maxBatchIDs caps the number of IDs accepted by the bulk lookup endpoints.
+const maxBatchIDs = 1000
+
+func (h *Handler) GetManyNodes(w http.ResponseWriter, r *http.Request) {
+	var req model.IDsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxBatchIDs {
+		http.Error(w, fmt.Sprintf("Too many IDs: %d, max allowed: %d", len(req.IDs), maxBatchIDs), http.StatusBadRequest)
+		return
+	}
+
+	nodes, err := h.dag.GetNodes(r.Context(), req.IDs)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		http.Error(w, "Failed to fetch nodes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(nodes); err != nil {
+		http.Error(w, "Failed to encode nodes", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) NodesExist(w http.ResponseWriter, r *http.Request) {
+	var req model.IDsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxBatchIDs {
+		http.Error(w, fmt.Sprintf("Too many IDs: %d, max allowed: %d", len(req.IDs), maxBatchIDs), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := h.dag.HasMany(r.Context(), req.IDs)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		http.Error(w, "Failed to check nodes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(exists); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetTips selects tips with the configured TipSelector. Traces, detailed
+// records and exclusions are MCMC features, so those requests always walk.
+func (h *Handler) GetTips(w http.ResponseWriter, r *http.Request) {
+	maxTips := 0
+	if v := r.URL.Query().Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid max parameter", http.StatusBadRequest)
+			return
+		}
+		maxTips = n
+	}
+
+	var opts []dag.TipOption
+	if v := r.URL.Query().Get("exclude"); v != "" {
+		exclude := []string{}
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				exclude = append(exclude, id)
+			}
+		}
+		opts = append(opts, dag.ExcludeTips(exclude, r.URL.Query().Get("exclude_cones") == "true"))
+	}
+
+	var resp model.TipsResponse
+	var err error
+	switch {
+	case r.URL.Query().Get("trace") == "true":
+		var trace *dag.WalkTrace
+		resp.Tips, trace, err = h.dag.SelectTipsMCMCWithTrace(maxTips, opts...)
+		if trace != nil {
+			resp.Trace = trace.Walks
+			resp.Params = trace.Params
+		}
+	case r.URL.Query().Get("detailed") == "true":
+		resp.Nodes, err = h.dag.SelectTipsMCMCDetailed(maxTips, opts...)
+		resp.Tips = make([]string, 0, len(resp.Nodes))
+		for _, n := range resp.Nodes {
+			resp.Tips = append(resp.Tips, n.ID)
+		}
+	case len(opts) > 0:
+		resp.Tips, err = h.dag.SelectTipsMCMC(maxTips, opts...)
+	default:
+		resp.Tips, err = h.dag.SelectTips(maxTips)
+	}
+	if err != nil {
+		if errors.Is(err, dag.ErrAllTipsExcluded) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, dag.ErrEmptyDAG) || strings.Contains(err.Error(), "no tips") {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to select tips", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) GetTipParams(w http.ResponseWriter, r *http.Request) {
+	maxTips := 0
+	if v := r.URL.Query().Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid max parameter", http.StatusBadRequest)
+			return
+		}
+		maxTips = n
+	}
+
+	params, err := h.dag.MCMCParams(maxTips)
+	if err != nil {
+		http.Error(w, "Failed to read tip selection parameters", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(params); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) GetNode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if atSeq := r.URL.Query().Get("at_seq"); atSeq != "" {
+		h.getNodeAtSeq(w, id, atSeq)
+		return
+	}
+
+	fields, err := parseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		http.Error(w, "Invalid fields parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node, err := h.dag.GetNode(id)
+	if err != nil {
+		http.Error(w, "Failed to fetch node", http.StatusInternalServerError)
+		return
+	}
+	if node == nil {
+		http.Error(w, "Node not found", http.StatusNotFound)
+		return
+	}
+
+	isTip, err := h.dag.IsTip(id)
+	if err != nil {
+		http.Error(w, "Failed to check if node is tip", http.StatusInternalServerError)
+		return
+	}
+	pending, err := h.dag.WeightPending(id)
+	if err != nil {
+		http.Error(w, "Failed to check for pending weights", http.StatusInternalServerError)
+		return
+	}
+
+	resp := model.GetNodeResponse{
+		ID:               node.ID,
+		Data:             node.Data,
+		Parents:          node.Parents,
+		Weight:           node.Weight,
+		CumulativeWeight: node.CumulativeWeight,
+		Istip:            isTip,
+		IsGenesis:        len(node.Parents) == 0,
+		Type:             node.Type,
+		Confirmed:        h.dag.IsConfirmed(node),
+		WeightPending:    pending,
+		CreatedAt:        node.CreatedAt,
+		UpdatedAt:        node.UpdatedAt,
+	}
+
+	if fields != nil {
+		projected, err := projectFields(resp, fields)
+		if err != nil {
+			http.Error(w, "Failed to project fields", http.StatusInternalServerError)
+			return
+		}
+		writeJSONWithETag(w, r, projected)
+		return
+	}
+
+	writeJSONWithETag(w, r, resp)
+}
+
+// getNodeAtSeq serves GET /nodes/{id}?at_seq= with the node as recorded in
+// the changefeed at that seq. Tip and genesis flags describe the current DAG,
+// so the historical node is returned as stored.
+func (h *Handler) getNodeAtSeq(w http.ResponseWriter, id, atSeq string) {
+	seq, err := strconv.ParseInt(atSeq, 10, 64)
+	if err != nil || seq < 0 {
+		http.Error(w, "Invalid at_seq parameter", http.StatusBadRequest)
+		return
+	}
+
+	node, err := h.dag.NodeAtSeq(id, seq)
+	if err != nil {
+		http.Error(w, "Failed to replay changefeed", http.StatusInternalServerError)
+		return
+	}
+	if node == nil {
+		http.Error(w, "Node not found at seq", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(node); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) GetGenesisNodes(w http.ResponseWriter, r *http.Request) {
+	genesis, err := h.dag.GenesisNodes()
+	if err != nil {
+		http.Error(w, "Failed to fetch genesis nodes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(genesis); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetAllTips lists every current tip, for monitoring; GET /tips samples
+// tips by MCMC for parent selection instead.
+func (h *Handler) GetAllTips(w http.ResponseWriter, r *http.Request) {
+	tips, err := h.dag.GetTips()
+	if err != nil {
+		http.Error(w, "Failed to fetch tips", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tips); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) GetConfirmedNodes(w http.ResponseWriter, r *http.Request) {
+	confirmed, err := h.dag.ConfirmedNodes()
+	if err != nil {
+		http.Error(w, "Failed to fetch confirmed nodes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(confirmed); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+const (
+	defaultTraversalLimit = 100
+	maxTraversalLimit     = 1000
+)
+
+func (h *Handler) GetAncestors(w http.ResponseWriter, r *http.Request) {
+	h.traversal(w, r, h.dag.Ancestors)
+}
+
+func (h *Handler) GetDescendants(w http.ResponseWriter, r *http.Request) {
+	h.traversal(w, r, h.dag.Descendants)
+}
+
+// GetHeaviestPath returns the heaviest path from a genesis node to {id}.
+func (h *Handler) GetHeaviestPath(w http.ResponseWriter, r *http.Request) {
+	path, err := h.dag.HeaviestPath(mux.Vars(r)["id"])
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to traverse DAG", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]string{"path": path}); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetPath serves the shortest path from {id} down to {target}. An empty
+// path means target is not a descendant; a missing node is a 404.
+func (h *Handler) GetPath(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	path, err := h.dag.FindPath(vars["id"], vars["target"])
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to traverse DAG", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]string{"path": path}); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) GetTopologicalOrder(w http.ResponseWriter, r *http.Request) {
+	nodes, err := h.dag.TopologicalSort()
+	if err != nil {
+		if errors.Is(err, dag.ErrCycle) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Failed to sort DAG", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(nodes); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) traversal(w http.ResponseWriter, r *http.Request, walk func(id string, limit, maxDepth int, cursor string) (*dag.TraversalPage, error)) {
+	id := mux.Vars(r)["id"]
+
+	limit := defaultTraversalLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxTraversalLimit)
+	}
+	if v := r.URL.Query().Get("maxNodes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid maxNodes parameter", http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("limit") == "" || n < limit {
+			limit = min(n, maxTraversalLimit)
+		}
+	}
+	depth := 0
+	if v := r.URL.Query().Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid depth parameter", http.StatusBadRequest)
+			return
+		}
+		depth = n
+	}
+
+	page, err := walk(id, limit, depth, r.URL.Query().Get("cursor"))
+	if err != nil {
+		if errors.Is(err, dag.ErrInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to traverse DAG", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// errNotTip reports an only_if_tip delete of a node that has children.
+var errNotTip = errors.New("node is no longer a tip")
+
+func (h *Handler) DeleteNode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	query := r.URL.Query()
+	force := query.Get("force") == "true"
+	onlyIfTip := !force && query.Get("only_if_tip") == "true"
+	cascade := query.Get("cascade") == "true"
+	if cascade && (force || onlyIfTip) {
+		http.Error(w, "Cascade cannot be combined with force or only_if_tip", http.StatusBadRequest)
+		return
+	}
+	if cascade && query.Get("dry_run") != "true" {
+		deleted, err := h.dag.DeleteSubtree(id)
+		if err != nil {
+			writeDeleteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"message": "Subtree deleted successfully", "deleted": deleted})
+		return
+	}
+	if force && !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	if query.Get("dry_run") == "true" {
+		plan, err := h.dag.PlanDelete(id, force, cascade)
+		if err != nil {
+			if onlyIfTip && strings.Contains(err.Error(), "has children") {
+				err = errNotTip
+			}
+			writeDeleteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+		return
+	}
+
+	deleteNode := h.dag.DeleteNode
+	if force {
+		repair := query.Get("repair_children") == "true"
+		deleteNode = func(id string) error { return h.dag.ForceDeleteNode(id, repair) }
+	} else if onlyIfTip {
+		deleteNode = func(id string) error {
+			deleted, err := h.dag.DeleteIfTip(id)
+			if err == nil && !deleted {
+				return errNotTip
+			}
+			return err
+		}
+	}
+
+	if err := deleteNode(id); err != nil {
+		writeDeleteError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Node deleted successfully"})
+}
+
+func writeDeleteError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNotTip) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if strings.Contains(err.Error(), "not found") {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if strings.Contains(err.Error(), "has children") || errors.Is(err, dag.ErrSharedDescendant) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, dag.ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, dag.ErrNotReady) || errors.Is(err, dag.ErrStoreUnavailable) || errors.Is(err, dag.ErrStoreCorrupt) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, "Failed to delete node", http.StatusInternalServerError)
+}
+
+// GetTombstones lists the tombstones of soft-deleted nodes, optionally
+// limited to IDs starting with ?prefix=, for peers to apply during sync.
+func (h *Handler) GetTombstones(w http.ResponseWriter, r *http.Request) {
+	tombstones, err := h.dag.Tombstones(r.URL.Query().Get("prefix"))
+	if err != nil {
+		http.Error(w, "Failed to read tombstones", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tombstones); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeleteNodeByHash deletes the tip whose content hash is {hash}, for clients
+// of content-addressed DAGs that key nodes by hash rather than ID.
+func (h *Handler) DeleteNodeByHash(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+
+	id, err := h.dag.DeleteNodeByHash(hash)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if strings.Contains(err.Error(), "has children") || errors.Is(err, dag.ErrAmbiguousHash) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if errors.Is(err, dag.ErrReadOnly) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, dag.ErrNotReady) || errors.Is(err, dag.ErrStoreUnavailable) || errors.Is(err, dag.ErrStoreCorrupt) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "Failed to delete node", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Node deleted successfully", "id": id})
+}
+
+func (h *Handler) RebuildIndexes(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+	if err := h.dag.RebuildIndexes(); err != nil {
+		http.Error(w, "Failed to rebuild indexes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Indexes rebuilt successfully"})
+}
+
+func (h *Handler) GetPeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.dag.Peers()); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (h *Handler) CheckWeightConsistency(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+	sample := 100
+	if v := r.URL.Query().Get("sample"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid sample parameter", http.StatusBadRequest)
+			return
+		}
+		sample = n
+	}
+
+	drift, err := h.dag.CheckWeightConsistency(sample)
+	if err != nil {
+		http.Error(w, "Failed to check weight consistency", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"consistent": len(drift) == 0,
+		"drift":      drift,
+	})
+}
+
+func (h *Handler) VerifyStructure(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+	report, err := h.dag.VerifyStructure()
+	if err != nil {
+		http.Error(w, "Failed to verify structure", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":  report.Valid(),
+		"report": report,
+	})
+}
+
+// RunMaintenance runs the maintenance operation named by {operation} now,
+// subject to the same exclusion and traffic guard as scheduled runs.
+func (h *Handler) RunMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+	op := mux.Vars(r)["operation"]
+
+	if err := h.dag.RunMaintenance(op); err != nil {
+		if errors.Is(err, dag.ErrMaintenanceSkipped) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if strings.Contains(err.Error(), "unknown maintenance operation") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Maintenance operation failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Maintenance operation " + op + " completed"})
+}
+
+func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.dag.Stats()
+	if err != nil {
+		http.Error(w, "Failed to collect stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// maxChangesLimit caps the page size of GET /changes.
+const maxChangesLimit = 1000
+
+// GetChanges serves the changefeed after since, oldest first. Replicas poll
+// it to follow this node.
+func (h *Handler) GetChanges(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var since int64
+	if v := query.Get("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	limit := maxChangesLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxChangesLimit)
+	}
+
+	page, err := h.dag.Changes(since, limit)
+	if err != nil {
+		http.Error(w, "Failed to read changes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// Healthz is the liveness probe. It answers 200 whenever the server can
+// serve a request, whatever the state of the store, so an orchestrator
+// restarts the process only when it hangs.
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz reports 503 until the node is ready for traffic, so load balancers
+// can withhold it during the startup index build, before the first peer
+// sync, or while the store does not answer.
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := h.dag.ProbeReadiness(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "not ready", "reason": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
@@ -0,0 +1,135 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// IdempotencyKeyHeader lets a client retry POST /nodes safely: the first
+// response for a key is saved and replayed verbatim to every retry until the
+// TTL expires. Reusing a key with a different request body is rejected with
+// 422 rather than replaying an unrelated result. Server errors (5xx) are not
+// saved, so a retry after one is processed again. Dry runs ignore the key.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// WithIdempotencyTTL sets how long Idempotency-Key results are kept.
+func WithIdempotencyTTL(ttl time.Duration) HandlerOption {
+	return func(h *Handler) {
+		if ttl > 0 {
+			h.idempotencyTTL = ttl
+		}
+	}
+}
+
+func (h *Handler) idempotent(w http.ResponseWriter, r *http.Request, key string, next http.HandlerFunc) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(body)
+	hash := hex.EncodeToString(sum[:])
+
+	// Serialize requests with the same key so two concurrent first attempts
+	// cannot both be processed.
+	defer h.lockKey(key)()
+
+	rec, err := h.dag.IdempotencyRecord(key)
+	if err != nil {
+		http.Error(w, "Failed to check idempotency key", http.StatusInternalServerError)
+		return
+	}
+	if rec != nil {
+		if rec.RequestHash != hash {
+			http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			return
+		}
+		if rec.ContentType != "" {
+			w.Header().Set("Content-Type", rec.ContentType)
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(rec.Status)
+		w.Write(rec.Body)
+		return
+	}
+
+	capture := &responseCapture{ResponseWriter: w, status: http.StatusOK}
+	next(capture, r)
+	if capture.status >= http.StatusInternalServerError {
+		return
+	}
+
+	err = h.dag.SaveIdempotencyRecord(key, &store.IdempotencyRecord{
+		RequestHash: hash,
+		Status:      capture.status,
+		ContentType: capture.Header().Get("Content-Type"),
+		Body:        capture.body.Bytes(),
+		ExpiresAt:   time.Now().Add(h.idempotencyTTL),
+	})
+	if err != nil {
+		h.dag.Logger().Errorf("Failed to save idempotency key %s: %v", key, err)
+	}
+}
+
+// keyLock serializes the requests holding one Idempotency-Key. refs counts
+// the requests holding or waiting for it and is guarded by
+// Handler.idempotencyMu.
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockKey blocks until no other request holds key and returns the func
+// that releases it. Requests with different keys do not wait for each
+// other.
+func (h *Handler) lockKey(key string) (unlock func()) {
+	h.idempotencyMu.Lock()
+	if h.idempotencyKeys == nil {
+		h.idempotencyKeys = map[string]*keyLock{}
+	}
+	l, ok := h.idempotencyKeys[key]
+	if !ok {
+		l = &keyLock{}
+		h.idempotencyKeys[key] = l
+	}
+	l.refs++
+	h.idempotencyMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		h.idempotencyMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(h.idempotencyKeys, key)
+		}
+		h.idempotencyMu.Unlock()
+	}
+}
+
+// responseCapture passes a response through while keeping a copy of its
+// status and body.
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
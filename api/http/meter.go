@@ -0,0 +1,57 @@
+package http
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// meterWindow is the number of one-second buckets averaged by Rate.
+const meterWindow = 60
+
+// RequestMeter counts requests passing through Wrap so background work can
+// back off while the node is busy.
+type RequestMeter struct {
+	mu      sync.Mutex
+	buckets [meterWindow]int64
+	seconds [meterWindow]int64
+	now     func() time.Time
+}
+
+func NewRequestMeter() *RequestMeter {
+	return &RequestMeter{now: time.Now}
+}
+
+// Wrap counts every request handled by next.
+func (m *RequestMeter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.record()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *RequestMeter) record() {
+	sec := m.now().Unix()
+	i := sec % meterWindow
+	m.mu.Lock()
+	if m.seconds[i] != sec {
+		m.seconds[i] = sec
+		m.buckets[i] = 0
+	}
+	m.buckets[i]++
+	m.mu.Unlock()
+}
+
+// Rate returns the average requests per second over the last minute.
+func (m *RequestMeter) Rate() float64 {
+	sec := m.now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for i := range m.buckets {
+		if sec-m.seconds[i] < meterWindow {
+			total += m.buckets[i]
+		}
+	}
+	return float64(total) / meterWindow
+}
@@ -0,0 +1,79 @@
+package http
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Metrics serves the DAG's counters in the Prometheus text exposition
+// format. The format is small enough to write directly, so the node needs
+// no client library. The node and tip gauges are refreshed on a timer, not
+// per scrape.
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	m := h.dag.Metrics()
+	var p promWriter
+
+	p.family("dag_nodes", "gauge", "Stored nodes as of the last gauge refresh.")
+	p.sample("dag_nodes", "", float64(m.Nodes))
+	p.family("dag_tips", "gauge", "Nodes without children as of the last gauge refresh.")
+	p.sample("dag_tips", "", float64(m.Tips))
+	p.family("dag_gauges_refreshed_timestamp_seconds", "gauge", "Unix time of the last node and tip gauge refresh, 0 before the first.")
+	refreshed := 0.0
+	if !m.GaugesRefreshedAt.IsZero() {
+		refreshed = float64(m.GaugesRefreshedAt.UnixMilli()) / 1000
+	}
+	p.sample("dag_gauges_refreshed_timestamp_seconds", "", refreshed)
+
+	p.family("dag_nodes_added_total", "counter", "Nodes added since startup, by clients, sync and import.")
+	p.sample("dag_nodes_added_total", "", float64(m.NodesAdded))
+	p.family("dag_nodes_deleted_total", "counter", "Nodes deleted since startup.")
+	p.sample("dag_nodes_deleted_total", "", float64(m.NodesDeleted))
+	p.family("dag_weight_recompute_duration_seconds", "summary", "Time spent in full cumulative weight recomputes.")
+	p.sample("dag_weight_recompute_duration_seconds_sum", "", m.RecomputeSeconds)
+	p.sample("dag_weight_recompute_duration_seconds_count", "", float64(m.Recomputes))
+
+	// Peer totals are saved with the registry, so they survive restarts.
+	p.family("dag_peer_syncs_total", "counter", "Sync cycles with each peer by result.")
+	for _, peer := range m.Peers {
+		label := `peer="` + promLabel(peer.Address) + `"`
+		p.sample("dag_peer_syncs_total", label+`,result="success"`, float64(peer.Syncs-peer.Failures))
+		p.sample("dag_peer_syncs_total", label+`,result="failure"`, float64(peer.Failures))
+	}
+	p.family("dag_peer_merged_nodes_total", "counter", "Nodes merged from each peer.")
+	for _, peer := range m.Peers {
+		p.sample("dag_peer_merged_nodes_total", `peer="`+promLabel(peer.Address)+`"`, float64(peer.Totals.Merged))
+	}
+
+	if c := m.NodeCache; c != nil {
+		p.family("dag_node_cache_requests_total", "counter", "Node cache lookups by result.")
+		p.sample("dag_node_cache_requests_total", `result="hit"`, float64(c.Hits))
+		p.sample("dag_node_cache_requests_total", `result="miss"`, float64(c.Misses))
+		p.family("dag_node_cache_entries", "gauge", "Nodes held in the node cache.")
+		p.sample("dag_node_cache_entries", "", float64(c.Size))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, p.b.String())
+}
+
+type promWriter struct {
+	b strings.Builder
+}
+
+func (p *promWriter) family(name, typ, help string) {
+	fmt.Fprintf(&p.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name, labels string, v float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(&p.b, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func promLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -0,0 +1,328 @@
+// Package client is a Go client for the DAG node HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors returned for the server's status codes. The returned error wraps
+// one of these together with the server's message, so callers can match it
+// with errors.Is.
+var (
+	ErrBadRequest = errors.New("bad request")
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrStoreFull  = errors.New("store full")
+	ErrServer     = errors.New("server error")
+)
+
+// StatusError is returned for any non-success response.
+type StatusError struct {
+	StatusCode int
+	Message    string
+	kind       error
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v (status %d): %s", e.kind, e.StatusCode, e.Message)
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.kind
+}
+
+// Node is a node as sent to and listed by the server.
+type Node struct {
+	ID               string    `json:"id"`
+	Data             string    `json:"data"`
+	Parents          []string  `json:"parents"`
+	Weight           float64   `json:"weight,omitempty"`
+	CumulativeWeight float64   `json:"cumulative_weight,omitempty"`
+	Type             string    `json:"type,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// NodeInfo is a single node with the flags computed by GET /nodes/{id}.
+type NodeInfo struct {
+	Node
+	IsTip     bool `json:"is_tip"`
+	IsGenesis bool `json:"is_genesis"`
+	Confirmed bool `json:"confirmed"`
+	// WeightPending means CumulativeWeight is still missing the weight of a
+	// deferred descendant.
+	WeightPending bool `json:"weight_pending"`
+}
+
+// SyncFailure names a node rejected by Sync.
+type SyncFailure struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// SyncResult reports the outcome of every node pushed with Sync.
+type SyncResult struct {
+	Added           []string      `json:"added"`
+	SkippedExisting []string      `json:"skipped_existing"`
+	Failed          []SyncFailure `json:"failed"`
+}
+
+// ListOptions filters and pages ListNodes.
+type ListOptions struct {
+	IsTip  *bool
+	Limit  int
+	Offset int
+	Cursor string
+}
+
+// Client talks to one DAG node. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+	authToken  string
+}
+
+// Option configures a Client in New.
+type Option func(*Client)
+
+// WithHTTPClient replaces the default HTTP client.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithRetries retries requests that fail with a network error or a 5xx
+// status (except 507) up to n more times, doubling backoff between attempts.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = n
+		c.backoff = backoff
+	}
+}
+
+// WithAuthToken sends token as a bearer token on every request, for nodes
+// that require one. An empty token sends none.
+func WithAuthToken(token string) Option {
+	return func(c *Client) {
+		c.authToken = token
+	}
+}
+
+// New returns a Client for the node at baseURL, e.g. "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		retries:    2,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// AddNode adds node. Leave Parents nil to let the server select them. Each
+// call carries its own Idempotency-Key, so a retried request is never applied
+// twice.
+func (c *Client) AddNode(ctx context.Context, node Node) error {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Idempotency-Key": []string{key}}
+	return c.do(ctx, http.MethodPost, "/nodes", header, node, nil)
+}
+
+func (c *Client) GetNode(ctx context.Context, id string) (*NodeInfo, error) {
+	var info NodeInfo
+	if err := c.do(ctx, http.MethodGet, "/nodes/"+url.PathEscape(id), nil, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) DeleteNode(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/nodes/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// ListNodes lists nodes. With opts.Limit set it returns one page and the
+// cursor for the next one, which is empty on the last page.
+func (c *Client) ListNodes(ctx context.Context, opts *ListOptions) ([]Node, string, error) {
+	query := url.Values{}
+	if opts != nil {
+		if opts.IsTip != nil {
+			query.Set("is_tip", strconv.FormatBool(*opts.IsTip))
+		}
+		if opts.Limit > 0 {
+			query.Set("limit", strconv.Itoa(opts.Limit))
+		}
+		if opts.Offset > 0 {
+			query.Set("offset", strconv.Itoa(opts.Offset))
+		}
+		if opts.Cursor != "" {
+			query.Set("cursor", opts.Cursor)
+		}
+	}
+	path := "/nodes"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var nodes []Node
+	resp, err := c.doResponse(ctx, http.MethodGet, path, nil, nil, &nodes)
+	if err != nil {
+		return nil, "", err
+	}
+	return nodes, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+// SelectTips asks the server for up to max tips chosen by MCMC.
+func (c *Client) SelectTips(ctx context.Context, max int) ([]string, error) {
+	var resp struct {
+		Tips []string `json:"tips"`
+	}
+	path := "/tips"
+	if max > 0 {
+		path += "?max=" + strconv.Itoa(max)
+	}
+	if err := c.do(ctx, http.MethodGet, path, nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Tips, nil
+}
+
+// Exists reports which of ids the server has.
+func (c *Client) Exists(ctx context.Context, ids []string) (map[string]bool, error) {
+	req := struct {
+		IDs []string `json:"ids"`
+	}{IDs: ids}
+	exists := map[string]bool{}
+	if err := c.do(ctx, http.MethodPost, "/nodes/exists", nil, req, &exists); err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+// Sync pushes nodes to the server. Per-node rejections are reported in the
+// result, not as an error.
+func (c *Client) Sync(ctx context.Context, nodes []Node) (*SyncResult, error) {
+	var result SyncResult
+	if err := c.do(ctx, http.MethodPost, "/sync", nil, nodes, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, in, out interface{}) error {
+	_, err := c.doResponse(ctx, method, path, header, in, out)
+	return err
+}
+
+func (c *Client) doResponse(ctx context.Context, method, path string, header http.Header, in, out interface{}) (*http.Response, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, fmt.Errorf("failed to encode request: %v", err)
+		}
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, method, path, header, body, out)
+		if err == nil || attempt >= c.retries || !retryable(err) {
+			return resp, err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, header http.Header, body []byte, out interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.authToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusMultiStatus {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp, statusError(resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("failed to decode response: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+func statusError(code int, msg string) *StatusError {
+	kind := ErrServer
+	switch code {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		kind = ErrBadRequest
+	case http.StatusNotFound:
+		kind = ErrNotFound
+	case http.StatusConflict:
+		kind = ErrConflict
+	case http.StatusInsufficientStorage:
+		kind = ErrStoreFull
+	}
+	return &StatusError{StatusCode: code, Message: msg, kind: kind}
+}
+
+func retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 && se.StatusCode != http.StatusInsufficientStorage
+	}
+	var ue *url.Error
+	return errors.As(err, &ue) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+func newIdempotencyKey() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate idempotency key: %v", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	apihttp "github.com/sivaram/dag-leveldb/api/http"
+	"github.com/sivaram/dag-leveldb/internal/dag"
+	"github.com/sivaram/dag-leveldb/internal/store"
+	"github.com/sivaram/dag-leveldb/routes"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	tmpDir, err := os.MkdirTemp("", "leveldb-client-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	st, err := store.New(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to initialize store: %v", err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(os.Stdout)
+
+	r := mux.NewRouter()
+	routes.RegisterRoutes(r, apihttp.NewHandler(dag.New(st, logger, 5, 1)))
+	srv := httptest.NewServer(r)
+	t.Cleanup(func() {
+		srv.Close()
+		st.Close()
+		os.RemoveAll(tmpDir)
+	})
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	srv := newTestServer(t)
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	if err := c.AddNode(ctx, Node{ID: "a", Data: "root", Parents: []string{}}); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+	if err := c.AddNode(ctx, Node{ID: "b", Parents: []string{"a"}}); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+
+	err := c.AddNode(ctx, Node{ID: "a", Parents: []string{}})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for duplicate, got %v", err)
+	}
+
+	info, err := c.GetNode(ctx, "b")
+	if err != nil {
+		t.Fatalf("GetNode failed: %v", err)
+	}
+	if !info.IsTip || info.Parents[0] != "a" {
+		t.Errorf("Unexpected node info: %+v", info)
+	}
+	if _, err := c.GetNode(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	isTip := true
+	tips, _, err := c.ListNodes(ctx, &ListOptions{IsTip: &isTip})
+	if err != nil || len(tips) != 1 || tips[0].ID != "b" {
+		t.Errorf("Expected tip list [b], got %+v, err: %v", tips, err)
+	}
+	page, cursor, err := c.ListNodes(ctx, &ListOptions{Limit: 1})
+	if err != nil || len(page) != 1 || cursor == "" {
+		t.Errorf("Expected one node and a cursor, got %+v, %q, err: %v", page, cursor, err)
+	}
+	page, _, err = c.ListNodes(ctx, &ListOptions{Limit: 1, Offset: 1})
+	if err != nil || len(page) != 1 || page[0].ID != "b" {
+		t.Errorf("Expected page [b] at offset 1, got %+v, err: %v", page, err)
+	}
+
+	selected, err := c.SelectTips(ctx, 1)
+	if err != nil || len(selected) != 1 || selected[0] != "b" {
+		t.Errorf("Expected selected tips [b], got %v, err: %v", selected, err)
+	}
+
+	exists, err := c.Exists(ctx, []string{"a", "missing"})
+	if err != nil || !exists["a"] || exists["missing"] || len(exists) != 2 {
+		t.Errorf("Expected exists {a:true missing:false}, got %v, err: %v", exists, err)
+	}
+
+	result, err := c.Sync(ctx, []Node{{ID: "c", Parents: []string{"b"}}, {ID: "a", Parents: []string{}}})
+	if err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if len(result.Added) != 1 || len(result.SkippedExisting) != 1 {
+		t.Errorf("Unexpected sync result: %+v", result)
+	}
+
+	if err := c.DeleteNode(ctx, "c"); err != nil {
+		t.Errorf("DeleteNode failed: %v", err)
+	}
+	if err := c.DeleteNode(ctx, "a"); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict deleting a parent, got %v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"tips":["t"]}`))
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetries(2, time.Millisecond))
+	tips, err := c.SelectTips(context.Background(), 1)
+	if err != nil || len(tips) != 1 {
+		t.Fatalf("Expected success after retries, got %v, err: %v", tips, err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls.Load())
+	}
+
+	calls.Store(0)
+	c = New(srv.URL, WithRetries(1, time.Millisecond))
+	_, err = c.SelectTips(context.Background(), 1)
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusServiceUnavailable || !errors.Is(err, ErrServer) {
+		t.Errorf("Expected a 503 StatusError after exhausting retries, got %v", err)
+	}
+}
+
+func TestClientAuthToken(t *testing.T) {
+	var got atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got.Store(r.Header.Get("Authorization"))
+		w.Write([]byte(`{"tips":["t"]}`))
+	}))
+	defer srv.Close()
+
+	if _, err := New(srv.URL, WithAuthToken("secret")).SelectTips(context.Background(), 1); err != nil {
+		t.Fatalf("SelectTips failed: %v", err)
+	}
+	if got.Load() != "Bearer secret" {
+		t.Errorf("Expected a bearer token, got %q", got.Load())
+	}
+	if _, err := New(srv.URL).SelectTips(context.Background(), 1); err != nil {
+		t.Fatalf("SelectTips failed: %v", err)
+	}
+	if got.Load() != "" {
+		t.Errorf("Expected no Authorization header without a token, got %q", got.Load())
+	}
+}
@@ -1,67 +1,292 @@
-package main
-
-import (
-	"context"
-	"flag"
-	"log"
-	server "net/http"
-	"time"
-
-	"github.com/gorilla/mux"
-	"github.com/sivaram/dag-leveldb/api/http"
-	"github.com/sivaram/dag-leveldb/internal/config"
-	"github.com/sivaram/dag-leveldb/internal/dag"
-	"github.com/sivaram/dag-leveldb/internal/logger"
-	"github.com/sivaram/dag-leveldb/internal/store"
-	"github.com/sivaram/dag-leveldb/routes"
-)
-
-func main() {
-	configPath := flag.String("config", "config/config.yaml", "Path to configuration file")
-	flag.Parse()
-
-	cfg, err := config.LoadConfig(*configPath)
-	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
-
-	logr, err := logger.NewLogger(cfg)
-	if err != nil {
-		log.Fatalf("Failed to initialize logger: %v", err)
-	}
-
-	st, err := store.New(cfg.LevelDB.Path)
-	if err != nil {
-		log.Fatalf("Failed to initialize store: %v", err)
-	}
-	defer st.Close()
-
-	dagManager := dag.New(st, logr, cfg.DAG.MaxParents, cfg.DAG.DefaultWeight)
-	handler := http.NewHandler(dagManager)
-
-	go func() {
-		ticker := time.NewTicker(time.Duration(cfg.DAG.SyncInterval) * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			for _, peer := range cfg.DAG.Peers {
-				_, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-				go func(peer string) {
-					defer cancel()
-					mergedNodes, err := dagManager.SyncWithPeer(peer)
-					if err != nil {
-						logr.Errorf("Failed to sync with peer %s: %v", peer, err)
-					} else if len(mergedNodes) > 0 {
-						logr.Infof("Successfully merged %d nodes from peer %s: %v", len(mergedNodes), peer, mergedNodes)
-					}
-				}(peer)
-			}
-		}
-	}()
-
-	r := mux.NewRouter()
-	routes.RegisterRoutes(r, handler)
-	log.Printf("Server listening on %s", cfg.Server.ListenAddr)
-	if err := server.ListenAndServe(cfg.Server.ListenAddr, r); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
-	}
-}
\ No newline at end of file
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	server "net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sivaram/dag-leveldb/api/http"
+	"github.com/sivaram/dag-leveldb/internal/config"
+	"github.com/sivaram/dag-leveldb/internal/dag"
+	"github.com/sivaram/dag-leveldb/internal/events"
+	"github.com/sivaram/dag-leveldb/internal/logger"
+	"github.com/sivaram/dag-leveldb/internal/store"
+	"github.com/sivaram/dag-leveldb/routes"
+)
+
+// shutdownTimeout bounds how long in-flight requests may run after a
+// shutdown signal before their connections are closed.
+const shutdownTimeout = 15 * time.Second
+
+// peerSyncTimeout bounds one sync with one peer, including parent pulls.
+const peerSyncTimeout = 10 * time.Second
+
+func main() {
+	configPath := flag.String("config", "config/config.yaml", "Path to configuration file")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := run(ctx, cfg, nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves the node until ctx is cancelled, then shuts down in order: the
+// server drains in-flight requests for up to shutdownTimeout, the sync and
+// other background loops stop and are waited for, pending weights are
+// flushed, and the store is closed last. If listening is not nil it receives
+// the bound address once the server accepts connections.
+func run(ctx context.Context, cfg *config.Config, listening chan<- string) error {
+	logr, err := logger.NewLogger(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize logger: %v", err)
+	}
+
+	store.SetWeightPrecision(cfg.DAG.WeightDecimals)
+	st, err := store.New(cfg.LevelDB.Path,
+		store.WithWriteBuffer(cfg.LevelDB.WriteBufferMax, time.Duration(cfg.LevelDB.WriteBufferFlushMs)*time.Millisecond),
+		store.WithNodeCache(cfg.LevelDB.CacheNodes),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to initialize store: %v", err)
+	}
+	defer st.Close()
+
+	conflictPolicy, err := dag.ParseConflictPolicy(cfg.DAG.ConflictPolicy)
+	if err != nil {
+		return fmt.Errorf("invalid dag.conflict_policy: %v", err)
+	}
+
+	cycleCheck, err := dag.ParseCycleCheck(cfg.DAG.CycleCheck)
+	if err != nil {
+		return fmt.Errorf("invalid dag.cycle_check: %v", err)
+	}
+
+	walkStart, err := dag.ParseWalkStart(cfg.DAG.WalkStart)
+	if err != nil {
+		return fmt.Errorf("invalid dag.walk_start: %v", err)
+	}
+
+	peerAuth := map[string]dag.PeerCredentials{}
+	for _, a := range cfg.DAG.PeerAuth {
+		peerAuth[a.URL] = dag.PeerCredentials{Token: a.Token, Username: a.Username, Password: a.Password}
+	}
+
+	peerFilters := map[string]dag.PeerFilter{}
+	for _, f := range cfg.DAG.PeerFilters {
+		parents, err := dag.ParseParentPolicy(f.Parents)
+		if err != nil {
+			return fmt.Errorf("invalid dag.peer_filters entry for %s: %v", dag.RedactPeerAddr(f.URL), err)
+		}
+		peerFilters[f.URL] = dag.PeerFilter{Prefix: f.Prefix, Parents: parents}
+	}
+
+	var eventSink dag.EventSink
+	if cfg.Events.NATSURL != "" {
+		sink, err := events.NewNATSSink(cfg.Events.NATSURL, cfg.Events.Subject)
+		if err != nil {
+			return fmt.Errorf("invalid events config: %v", err)
+		}
+		defer sink.Close()
+		eventSink = sink
+	}
+
+	// Deferred calls run in reverse, so the background loops are cancelled
+	// and waited for before the event sink and the store are closed.
+	ctx, cancel := context.WithCancel(ctx)
+	var bg sync.WaitGroup
+	defer bg.Wait()
+	defer cancel()
+	start := func(fn func()) {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			fn()
+		}()
+	}
+
+	meter := http.NewRequestMeter()
+	dagManager := dag.New(st, logr, cfg.DAG.MaxParents, cfg.DAG.DefaultWeight,
+		dag.WithAutoParents(cfg.DAG.AutoParents),
+		dag.WithTipDiversity(cfg.DAG.TipDiversity),
+		dag.WithTipBias(cfg.DAG.TipBias, cfg.DAG.Alpha),
+		dag.WithWalkStart(walkStart, cfg.DAG.WalkStartWindow),
+		dag.WithConfirmationThreshold(cfg.DAG.ConfirmationThreshold),
+		dag.WithWeightCoalescing(time.Duration(cfg.DAG.WeightFlushMs)*time.Millisecond),
+		dag.WithMaxAncestorUpdates(cfg.DAG.MaxAncestorUpdates),
+		dag.WithMinParents(cfg.DAG.MinParents),
+		dag.WithRequireTipParents(cfg.DAG.RequireTipParents),
+		dag.WithAllowedTypes(cfg.DAG.AllowedTypes),
+		dag.WithMaxIDLength(cfg.DAG.MaxIDLength),
+		dag.WithMaxDepthDiff(cfg.DAG.MaxDepthDiff),
+		dag.WithSoftDelete(cfg.DAG.SoftDelete, time.Duration(cfg.DAG.TombstoneTTL)*time.Second),
+		dag.WithInvariantChecks(cfg.DAG.AssertInvariants),
+		dag.WithScanBatchSize(cfg.DAG.ScanBatchSize),
+		dag.WithMaxStoreBytes(cfg.DAG.MaxStoreBytes),
+		dag.WithPeers(cfg.DAG.Peers),
+		dag.WithPeerAuth(cfg.DAG.ClusterToken, peerAuth),
+		dag.WithPeerFilters(peerFilters),
+		dag.WithConflictPolicy(conflictPolicy),
+		dag.WithCycleCheck(cycleCheck),
+		dag.WithEventSink(eventSink, cfg.Events.Buffer),
+		dag.WithReplicaOf(cfg.Replication.PrimaryAddr),
+		dag.WithMaintenanceGuard(cfg.Maintenance.MaxRequestRate, meter.Rate),
+		dag.WithAllowMultipleGenesis(cfg.DAG.AllowMultipleGenesis),
+		dag.WithSyncHTTP(dag.SyncHTTPOptions{
+			Timeout:             time.Duration(cfg.DAG.SyncHTTP.Timeout) * time.Second,
+			MaxIdleConns:        cfg.DAG.SyncHTTP.MaxIdleConns,
+			MaxIdleConnsPerHost: cfg.DAG.SyncHTTP.MaxIdleConnsPerHost,
+			IdleConnTimeout:     time.Duration(cfg.DAG.SyncHTTP.IdleConnTimeout) * time.Second,
+			InsecureSkipVerify:  cfg.DAG.SyncHTTP.InsecureSkipVerify,
+			MaxResponseBytes:    cfg.DAG.SyncHTTP.MaxResponseBytes,
+		}),
+	)
+	if cfg.DAG.RecoverOnStartup && st.UncleanShutdown() {
+		logr.Warnf("Store was not closed cleanly, running recovery")
+		if _, err := dagManager.Recover(); err != nil {
+			return fmt.Errorf("store recovery failed: %v", err)
+		}
+	}
+	if cfg.DAG.AutoGenesis.Enabled && cfg.Replication.PrimaryAddr == "" {
+		created, err := dagManager.EnsureGenesis(cfg.DAG.AutoGenesis.ID, cfg.DAG.AutoGenesis.Data)
+		if err != nil {
+			return fmt.Errorf("failed to create genesis node: %v", err)
+		}
+		if created {
+			logr.Infof("Created genesis node %s on empty store", cfg.DAG.AutoGenesis.ID)
+		}
+	}
+	indexesBuilt, err := dagManager.StartIndexBuild()
+	if err != nil {
+		return fmt.Errorf("failed to start index build: %v", err)
+	}
+	// The build cannot be cancelled, so shutdown waits for it before the
+	// store is closed under it.
+	start(func() { <-indexesBuilt })
+	var maintenance []dag.MaintenanceTask
+	for _, t := range cfg.Maintenance.Tasks {
+		maintenance = append(maintenance, dag.MaintenanceTask{Operation: t.Operation, Schedule: t.Schedule})
+	}
+	maintenanceDone, err := dagManager.StartMaintenance(ctx, maintenance)
+	if err != nil {
+		return fmt.Errorf("invalid maintenance config: %v", err)
+	}
+	start(func() { <-maintenanceDone })
+	handler := http.NewHandler(dagManager,
+		http.WithIdempotencyTTL(time.Duration(cfg.Server.IdempotencyTTL)*time.Second),
+		http.WithAdminToken(cfg.Server.AdminToken),
+		http.WithAuthToken(cfg.Server.AuthToken, cfg.Server.AuthReads),
+	)
+
+	start(func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				dagManager.PurgeIdempotencyRecords()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	start(func() { dagManager.RunWeightFlusher(ctx) })
+	start(func() { dagManager.RunWeightReconciler(ctx, time.Duration(cfg.DAG.ReconcileInterval)*time.Second) })
+	start(func() { dagManager.RunTombstoneGC(ctx, time.Duration(cfg.DAG.TombstoneGCInterval)*time.Second) })
+	start(func() { dagManager.RunMetricsRefresher(ctx, time.Duration(cfg.DAG.MetricsInterval)*time.Second) })
+
+	if cfg.DAG.MaxStoreBytes > 0 {
+		start(func() { dagManager.RunStoreSizeEstimator(ctx, time.Duration(cfg.DAG.StoreSizeInterval)*time.Second) })
+	}
+
+	if cfg.DAG.WeightCheckInterval > 0 {
+		start(func() {
+			dagManager.RunWeightChecker(ctx, time.Duration(cfg.DAG.WeightCheckInterval)*time.Second, cfg.DAG.WeightCheckSample)
+		})
+	}
+
+	if cfg.Replication.PrimaryAddr != "" {
+		logr.Infof("Running as a read replica of %s", dag.RedactPeerAddr(cfg.Replication.PrimaryAddr))
+		start(func() { dagManager.RunReplication(ctx, time.Duration(cfg.Replication.PollInterval)*time.Second) })
+	} else {
+		start(func() {
+			ticker := time.NewTicker(time.Duration(cfg.DAG.SyncInterval) * time.Second)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+				for _, peer := range cfg.DAG.Peers {
+					start(func() {
+						syncCtx, cancel := context.WithTimeout(ctx, peerSyncTimeout)
+						defer cancel()
+						mergedNodes, err := dagManager.SyncWithPeer(syncCtx, peer)
+						if err != nil {
+							logr.Errorf("Failed to sync with peer %s: %v", dag.RedactPeerAddr(peer), err)
+						} else if len(mergedNodes) > 0 {
+							logr.Infof("Successfully merged %d nodes from peer %s: %v", len(mergedNodes), dag.RedactPeerAddr(peer), mergedNodes)
+						}
+					})
+				}
+			}
+		})
+	}
+
+	r := mux.NewRouter()
+	routes.RegisterRoutes(r, handler)
+	ln, err := net.Listen("tcp", cfg.Server.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", cfg.Server.ListenAddr, err)
+	}
+	srv := &server.Server{Handler: meter.Wrap(http.LogBodies(logr, r))}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+	log.Printf("Server listening on %s", ln.Addr())
+	if listening != nil {
+		listening <- ln.Addr().String()
+	}
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("server failed: %v", err)
+	case <-ctx.Done():
+	}
+	logr.Infof("Shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logr.Errorf("Server did not drain within %s: %v", shutdownTimeout, err)
+	}
+	cancel()
+	bg.Wait()
+	if err := dagManager.Flush(); err != nil {
+		logr.Errorf("Failed to flush weights on shutdown: %v", err)
+	}
+	// Deliver what is still queued before the deferred sink.Close.
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelDrain()
+	if err := dagManager.StopEvents(drainCtx); err != nil {
+		logr.Errorf("Event queue did not drain within %s: %v", shutdownTimeout, err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/config"
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+func TestRunShutdown(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "data")
+	cfgPath := filepath.Join(dir, "config.yaml")
+	yaml := fmt.Sprintf("server:\n  listen_addr: \"127.0.0.1:0\"\nleveldb:\n  path: %q\nlogging:\n  output: \"stdout\"\n  level: \"error\"\n", dataPath)
+	if err := os.WriteFile(cfgPath, []byte(yaml), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listening := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() { done <- run(ctx, cfg, listening) }()
+
+	var addr string
+	select {
+	case addr = <-listening:
+	case err := <-done:
+		t.Fatalf("run returned before listening: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the server")
+	}
+	resp, err := http.Post("http://"+addr+"/nodes", "application/json", strings.NewReader(`{"id":"g","parents":[]}`))
+	if err != nil {
+		t.Fatalf("Failed to add g: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status %d adding g, got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	// A request still sending its body when the signal arrives is drained
+	// before the store closes.
+	body, send := io.Pipe()
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post("http://"+addr+"/nodes", "application/json", body)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	send.Write([]byte(`{"id":"late",`))
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		t.Fatalf("run returned with a request in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	send.Write([]byte(`"parents":["g"]}`))
+	send.Close()
+	if code := <-status; code != http.StatusCreated {
+		t.Errorf("Expected the in-flight request to complete with %d, got %d", http.StatusCreated, code)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Fatalf("Timed out waiting for shutdown")
+	}
+
+	st, err := store.New(dataPath)
+	if err != nil {
+		t.Fatalf("Expected the store to be closed and reopenable, got %v", err)
+	}
+	defer st.Close()
+	if st.UncleanShutdown() {
+		t.Errorf("Expected a clean shutdown")
+	}
+	if n, _ := st.GetNode("late"); n == nil {
+		t.Errorf("Expected the drained request's node to be stored")
+	}
+}
@@ -1,50 +1,217 @@
-package config
-
-import (
-	"strings"
-
-	"github.com/spf13/viper"
-)
-
-type Config struct {
-	Server struct {
-		ListenAddr string `mapstructure:"listen_addr"`
-	} `mapstructure:"server"`
-	LevelDB struct {
-		Path string `mapstructure:"path"`
-	} `mapstructure:"leveldb"`
-	Logging struct {
-		Level  string `mapstructure:"level"`
-		Output string `mapstructure:"output"`
-		File   string `mapstructure:"file"`
-	} `mapstructure:"logging"`
-	DAG struct {
-		MaxParents    int      `mapstructure:"max_parents"`
-		DefaultWeight float64  `mapstructure:"default_weight"`
-		Peers         []string `mapstructure:"peers"`
-		SyncInterval  int      `mapstructure:"sync_interval"`
-	} `mapstructure:"dag"`
-}
-
-func LoadConfig(configPath string) (*Config, error) {
-	v := viper.New()
-	v.SetConfigFile(configPath)
-	v.SetEnvPrefix("DAG")
-	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	v.AutomaticEnv()
-
-	if err := v.ReadInConfig(); err != nil {
-		return nil, err
-	}
-
-	var cfg Config
-	if err := v.Unmarshal(&cfg); err != nil {
-		return nil, err
-	}
-
-	if cfg.DAG.SyncInterval <= 0 {
-		cfg.DAG.SyncInterval = 30
-	}
-
-	return &cfg, nil
-}
\ No newline at end of file
+package config
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/sivaram/dag-leveldb/internal/dag"
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	Server struct {
+		ListenAddr     string `mapstructure:"listen_addr"`
+		IdempotencyTTL int    `mapstructure:"idempotency_ttl"`
+		AdminToken     string `mapstructure:"admin_token"`
+		// AuthToken is the bearer token required by writes, and by reads
+		// too when AuthReads is set. Empty leaves the API open.
+		AuthToken string `mapstructure:"auth_token"`
+		AuthReads bool   `mapstructure:"auth_reads"`
+	} `mapstructure:"server"`
+	LevelDB struct {
+		Path               string `mapstructure:"path"`
+		WriteBufferFlushMs int    `mapstructure:"write_buffer_flush_ms"`
+		WriteBufferMax     int    `mapstructure:"write_buffer_max"`
+		// CacheNodes sizes the in-memory cache of decoded nodes; 0 disables it.
+		CacheNodes int `mapstructure:"cache_nodes"`
+	} `mapstructure:"leveldb"`
+	Logging struct {
+		Level  string `mapstructure:"level"`
+		Output string `mapstructure:"output"`
+		File   string `mapstructure:"file"`
+	} `mapstructure:"logging"`
+	DAG struct {
+		// MaxParents caps the parents of every node, whether added locally,
+		// batched, imported or merged from a peer; 0 selects 2.
+		MaxParents int `mapstructure:"max_parents"`
+		// DefaultWeight is the weight of nodes sent without one; 0 selects 1.
+		DefaultWeight         float64  `mapstructure:"default_weight"`
+		AutoParents           int      `mapstructure:"auto_parents"`
+		TipDiversity          float64  `mapstructure:"tip_diversity"`
+		TipBias               bool     `mapstructure:"tip_bias"`
+		Alpha                 float64  `mapstructure:"alpha"`
+		WalkStart             string   `mapstructure:"walk_start"`
+		WalkStartWindow       int      `mapstructure:"walk_start_window"`
+		WeightDecimals        int      `mapstructure:"weight_decimals"`
+		ConfirmationThreshold float64  `mapstructure:"confirmation_threshold"`
+		WeightFlushMs         int      `mapstructure:"weight_flush_ms"`
+		MaxAncestorUpdates    int      `mapstructure:"max_ancestor_updates"`
+		ReconcileInterval     int      `mapstructure:"reconcile_interval"`
+		ScanBatchSize         int      `mapstructure:"scan_batch_size"`
+		MinParents            int      `mapstructure:"min_parents"`
+		AllowMultipleGenesis  bool     `mapstructure:"allow_multiple_genesis"`
+		RequireTipParents     bool     `mapstructure:"require_tip_parents"`
+		AllowedTypes          []string `mapstructure:"allowed_types"`
+		MaxIDLength           int      `mapstructure:"max_id_length"`
+		MaxDepthDiff          int      `mapstructure:"max_depth_diff"`
+		RecoverOnStartup      bool     `mapstructure:"recover_on_startup"`
+		SoftDelete            bool     `mapstructure:"soft_delete"`
+		TombstoneTTL          int      `mapstructure:"tombstone_ttl"`
+		TombstoneGCInterval   int      `mapstructure:"tombstone_gc_interval"`
+		AssertInvariants      bool     `mapstructure:"assert_invariants"`
+		Peers                 []string `mapstructure:"peers"`
+		ClusterToken          string   `mapstructure:"cluster_token"`
+		ConflictPolicy        string   `mapstructure:"conflict_policy"`
+		CycleCheck            string   `mapstructure:"cycle_check"`
+		PeerAuth              []struct {
+			URL      string `mapstructure:"url"`
+			Token    string `mapstructure:"token"`
+			Username string `mapstructure:"username"`
+			Password string `mapstructure:"password"`
+		} `mapstructure:"peer_auth"`
+		PeerFilters []struct {
+			URL     string `mapstructure:"url"`
+			Prefix  string `mapstructure:"prefix"`
+			Parents string `mapstructure:"parents"`
+		} `mapstructure:"peer_filters"`
+		SyncInterval        int   `mapstructure:"sync_interval"`
+		WeightCheckInterval int   `mapstructure:"weight_check_interval"`
+		WeightCheckSample   int   `mapstructure:"weight_check_sample"`
+		MaxStoreBytes       int64 `mapstructure:"max_store_bytes"`
+		StoreSizeInterval   int   `mapstructure:"store_size_interval"`
+		MetricsInterval     int   `mapstructure:"metrics_interval"`
+		SyncHTTP            struct {
+			Timeout             int   `mapstructure:"timeout"`
+			MaxIdleConns        int   `mapstructure:"max_idle_conns"`
+			MaxIdleConnsPerHost int   `mapstructure:"max_idle_conns_per_host"`
+			IdleConnTimeout     int   `mapstructure:"idle_conn_timeout"`
+			InsecureSkipVerify  bool  `mapstructure:"insecure_skip_verify"`
+			MaxResponseBytes    int64 `mapstructure:"max_response_bytes"`
+		} `mapstructure:"sync_http"`
+		AutoGenesis struct {
+			Enabled bool   `mapstructure:"enabled"`
+			ID      string `mapstructure:"id"`
+			Data    string `mapstructure:"data"`
+		} `mapstructure:"auto_genesis"`
+	} `mapstructure:"dag"`
+	Events struct {
+		NATSURL string `mapstructure:"nats_url"`
+		Subject string `mapstructure:"subject"`
+		Buffer  int    `mapstructure:"buffer"`
+	} `mapstructure:"events"`
+	Maintenance struct {
+		// MaxRequestRate skips runs while the node serves more requests per
+		// second than this; 0 disables the check.
+		MaxRequestRate float64 `mapstructure:"max_request_rate"`
+		Tasks          []struct {
+			Operation string `mapstructure:"operation"`
+			Schedule  string `mapstructure:"schedule"`
+		} `mapstructure:"tasks"`
+	} `mapstructure:"maintenance"`
+	Replication struct {
+		PrimaryAddr  string `mapstructure:"primary_addr"`
+		PollInterval int    `mapstructure:"poll_interval"`
+	} `mapstructure:"replication"`
+}
+
+func LoadConfig(configPath string) (*Config, error) {
+	v := viper.New()
+	v.SetConfigFile(configPath)
+	v.SetEnvPrefix("DAG")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	v.SetDefault("dag.allow_multiple_genesis", true)
+	v.SetDefault("events.subject", "dag.events")
+	v.SetDefault("dag.weight_decimals", -1)
+	v.SetDefault("dag.tombstone_ttl", 7*24*3600)
+	v.SetDefault("dag.auto_genesis.id", "genesis")
+	v.SetDefault("dag.auto_genesis.data", "genesis")
+
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.DAG.SyncInterval <= 0 {
+		cfg.DAG.SyncInterval = 30
+	}
+	if cfg.DAG.ReconcileInterval <= 0 {
+		cfg.DAG.ReconcileInterval = 10
+	}
+	if cfg.DAG.TombstoneGCInterval <= 0 {
+		cfg.DAG.TombstoneGCInterval = 3600
+	}
+	if cfg.DAG.StoreSizeInterval <= 0 {
+		cfg.DAG.StoreSizeInterval = 60
+	}
+	if cfg.DAG.MetricsInterval <= 0 {
+		cfg.DAG.MetricsInterval = 30
+	}
+	if cfg.Replication.PollInterval <= 0 {
+		cfg.Replication.PollInterval = 1
+	}
+	if cfg.DAG.SyncHTTP.Timeout <= 0 {
+		cfg.DAG.SyncHTTP.Timeout = 5
+	}
+	if err := cfg.validateDAG(); err != nil {
+		return nil, err
+	}
+	if err := cfg.normalizePeerURLs(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// validateDAG rejects DAG settings that dag.New would otherwise replace with
+// its defaults without a word.
+func (cfg *Config) validateDAG() error {
+	switch {
+	case cfg.DAG.MaxParents < 0:
+		return fmt.Errorf("dag.max_parents: must not be negative, got %d", cfg.DAG.MaxParents)
+	case cfg.DAG.AutoParents < 0:
+		return fmt.Errorf("dag.auto_parents: must not be negative, got %d", cfg.DAG.AutoParents)
+	case cfg.DAG.MinParents < 0:
+		return fmt.Errorf("dag.min_parents: must not be negative, got %d", cfg.DAG.MinParents)
+	case cfg.DAG.DefaultWeight < 0 || math.IsNaN(cfg.DAG.DefaultWeight) || math.IsInf(cfg.DAG.DefaultWeight, 0):
+		return fmt.Errorf("dag.default_weight: must be a non-negative number, got %g", cfg.DAG.DefaultWeight)
+	case cfg.DAG.Alpha < 0 || math.IsNaN(cfg.DAG.Alpha) || math.IsInf(cfg.DAG.Alpha, 0):
+		return fmt.Errorf("dag.alpha: must be a non-negative number, got %g; leave dag.tip_bias off to walk in proportion to cumulative weight", cfg.DAG.Alpha)
+	case cfg.DAG.Alpha != 0 && !cfg.DAG.TipBias:
+		return fmt.Errorf("dag.alpha: set to %g but dag.tip_bias is off, so it would be ignored", cfg.DAG.Alpha)
+	}
+	return nil
+}
+
+// normalizePeerURLs rejects malformed peer and primary URLs and strips
+// their trailing slashes, so the same peer configured in several places
+// always matches.
+func (cfg *Config) normalizePeerURLs() error {
+	var err error
+	for i, p := range cfg.DAG.Peers {
+		if cfg.DAG.Peers[i], err = dag.NormalizePeerAddr(p); err != nil {
+			return fmt.Errorf("dag.peers: %v", err)
+		}
+	}
+	for i := range cfg.DAG.PeerAuth {
+		if cfg.DAG.PeerAuth[i].URL, err = dag.NormalizePeerAddr(cfg.DAG.PeerAuth[i].URL); err != nil {
+			return fmt.Errorf("dag.peer_auth: %v", err)
+		}
+	}
+	for i := range cfg.DAG.PeerFilters {
+		if cfg.DAG.PeerFilters[i].URL, err = dag.NormalizePeerAddr(cfg.DAG.PeerFilters[i].URL); err != nil {
+			return fmt.Errorf("dag.peer_filters: %v", err)
+		}
+	}
+	if cfg.Replication.PrimaryAddr != "" {
+		if cfg.Replication.PrimaryAddr, err = dag.NormalizePeerAddr(cfg.Replication.PrimaryAddr); err != nil {
+			return fmt.Errorf("replication.primary_addr: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadYAML(t *testing.T, yaml string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return LoadConfig(path)
+}
+
+func TestLoadConfigValidatesDAG(t *testing.T) {
+	for _, tc := range []struct {
+		name, yaml, want string
+	}{
+		{"Negative max parents", "dag:\n  max_parents: -1\n", "dag.max_parents"},
+		{"Negative auto parents", "dag:\n  auto_parents: -2\n", "dag.auto_parents"},
+		{"Negative min parents", "dag:\n  min_parents: -1\n", "dag.min_parents"},
+		{"Negative default weight", "dag:\n  default_weight: -0.5\n", "dag.default_weight"},
+		{"Infinite alpha", "dag:\n  tip_bias: true\n  alpha: .inf\n", "dag.alpha"},
+		{"Negative alpha", "dag:\n  tip_bias: true\n  alpha: -1\n", "dag.alpha"},
+		{"Alpha without tip bias", "dag:\n  alpha: 0.5\n", "dag.tip_bias"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadYAML(t, tc.yaml)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Expected an error naming %s, got %v", tc.want, err)
+			}
+		})
+	}
+
+	t.Run("Zero selects the defaults", func(t *testing.T) {
+		cfg, err := loadYAML(t, "dag:\n  max_parents: 0\n  default_weight: 0\n")
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %v", err)
+		}
+		if cfg.DAG.MaxParents != 0 || cfg.DAG.DefaultWeight != 0 || cfg.DAG.TipBias || cfg.DAG.Alpha != 0 {
+			t.Errorf("Unexpected DAG config: %+v", cfg.DAG)
+		}
+	})
+}
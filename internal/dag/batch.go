@@ -0,0 +1,223 @@
+package dag
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// BatchError is returned by AddNodes when nodes in the batch fail validation.
+// It lists every failure; none of the batch was written.
+type BatchError struct {
+	Failures []ImportFailure `json:"failed"`
+}
+
+func (e *BatchError) Error() string {
+	first := e.Failures[0]
+	if len(e.Failures) == 1 {
+		return fmt.Sprintf("batch rejected: node %s: %s", first.ID, first.Reason)
+	}
+	return fmt.Sprintf("batch rejected: node %s: %s, and %d more", first.ID, first.Reason, len(e.Failures)-1)
+}
+
+// nodeBatch is the part of a batch validated so far, which later nodes in the
+// batch see as if it were stored.
+type nodeBatch struct {
+	pending map[string]*store.Node
+	depths  map[string]int
+	// claimed holds the parents of the batch so far, which are no longer
+	// tips once it is written.
+	claimed map[string]bool
+}
+
+// AddNodes adds nodes with one atomic store write. Each node is validated as
+// AddNode would validate it, except that parents must be listed and may be
+// stored nodes or nodes earlier in the batch. A batch is all or nothing: if
+// any node fails validation nothing is written and the returned *BatchError
+// lists every failure, including the nodes whose parents failed.
+func (d *DAG) AddNodes(nodes []*store.Node) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.logger.Infof("Adding batch of %d nodes", len(nodes))
+	if err := d.checkStoreSize(); err != nil {
+		d.logger.Warnf("Rejecting batch: %v", err)
+		return err
+	}
+
+	b := &nodeBatch{
+		pending: make(map[string]*store.Node, len(nodes)),
+		depths:  make(map[string]int, len(nodes)),
+		claimed: map[string]bool{},
+	}
+	var failures []ImportFailure
+	for _, node := range nodes {
+		if err := d.validateBatchNode(b, node); err != nil {
+			if errors.Is(err, ErrStoreUnavailable) {
+				return err
+			}
+			failures = append(failures, ImportFailure{ID: node.ID, Reason: err.Error()})
+			continue
+		}
+		b.pending[node.ID] = node
+		for _, p := range node.Parents {
+			b.claimed[p] = true
+		}
+	}
+	if len(failures) > 0 {
+		d.logger.Warnf("Rejecting batch of %d nodes: %d invalid", len(nodes), len(failures))
+		return &BatchError{Failures: failures}
+	}
+
+	// Each node's weight goes to its ancestors in the batch directly and to
+	// its stored ancestors through one write, as AddNode does for one node.
+	lookup := func(id string) (*store.Node, error) {
+		if n, ok := b.pending[id]; ok {
+			return n, nil
+		}
+		return d.getNodeInternal(id)
+	}
+	deltas := make(map[string]float64)
+	var deferred []*store.Node
+	for _, node := range nodes {
+		err := d.addWeightDeltasWith(node, node.Weight, deltas, d.maxAncestorUpdates, lookup)
+		if errors.Is(err, errTooManyAncestors) {
+			deferred = append(deferred, node)
+			continue
+		}
+		if err != nil {
+			return d.storeFailure("failed to update weights", err)
+		}
+	}
+	stored := make(map[string]float64, len(deltas))
+	for id, delta := range deltas {
+		if n, ok := b.pending[id]; ok {
+			n.CumulativeWeight += delta
+		} else {
+			stored[id] = delta
+		}
+	}
+	var ancestors []*store.Node
+	if d.coalescer == nil {
+		var err error
+		if ancestors, err = d.weightUpdates(stored); err != nil {
+			return d.storeFailure("failed to update weights", err)
+		}
+	}
+
+	writes := make([]*store.Node, 0, len(nodes)+len(ancestors))
+	writes = append(append(writes, nodes...), ancestors...)
+	if err := d.storeNodes(writes, deferred); err != nil {
+		return d.storeFailure("failed to store batch", err)
+	}
+	d.queueWeightDeltas(stored)
+	for _, node := range nodes {
+		d.recordWrite(node)
+		d.emit(EventNodeAdded, node.ID, node)
+		if d.IsConfirmed(node) {
+			d.emit(EventNodeConfirmed, node.ID, node)
+		}
+	}
+	d.emitConfirmed(ancestors, stored)
+
+	d.logger.Infof("Added batch of %d nodes", len(nodes))
+	return nil
+}
+
+// validateBatchNode runs AddNode's checks on node against the store and the
+// batch so far, and fills in its weights.
+func (d *DAG) validateBatchNode(b *nodeBatch, node *store.Node) error {
+	if err := d.checkNodeKeys(node); err != nil {
+		return err
+	}
+	if node.Parents == nil {
+		return fmt.Errorf("node %s has no parents listed, which a batch requires", node.ID)
+	}
+	existing, err := d.getNodeInternal(node.ID)
+	if err != nil {
+		return d.storeFailure("failed to check existing node", err)
+	}
+	if _, dup := b.pending[node.ID]; existing != nil || dup {
+		return fmt.Errorf("node with ID %s already exists", node.ID)
+	}
+	if err := d.checkType(node); err != nil {
+		return err
+	}
+
+	if len(node.Parents) > d.maxParents {
+		return fmt.Errorf("node %s has too many parents: %d, max allowed: %d", node.ID, len(node.Parents), d.maxParents)
+	}
+	if len(node.Parents) > 0 && len(node.Parents) < d.minParents {
+		return fmt.Errorf("%w: node %s has %d parents, min required: %d", ErrTooFewParents, node.ID, len(node.Parents), d.minParents)
+	}
+	if err := d.checkGenesis(node); err != nil {
+		return err
+	}
+	if !d.allowMultipleGenesis && len(node.Parents) == 0 && len(b.pending) > 0 {
+		return fmt.Errorf("%w: node %s has no parents, attach it to existing tips instead", ErrMultipleGenesis, node.ID)
+	}
+
+	// Parents in the batch were validated already and cannot close a cycle,
+	// since they only reach stored nodes and earlier nodes in the batch.
+	storedParents := make([]string, 0, len(node.Parents))
+	for _, p := range node.Parents {
+		if _, ok := b.pending[p]; !ok {
+			storedParents = append(storedParents, p)
+		}
+	}
+	if err := d.validateParents(node.ID, storedParents); err != nil {
+		return err
+	}
+
+	depth := func(id string) (int, error) {
+		if depth, ok := b.depths[id]; ok {
+			return depth, nil
+		}
+		return d.depth(id)
+	}
+	if err := d.checkDepthSpread(node.ID, node.Parents, depth); err != nil {
+		return err
+	}
+	isTip := func(id string) (bool, error) {
+		if b.claimed[id] {
+			return false, nil
+		}
+		if _, ok := b.pending[id]; ok {
+			return true, nil
+		}
+		return d.isTipInternal(id)
+	}
+	if err := d.checkTipParents(node, false, isTip); err != nil {
+		return err
+	}
+
+	if d.maxDepthDiff > 0 {
+		nodeDepth := 0
+		for _, p := range node.Parents {
+			pd, err := depth(p)
+			if err != nil {
+				return err
+			}
+			if pd+1 > nodeDepth {
+				nodeDepth = pd + 1
+			}
+		}
+		b.depths[node.ID] = nodeDepth
+	}
+
+	if node.Weight == 0 {
+		node.Weight = d.defaultWeight
+	}
+	node.CumulativeWeight = node.Weight
+	node.CreatedAt = time.Time{}
+	return nil
+}
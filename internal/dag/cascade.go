@@ -0,0 +1,100 @@
+package dag
+
+import (
+	"fmt"
+	"time"
+)
+
+// DeleteSubtree deletes id and every node descending from it, children
+// before parents, so each delete removes a tip and takes only its own
+// weight off the ancestors that remain. It returns the deleted IDs in the
+// order they were deleted. A descendant that also has a parent outside
+// the subtree blocks the whole delete with ErrSharedDescendant, since
+// another branch still builds on it; nothing is deleted then. A store
+// failure part way returns the IDs deleted so far with the error.
+func (d *DAG) DeleteSubtree(id string) ([]string, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	root, err := d.getNodeInternal(id)
+	if err != nil {
+		return nil, d.storeFailure("failed to read node "+id, err)
+	}
+	if root == nil {
+		return nil, fmt.Errorf("node with ID %s not found", id)
+	}
+	order, err := d.subtreeLeavesFirst(id)
+	if err != nil {
+		return nil, err
+	}
+
+	d.logger.Infof("Deleting subtree of %s: %d nodes", id, len(order))
+	deleted := make([]string, 0, len(order))
+	at := time.Now().UTC()
+	for _, nodeID := range order {
+		if err := d.deleteNodeAt(nodeID, at); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, nodeID)
+	}
+	return deleted, nil
+}
+
+// subtreeLeavesFirst returns id and its descendants ordered so that each
+// node comes after all of its children, failing if a descendant has a
+// parent outside the subtree. The caller holds d.mu.
+func (d *DAG) subtreeLeavesFirst(id string) ([]string, error) {
+	children := map[string][]string{}
+	queue := []string{id}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, seen := children[current]; seen {
+			continue
+		}
+		kids, err := d.store.GetChildren(current)
+		if err != nil {
+			return nil, d.storeFailure("failed to read children of "+current, err)
+		}
+		children[current] = kids
+		queue = append(queue, kids...)
+	}
+
+	for nodeID := range children {
+		if nodeID == id {
+			continue
+		}
+		node, err := d.getNodeInternal(nodeID)
+		if err != nil {
+			return nil, d.storeFailure("failed to read node "+nodeID, err)
+		}
+		if node == nil {
+			continue
+		}
+		for _, p := range node.Parents {
+			if _, inside := children[p]; !inside {
+				return nil, fmt.Errorf("%w: %s also has parent %s outside the subtree of %s", ErrSharedDescendant, nodeID, p, id)
+			}
+		}
+	}
+
+	order := make([]string, 0, len(children))
+	placed := make(map[string]bool, len(children))
+	var place func(nodeID string)
+	place = func(nodeID string) {
+		if placed[nodeID] {
+			return
+		}
+		placed[nodeID] = true
+		for _, c := range children[nodeID] {
+			place(c)
+		}
+		order = append(order, nodeID)
+	}
+	place(id)
+	return order, nil
+}
@@ -0,0 +1,142 @@
+package dag
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// weightCoalescer holds cumulative-weight deltas that have been accepted but
+// not yet written to their ancestors.
+type weightCoalescer struct {
+	interval time.Duration
+	mu       sync.Mutex
+	pending  map[string]float64
+}
+
+// WithWeightCoalescing stops adds from rewriting every ancestor. The new
+// node is written immediately; its ancestor deltas are summed in memory and
+// written once per interval by RunWeightFlusher, on Flush and before a
+// recompute, so a hot ancestor such as the genesis node is rewritten once per
+// flush instead of once per add. Reads through the DAG apply pending deltas;
+// the changefeed, and so replicas and subscribers, see the new weights only
+// after the flush. Zero, the default, disables coalescing.
+func WithWeightCoalescing(interval time.Duration) Option {
+	return func(d *DAG) {
+		if interval > 0 {
+			d.coalescer = &weightCoalescer{interval: interval, pending: map[string]float64{}}
+		}
+	}
+}
+
+// queueWeightDeltas adds deltas to the pending set. It reports false without
+// coalescing, in which case the caller writes them itself.
+func (d *DAG) queueWeightDeltas(deltas map[string]float64) bool {
+	if d.coalescer == nil {
+		return false
+	}
+	d.coalescer.mu.Lock()
+	defer d.coalescer.mu.Unlock()
+	for id, delta := range deltas {
+		d.coalescer.pending[id] += delta
+	}
+	return true
+}
+
+// commitWeightDeltas queues deltas when coalescing and writes them otherwise.
+func (d *DAG) commitWeightDeltas(deltas map[string]float64) error {
+	if d.queueWeightDeltas(deltas) {
+		return nil
+	}
+	return d.applyWeightDeltas(deltas)
+}
+
+// takePendingWeights empties the pending set and returns what it held.
+func (d *DAG) takePendingWeights() map[string]float64 {
+	if d.coalescer == nil {
+		return nil
+	}
+	d.coalescer.mu.Lock()
+	defer d.coalescer.mu.Unlock()
+	pending := d.coalescer.pending
+	d.coalescer.pending = map[string]float64{}
+	return pending
+}
+
+// dropPendingWeight discards the pending delta of a deleted node.
+func (d *DAG) dropPendingWeight(id string) {
+	if d.coalescer == nil {
+		return
+	}
+	d.coalescer.mu.Lock()
+	defer d.coalescer.mu.Unlock()
+	delete(d.coalescer.pending, id)
+}
+
+// applyPendingWeight adds node's pending delta to its cumulative weight, so
+// reads agree with what the next flush will write.
+func (d *DAG) applyPendingWeight(node *store.Node) {
+	if d.coalescer == nil || node == nil {
+		return
+	}
+	d.coalescer.mu.Lock()
+	delta, ok := d.coalescer.pending[node.ID]
+	d.coalescer.mu.Unlock()
+	if !ok {
+		return
+	}
+	node.CumulativeWeight += delta
+	if node.CumulativeWeight < node.Weight {
+		node.CumulativeWeight = node.Weight
+	}
+}
+
+// Flush writes every pending weight delta in one batch. A failed write puts
+// the deltas back so the next flush retries them. It is a no-op without
+// coalescing, and while the startup index build runs, which rejects the
+// writes that queue deltas.
+func (d *DAG) Flush() error {
+	if d.coalescer == nil || d.building.Load() {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.flushLocked()
+}
+
+func (d *DAG) flushLocked() error {
+	pending := d.takePendingWeights()
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := d.applyWeightDeltas(pending); err != nil {
+		d.queueWeightDeltas(pending)
+		return d.storeFailure("failed to flush weights", err)
+	}
+	return nil
+}
+
+// RunWeightFlusher flushes pending weight deltas every coalescing interval
+// until ctx is cancelled, then flushes once more.
+func (d *DAG) RunWeightFlusher(ctx context.Context) {
+	if d.coalescer == nil {
+		return
+	}
+	ticker := time.NewTicker(d.coalescer.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Flush(); err != nil {
+				d.logger.Errorf("Weight flush failed: %v", err)
+			}
+		case <-ctx.Done():
+			if err := d.Flush(); err != nil {
+				d.logger.Errorf("Weight flush failed: %v", err)
+			}
+			return
+		}
+	}
+}
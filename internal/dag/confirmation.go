@@ -0,0 +1,62 @@
+package dag
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// WithConfirmationThreshold marks nodes whose cumulative weight is at least
+// threshold as confirmed. Zero, the default, disables confirmation.
+func WithConfirmationThreshold(threshold float64) Option {
+	return func(d *DAG) {
+		d.confirmationThreshold = threshold
+	}
+}
+
+// IsConfirmed reports whether node has reached the confirmation threshold.
+func (d *DAG) IsConfirmed(node *store.Node) bool {
+	return d.confirmationThreshold > 0 && node.CumulativeWeight >= d.confirmationThreshold
+}
+
+// ConfirmedNodes returns the IDs of every confirmed node, in key order.
+func (d *DAG) ConfirmedNodes() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	confirmed := []string{}
+	if d.confirmationThreshold <= 0 {
+		return confirmed, nil
+	}
+	iter := d.store.Iterator()
+	defer iter.Release()
+	for iter.Next() {
+		var node store.Node
+		if err := json.Unmarshal(iter.Value(), &node); err != nil {
+			d.logger.Errorf("Failed to unmarshal node: %v", err)
+			continue
+		}
+		d.applyPendingWeight(&node)
+		if d.IsConfirmed(&node) {
+			confirmed = append(confirmed, node.ID)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate nodes: %v", err)
+	}
+	return confirmed, nil
+}
+
+// emitConfirmed publishes EventNodeConfirmed for each written node that the
+// deltas lifted over the threshold. It must run after the write succeeds.
+func (d *DAG) emitConfirmed(updated []*store.Node, deltas map[string]float64) {
+	if d.confirmationThreshold <= 0 {
+		return
+	}
+	for _, n := range updated {
+		if d.IsConfirmed(n) && n.CumulativeWeight-deltas[n.ID] < d.confirmationThreshold {
+			d.emit(EventNodeConfirmed, n.ID, n)
+		}
+	}
+}
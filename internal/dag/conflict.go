@@ -0,0 +1,97 @@
+package dag
+
+import (
+	"fmt"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// ConflictPolicy decides what SyncWithPeer does when a peer sends a node
+// whose ID exists locally with different content.
+type ConflictPolicy string
+
+const (
+	// ConflictSkip ignores existing IDs without comparing them.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictKeepLocal compares, counts the conflict and keeps the local node.
+	ConflictKeepLocal ConflictPolicy = "keep-local"
+	// ConflictKeepRemote replaces the local node with the peer's version.
+	ConflictKeepRemote ConflictPolicy = "keep-remote"
+	// ConflictErrorLog keeps the local node and logs the conflict as an error.
+	ConflictErrorLog ConflictPolicy = "error-log"
+)
+
+// ParseConflictPolicy validates a configured policy. An empty value selects
+// ConflictSkip.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case "":
+		return ConflictSkip, nil
+	case ConflictSkip, ConflictKeepLocal, ConflictKeepRemote, ConflictErrorLog:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// WithConflictPolicy sets the sync conflict policy. It defaults to
+// ConflictSkip.
+func WithConflictPolicy(p ConflictPolicy) Option {
+	return func(d *DAG) {
+		if p != "" {
+			d.conflictPolicy = p
+		}
+	}
+}
+
+// ContentHash is the hex SHA-256 of a node's data, parents and weight.
+// Cumulative weight is excluded because it legitimately differs between
+// peers. A node whose ID equals its content hash is content-addressed.
+func ContentHash(node *store.Node) string {
+	return store.ContentHash(node)
+}
+
+// resolveConflict applies the conflict policy to a node received from a peer
+// whose ID already exists locally. It reports whether the remote version
+// replaced the local one. The caller holds d.mu.
+func (d *DAG) resolveConflict(local, remote *store.Node, label string, cycle *SyncMetrics) (bool, error) {
+	if remote.Weight == 0 {
+		remote.Weight = d.defaultWeight
+	}
+	localHash := ContentHash(local)
+	if d.conflictPolicy == ConflictSkip || localHash == ContentHash(remote) {
+		d.logger.Debugf("Node %s already exists, skipping", local.ID)
+		cycle.SkippedExisting++
+		return false, nil
+	}
+
+	cycle.Conflicts++
+	if local.ID == localHash {
+		cycle.Tampered++
+		d.logger.Errorf("Tampering detected: peer %s sent content-addressed node %s with different content", label, local.ID)
+		return false, nil
+	}
+
+	switch d.conflictPolicy {
+	case ConflictKeepLocal:
+		d.logger.Infof("Conflict on node %s from peer %s, keeping local version", local.ID, label)
+	case ConflictErrorLog:
+		d.logger.Errorf("Conflict on node %s from peer %s: local and remote content differ", local.ID, label)
+	case ConflictKeepRemote:
+		if err := d.checkNodeKeys(remote); err != nil {
+			d.logger.Warnf("Rejecting remote version of %s from peer %s: %v", remote.ID, label, err)
+			cycle.SkippedInvalid++
+			return false, nil
+		}
+		if err := d.validateParents(remote.ID, remote.Parents); err != nil {
+			d.logger.Warnf("Rejecting remote version of %s from peer %s: %v", remote.ID, label, err)
+			cycle.SkippedInvalid++
+			return false, nil
+		}
+		if err := d.store.AddNode(remote); err != nil {
+			return false, fmt.Errorf("failed to replace node %s: %v", remote.ID, err)
+		}
+		d.logger.Infof("Conflict on node %s from peer %s, replaced with remote version", remote.ID, label)
+		return true, nil
+	}
+	return false, nil
+}
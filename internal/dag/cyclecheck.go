@@ -0,0 +1,92 @@
+package dag
+
+import (
+	"fmt"
+)
+
+// CycleCheck selects how much AddNode validates a new node's parents.
+type CycleCheck string
+
+const (
+	// CycleCheckStrict runs the parent checks and then walks every ancestor
+	// of the parents, rejecting the node if it is reachable from itself. It
+	// walks even when the child index names no children of the node, so an
+	// index left stale by an interrupted write cannot hide a cycle.
+	CycleCheckStrict CycleCheck = "strict"
+	// CycleCheckParentsOnly rejects self-parents and missing parents, and
+	// walks the ancestors of the parents only when the child index shows the
+	// node is already named as a parent.
+	CycleCheckParentsOnly CycleCheck = "parents-only"
+	// CycleCheckNone trusts the input and skips all parent validation. A
+	// node naming itself, a missing parent or a descendant as a parent is
+	// stored as is and can corrupt tip selection, cumulative weights and
+	// traversals; only use it for pipelines that validate upstream.
+	CycleCheckNone CycleCheck = "none"
+)
+
+// ParseCycleCheck validates a configured strategy. An empty value selects
+// CycleCheckParentsOnly.
+func ParseCycleCheck(s string) (CycleCheck, error) {
+	switch c := CycleCheck(s); c {
+	case "":
+		return CycleCheckParentsOnly, nil
+	case CycleCheckStrict, CycleCheckParentsOnly, CycleCheckNone:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown cycle check %q", s)
+}
+
+// WithCycleCheck sets the parent validation strategy used by AddNode. It
+// defaults to CycleCheckParentsOnly.
+func WithCycleCheck(c CycleCheck) Option {
+	return func(d *DAG) {
+		if c != "" {
+			d.cycleCheck = c
+		}
+	}
+}
+
+// validateParents runs the configured cycle check for a node being added.
+func (d *DAG) validateParents(nodeID string, parents []string) error {
+	switch d.cycleCheck {
+	case CycleCheckNone:
+		return nil
+	case CycleCheckStrict:
+		if err := d.checkCycle(nodeID, parents); err != nil {
+			return err
+		}
+		return d.checkReachable(nodeID, parents)
+	default:
+		return d.checkCycle(nodeID, parents)
+	}
+}
+
+// checkReachable walks the ancestors of parents and fails if nodeID is one of
+// them. Missing ancestors are skipped.
+func (d *DAG) checkReachable(nodeID string, parents []string) error {
+	seen := make(map[string]struct{}, len(parents))
+	queue := append([]string{}, parents...)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[current]; ok {
+			continue
+		}
+		seen[current] = struct{}{}
+
+		node, err := d.getNodeInternal(current)
+		if err != nil {
+			return fmt.Errorf("failed to check ancestor %s: %v", current, err)
+		}
+		if node == nil {
+			continue
+		}
+		for _, p := range node.Parents {
+			if p == nodeID {
+				return fmt.Errorf("cycle detected: node %s is an ancestor of its parent %s", nodeID, current)
+			}
+			queue = append(queue, p)
+		}
+	}
+	return nil
+}
@@ -1,476 +1,1459 @@
-package dag
-
-import (
-	"encoding/json"
-	"fmt"
-	"math"
-	"math/rand"
-	"net/http"
-	"sync"
-	"time"
-
-	"github.com/sirupsen/logrus"
-	"github.com/sivaram/dag-leveldb/internal/store"
-)
-
-type DAG struct {
-	store         *store.Store
-	logger        *logrus.Logger
-	maxParents    int
-	defaultWeight float64
-	mu            sync.RWMutex
-}
-
-func New(store *store.Store, logger *logrus.Logger, maxParents int, defaultWeight float64) *DAG {
-	if maxParents <= 0 {
-		maxParents = 2
-	}
-	if defaultWeight <= 0 {
-		defaultWeight = 1.0
-	}
-	return &DAG{store: store, logger: logger, maxParents: maxParents, defaultWeight: defaultWeight}
-}
-
-func (d *DAG) AddNode(node *store.Node) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	d.logger.Infof("Adding node: %s", node.ID)
-
-	existingNode, err := d.getNodeInternal(node.ID)
-	if err != nil {
-		d.logger.Errorf("Error checking for existing node %s: %v", node.ID, err)
-		return fmt.Errorf("failed to check existing node: %v", err)
-	}
-	if existingNode != nil {
-		d.logger.Warnf("Node with ID %s already exists", node.ID)
-		return fmt.Errorf("node with ID %s already exists", node.ID)
-	}
-
-	// Only select tips if parents is not explicitly provided (i.e., null in JSON)
-	// If parents: [] is sent, keep it as empty
-	if node.Parents == nil {
-		selectedTips, err := d.selectTipsMCMCInternal(2)
-		if err != nil {
-			d.logger.Warnf("Failed to select tips via MCMC: %v", err)
-			if err.Error() != "no nodes in DAG" {
-				return fmt.Errorf("failed to select parents: %v", err)
-			}
-		} else {
-			node.Parents = selectedTips
-			d.logger.Infof("Auto-selected parents (MCMC) for %s: %v", node.ID, node.Parents)
-		}
-	}
-
-	if d.maxParents > 0 && len(node.Parents) > d.maxParents {
-		return fmt.Errorf("node %s has too many parents: %d, max allowed: %d", node.ID, len(node.Parents), d.maxParents)
-	}
-
-	if err := d.checkCycle(node.ID, node.Parents); err != nil {
-		d.logger.Warnf("Cycle check failed for node %s: %v", node.ID, err)
-		return err
-	}
-
-	if node.Weight == 0 {
-		node.Weight = d.defaultWeight
-	}
-	node.CumulativeWeight = node.Weight
-
-	if err := d.store.AddNode(node); err != nil {
-		d.logger.Errorf("Failed to store node %s: %v", node.ID, err)
-		return fmt.Errorf("failed to store node: %v", err)
-	}
-
-	d.logger.Infof("Node %s added with weight %f", node.ID, node.Weight)
-
-	if err := d.updateCumulativeWeights(node, node.Weight); err != nil {
-		d.logger.Errorf("Failed to update cumulative weights for node %s: %v", node.ID, err)
-		return fmt.Errorf("failed to update weights: %v", err)
-	}
-
-	return nil
-}
-
-func (d *DAG) GetAllNodes() ([]store.Node, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	nodes := []store.Node{}
-	iter := d.store.Iterator()
-	defer iter.Release()
-	for iter.Next() {
-		var node store.Node
-		if err := json.Unmarshal(iter.Value(), &node); err != nil {
-			d.logger.Errorf("Failed to unmarshal node: %v", err)
-			continue
-		}
-		nodes = append(nodes, node)
-	}
-	return nodes, nil
-}
-
-func (d *DAG) checkCycle(nodeID string, parents []string) error {
-	for _, parentID := range parents {
-		if parentID == nodeID {
-			return fmt.Errorf("cycle detected: node %s cannot be its own parent", nodeID)
-		}
-		p, err := d.getNodeInternal(parentID)
-		if err != nil {
-			d.logger.Errorf("Error checking parent %s: %v", parentID, err)
-			return fmt.Errorf("failed to check parent %s: %v", parentID, err)
-		}
-		if p == nil {
-			return fmt.Errorf("parent %s does not exist", parentID)
-		}
-	}
-	return nil
-}
-
-func (d *DAG) updateCumulativeWeights(node *store.Node, delta float64) error {
-	if len(node.Parents) == 0 {
-		return nil
-	}
-
-	ancestors := make(map[string]struct{})
-	queue := make([]string, 0, len(node.Parents))
-	for _, p := range node.Parents {
-		if _, seen := ancestors[p]; !seen {
-			ancestors[p] = struct{}{}
-			queue = append(queue, p)
-		}
-	}
-
-	for len(queue) > 0 {
-		current := queue[0]
-		queue = queue[1:]
-
-		parent, err := d.getNodeInternal(current)
-		if err != nil {
-			d.logger.Errorf("Error fetching parent %s: %v", current, err)
-			return fmt.Errorf("failed to fetch parent %s: %v", current, err)
-		}
-		if parent == nil {
-			continue
-		}
-
-		for _, gp := range parent.Parents {
-			if _, seen := ancestors[gp]; !seen {
-				ancestors[gp] = struct{}{}
-				queue = append(queue, gp)
-			}
-		}
-	}
-
-	for ancID := range ancestors {
-		anc, err := d.getNodeInternal(ancID)
-		if err != nil {
-			d.logger.Errorf("Error fetching ancestor %s: %v", ancID, err)
-			return fmt.Errorf("failed to fetch ancestor %s: %v", ancID, err)
-		}
-		if anc == nil {
-			continue
-		}
-
-		anc.CumulativeWeight += delta
-		if anc.CumulativeWeight < anc.Weight {
-			anc.CumulativeWeight = anc.Weight
-		}
-
-		if err := d.store.AddNode(anc); err != nil {
-			d.logger.Errorf("Failed to update ancestor %s: %v", ancID, err)
-			return fmt.Errorf("failed to update ancestor %s: %v", ancID, err)
-		}
-	}
-
-	return nil
-}
-
-func (d *DAG) SyncWithPeer(peerAddr string) ([]string, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	d.logger.Infof("Syncing with peer: %s", peerAddr)
-
-	client := &http.Client{
-		Timeout: 5 * time.Second,
-	}
-	resp, err := client.Get(peerAddr + "/nodes")
-	if err != nil {
-		d.logger.Errorf("Failed to fetch nodes from peer %s: %v", peerAddr, err)
-		return nil, fmt.Errorf("failed to fetch nodes from peer %s: %v", peerAddr, err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		d.logger.Errorf("Peer %s returned status %d", peerAddr, resp.StatusCode)
-		return nil, fmt.Errorf("peer %s returned status %d", peerAddr, resp.StatusCode)
-	}
-
-	var nodes []store.Node
-	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
-		d.logger.Errorf("Failed to decode nodes from peer %s: %v", peerAddr, err)
-		return nil, fmt.Errorf("failed to decode nodes: %v", err)
-	}
-
-	mergedNodes := []string{}
-	for _, node := range nodes {
-		existing, err := d.getNodeInternal(node.ID)
-		if err != nil {
-			d.logger.Errorf("Error checking node %s: %v", node.ID, err)
-			continue
-		}
-		if existing != nil {
-			d.logger.Debugf("Node %s already exists, skipping", node.ID)
-			continue
-		}
-
-		if err := d.checkCycle(node.ID, node.Parents); err != nil {
-			d.logger.Warnf("Cycle check failed for node %s from peer %s: %v", node.ID, peerAddr, err)
-			continue
-		}
-
-		if d.maxParents > 0 && len(node.Parents) > d.maxParents {
-			d.logger.Warnf("Node %s has too many parents: %d, max allowed: %d", node.ID, len(node.Parents), d.maxParents)
-			continue
-		}
-
-		if node.Weight == 0 {
-			node.Weight = d.defaultWeight
-		}
-		node.CumulativeWeight = node.Weight
-
-		if err := d.store.AddNode(&node); err != nil {
-			d.logger.Errorf("Failed to add node %s from peer %s: %v", node.ID, peerAddr, err)
-			continue
-		}
-		d.logger.Infof("Node %s merged from peer %s with weight %f", node.ID, peerAddr, node.Weight)
-		mergedNodes = append(mergedNodes, node.ID)
-
-		if err := d.updateCumulativeWeights(&node, node.Weight); err != nil {
-			d.logger.Errorf("Failed to update weights for node %s: %v", node.ID, err)
-		}
-	}
-
-	if len(mergedNodes) == 0 {
-		d.logger.Warnf("No new nodes merged from peer %s", peerAddr)
-	} else {
-		d.logger.Infof("Merged %d nodes from peer %s: %v", len(mergedNodes), peerAddr, mergedNodes)
-	}
-	return mergedNodes, nil
-}
-
-func (d *DAG) SelectTipsMCMC(maxTips int) ([]string, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-	return d.selectTipsMCMCInternal(maxTips)
-}
-
-func (d *DAG) selectTipsMCMCInternal(maxTips int) ([]string, error) {
-	if maxTips <= 0 {
-		maxTips = d.maxParents
-	}
-	tips := make(map[string]struct{})
-	maxAttempts := 10 * maxTips
-
-	nodeCount := 0
-	iter := d.store.Iterator()
-	for iter.Next() {
-		nodeCount++
-	}
-	iter.Release()
-	if nodeCount == 0 {
-		return nil, fmt.Errorf("no nodes in DAG")
-	}
-	maxWalkSteps := max(10, nodeCount/2)
-
-	for len(tips) < maxTips && maxAttempts > 0 {
-		startNode, err := d.getRandomNode()
-		if err != nil {
-			return nil, err
-		}
-
-		current := startNode
-		for steps := 0; steps < maxWalkSteps; steps++ {
-			isTip, err := d.isTipInternal(current.ID)
-			if err != nil {
-				return nil, err
-			}
-			if isTip {
-				tips[current.ID] = struct{}{}
-				break
-			}
-
-			children, err := d.getChildren(current.ID)
-			if err != nil {
-				return nil, err
-			}
-			if len(children) == 0 {
-				tips[current.ID] = struct{}{}
-				break
-			}
-
-			current = weightedRandomChoice(children)
-		}
-		maxAttempts--
-	}
-
-	if len(tips) == 0 {
-		d.logger.Warnf("No tips found after %d attempts", maxAttempts)
-		return nil, fmt.Errorf("no tips available")
-	}
-
-	result := make([]string, 0, len(tips))
-	for id := range tips {
-		result = append(result, id)
-	}
-	return result, nil
-}
-
-func max(a, b int) int {
-	if a > b {
-		return a
-	}
-	return b
-}
-
-func (d *DAG) getRandomNode() (*store.Node, error) {
-	iter := d.store.Iterator()
-	defer iter.Release()
-
-	count := 0
-	keys := []string{}
-	for iter.Next() {
-		var node store.Node
-		if err := json.Unmarshal(iter.Value(), &node); err != nil {
-			continue
-		}
-		keys = append(keys, node.ID)
-		count++
-	}
-	if count == 0 {
-		return nil, fmt.Errorf("no nodes in DAG")
-	}
-
-	target := rand.Intn(count)
-	return d.getNodeInternal(keys[target])
-}
-
-func (d *DAG) getChildren(parentID string) ([]*store.Node, error) {
-	iter := d.store.Iterator()
-	defer iter.Release()
-
-	children := []*store.Node{}
-	for iter.Next() {
-		var node store.Node
-		if err := json.Unmarshal(iter.Value(), &node); err != nil {
-			return nil, err
-		}
-		for _, p := range node.Parents {
-			if p == parentID {
-				children = append(children, &node)
-				break
-			}
-		}
-	}
-	return children, nil
-}
-
-func weightedRandomChoice(nodes []*store.Node) *store.Node {
-	totalWeight := 0.0
-	for _, n := range nodes {
-		totalWeight += math.Max(n.CumulativeWeight, 0.0001)
-	}
-
-	r := rand.Float64() * totalWeight
-	cumSum := 0.0
-	for _, n := range nodes {
-		cumSum += math.Max(n.CumulativeWeight, 0.0001)
-		if r <= cumSum {
-			return n
-		}
-	}
-
-	return nodes[len(nodes)-1]
-}
-
-func (d *DAG) GetNode(id string) (*store.Node, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	d.logger.Infof("Fetching node: %s", id)
-	return d.getNodeInternal(id)
-}
-
-func (d *DAG) getNodeInternal(id string) (*store.Node, error) {
-	return d.store.GetNode(id)
-}
-
-func (d *DAG) IsTip(id string) (bool, error) {
-	d.mu.RLock()
-	defer d.mu.RUnlock()
-
-	return d.isTipInternal(id)
-}
-
-func (d *DAG) isTipInternal(id string) (bool, error) {
-	iter := d.store.Iterator()
-	defer iter.Release()
-
-	for iter.Next() {
-		var node store.Node
-		if err := json.Unmarshal(iter.Value(), &node); err != nil {
-			return false, err
-		}
-		for _, parent := range node.Parents {
-			if parent == id {
-				return false, nil
-			}
-		}
-	}
-
-	return true, nil
-}
-
-func (d *DAG) DeleteNode(id string) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	d.logger.Infof("Deleting node: %s", id)
-
-	node, err := d.getNodeInternal(id)
-	if err != nil {
-		return err
-	}
-	if node == nil {
-		return fmt.Errorf("node with ID %s not found", id)
-	}
-
-	iter := d.store.Iterator()
-	defer iter.Release()
-	for iter.Next() {
-		var n store.Node
-		if err := json.Unmarshal(iter.Value(), &n); err != nil {
-			return err
-		}
-		for _, parentID := range n.Parents {
-			if parentID == id {
-				return fmt.Errorf("cannot delete node %s because it has children", id)
-			}
-		}
-	}
-
-	if err := d.updateCumulativeWeights(node, -node.Weight); err != nil {
-		d.logger.Errorf("Failed to update cumulative weights during delete: %v", err)
-		return fmt.Errorf("failed to update weights: %v", err)
-	}
-
-	if err := d.store.DeleteNode(id); err != nil {
-		return fmt.Errorf("failed to delete node: %v", err)
-	}
-
-	return nil
-}
-
-func (d *DAG) Logger() *logrus.Logger {
-	return d.logger
-}
+package dag
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+type DAG struct {
+	store         *store.Store
+	logger        *logrus.Logger
+	maxParents    int
+	defaultWeight float64
+	autoParents   int
+	minParents    int
+	httpClient    *http.Client
+
+	allowMultipleGenesis  bool
+	scanBatchSize         int
+	maxStoreBytes         int64
+	storeBytes            atomic.Int64
+	clusterToken          string
+	peerAuth              map[string]PeerCredentials
+	conflictPolicy        ConflictPolicy
+	maxSyncResponseBytes  int64
+	events                *eventPublisher
+	tipDiversity          float64
+	confirmationThreshold float64
+	coalescer             *weightCoalescer
+	peerFilters           map[string]PeerFilter
+	requireTipParents     bool
+	nonTipAttachments     atomic.Int64
+	maxAncestorUpdates    int
+	deferredWeights       atomic.Int64
+	walkStart             WalkStart
+	allowedTypes          map[string]bool
+	maxIDLength           int
+	maxDepthDiff          int
+	depths                map[string]int
+	walkStartWindow       int
+	tipSelector           TipSelector
+	tipBias               bool
+	alpha                 float64
+	cycleCheck            CycleCheck
+	building              atomic.Bool
+	indexBuildFailed      atomic.Bool
+	storeDown             atomic.Bool
+	awaitingPeerSync      atomic.Bool
+	metrics               metricsState
+	unrecoverable         atomic.Int64
+	softDelete            bool
+	tombstoneTTL          time.Duration
+	maintenance           maintenanceState
+	primaryAddr           string
+	replication           *replicationState
+	mu                    dagLock
+	peers                 peerRegistry
+	cursors               cursorStore
+}
+
+// New returns a DAG over store. maxParents caps the parents of every node
+// added, batched, imported or merged from a peer; zero or less selects 2.
+// defaultWeight is given to nodes without a weight; zero or less selects 1.
+func New(store *store.Store, logger *logrus.Logger, maxParents int, defaultWeight float64, opts ...Option) *DAG {
+	if maxParents <= 0 {
+		maxParents = 2
+	}
+	if defaultWeight <= 0 {
+		defaultWeight = 1.0
+	}
+	d := &DAG{store: store, logger: logger, maxParents: maxParents, defaultWeight: defaultWeight, allowMultipleGenesis: true, conflictPolicy: ConflictSkip, cycleCheck: CycleCheckParentsOnly, tipSelector: MCMCSelector{}, maxIDLength: DefaultMaxIDLength}
+	d.httpClient = newSyncHTTPClient(SyncHTTPOptions{})
+	d.maxSyncResponseBytes = defaultMaxSyncResponseBytes
+	d.loadPeers()
+	d.loadDeferredWeights()
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.autoParents <= 0 {
+		d.autoParents = min(2, d.maxParents)
+	}
+	if d.autoParents > d.maxParents {
+		d.logger.Warnf("auto_parents %d exceeds max_parents %d, using %d", d.autoParents, d.maxParents, d.maxParents)
+		d.autoParents = d.maxParents
+	}
+	if d.minParents > d.maxParents {
+		d.logger.Warnf("min_parents %d exceeds max_parents %d, using %d", d.minParents, d.maxParents, d.maxParents)
+		d.minParents = d.maxParents
+	}
+	if d.autoParents < d.minParents {
+		d.autoParents = d.minParents
+	}
+	d.RefreshStoreSize()
+	return d
+}
+
+func (d *DAG) AddNode(node *store.Node) error {
+	return d.addNode(node, false)
+}
+
+// DryRunAddNode runs the same validation and parent selection as AddNode and
+// fills in node as it would be stored, without writing anything.
+func (d *DAG) DryRunAddNode(node *store.Node) error {
+	return d.addNode(node, true)
+}
+
+func (d *DAG) addNode(node *store.Node, dryRun bool) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if dryRun {
+		d.logger.Infof("Dry run adding node: %s", node.ID)
+	} else {
+		d.logger.Infof("Adding node: %s", node.ID)
+	}
+	if err := d.checkNodeKeys(node); err != nil {
+		d.logger.Warnf("Rejecting node: %v", err)
+		return err
+	}
+
+	existingNode, err := d.getNodeInternal(node.ID)
+	if err != nil {
+		return d.storeFailure("failed to check existing node", err)
+	}
+	if existingNode != nil {
+		d.logger.Warnf("Node with ID %s already exists", node.ID)
+		return fmt.Errorf("node with ID %s already exists", node.ID)
+	}
+	if err := d.checkType(node); err != nil {
+		d.logger.Warnf("Rejecting node %s: %v", node.ID, err)
+		return err
+	}
+
+	// Only select tips if parents is not explicitly provided (i.e., null in JSON)
+	// If parents: [] is sent, keep it as empty
+	supplied := node.Parents != nil
+	if node.Parents == nil {
+		selectedTips, err := d.selectParents()
+		switch {
+		case errors.Is(err, ErrEmptyDAG):
+			node.Parents = []string{}
+			d.logger.Infof("DAG is empty, adding %s as genesis", node.ID)
+		case err != nil:
+			d.logger.Warnf("Failed to select tips via MCMC: %v", err)
+			return fmt.Errorf("failed to select parents: %w", err)
+		default:
+			node.Parents = selectedTips
+			d.logger.Infof("Auto-selected parents (MCMC) for %s: %v", node.ID, node.Parents)
+		}
+	}
+
+	if len(node.Parents) > d.maxParents {
+		return fmt.Errorf("node %s has too many parents: %d, max allowed: %d", node.ID, len(node.Parents), d.maxParents)
+	}
+	if len(node.Parents) > 0 && len(node.Parents) < d.minParents {
+		return fmt.Errorf("%w: node %s has %d parents, min required: %d", ErrTooFewParents, node.ID, len(node.Parents), d.minParents)
+	}
+
+	if err := d.checkGenesis(node); err != nil {
+		d.logger.Warnf("Genesis check failed for node %s: %v", node.ID, err)
+		return err
+	}
+
+	if err := d.validateParents(node.ID, node.Parents); err != nil {
+		d.logger.Warnf("Cycle check failed for node %s: %v", node.ID, err)
+		return err
+	}
+
+	if err := d.checkDepthSpread(node.ID, node.Parents, d.depth); err != nil {
+		d.logger.Warnf("Rejecting node %s: %v", node.ID, err)
+		return err
+	}
+
+	if supplied {
+		if err := d.checkTipParents(node, dryRun, d.isTipInternal); err != nil {
+			return err
+		}
+	}
+
+	if node.Weight == 0 {
+		node.Weight = d.defaultWeight
+	}
+	node.CumulativeWeight = node.Weight
+	// A new node's creation time is the store's, whatever a client sent.
+	node.CreatedAt = time.Time{}
+
+	if err := d.checkStoreSize(); err != nil {
+		d.logger.Warnf("Rejecting node %s: %v", node.ID, err)
+		return err
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	// The node and its ancestors' new cumulative weights are written in one
+	// batch, so a store failure cannot leave the node without its weight.
+	// With coalescing only the node is written and the deltas are queued.
+	// Past the ancestor cap only the node is written, with its deferred
+	// mark.
+	deltas := make(map[string]float64)
+	err = d.addWeightDeltas(node, node.Weight, deltas, d.maxAncestorUpdates)
+	deferred := errors.Is(err, errTooManyAncestors)
+	if err != nil && !deferred {
+		return d.storeFailure("failed to update weights", err)
+	}
+	var ancestors []*store.Node
+	if d.coalescer == nil {
+		var err error
+		if ancestors, err = d.weightUpdates(deltas); err != nil {
+			return d.storeFailure("failed to update weights", err)
+		}
+	}
+	var deferrals []*store.Node
+	if deferred {
+		deferrals = []*store.Node{node}
+	}
+	if err := d.storeNodes(append([]*store.Node{node}, ancestors...), deferrals); err != nil {
+		return d.storeFailure("failed to store node", err)
+	}
+	d.queueWeightDeltas(deltas)
+	d.recordWrite(node)
+
+	d.logger.Infof("Node %s added with weight %f", node.ID, node.Weight)
+
+	d.emit(EventNodeAdded, node.ID, node)
+	if d.IsConfirmed(node) {
+		d.emit(EventNodeConfirmed, node.ID, node)
+	}
+	d.emitConfirmed(ancestors, deltas)
+	return nil
+}
+
+func (d *DAG) GetAllNodes() ([]store.Node, error) {
+	nodes := []store.Node{}
+	err := d.scanNodes(func(node *store.Node) {
+		nodes = append(nodes, *node)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// selectParentsAttempts bounds how many selection rounds selectParents runs
+// while trying to gather minParents distinct tips.
+const selectParentsAttempts = 5
+
+// selectParents picks autoParents tips for a node added with null parents,
+// retrying until at least minParents distinct tips have been found. It never
+// returns more than maxParents, so addNode cannot reject its own selection.
+func (d *DAG) selectParents() ([]string, error) {
+	want := min(d.autoParents, d.maxParents)
+	selected := map[string]struct{}{}
+	result := []string{}
+	for attempt := 0; attempt < selectParentsAttempts; attempt++ {
+		tips, err := d.tipSelector.SelectTips(d, want)
+		if err != nil {
+			return nil, err
+		}
+		for _, tip := range tips {
+			if _, ok := selected[tip]; !ok && len(result) < want {
+				selected[tip] = struct{}{}
+				result = append(result, tip)
+			}
+		}
+		if len(result) >= d.minParents {
+			return result, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: found %d distinct tips, min required: %d", ErrTooFewParents, len(result), d.minParents)
+}
+
+// GenesisNodes returns the IDs of every node without parents, in key order.
+func (d *DAG) GenesisNodes() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	genesis := []string{}
+	iter := d.store.Iterator()
+	defer iter.Release()
+	for iter.Next() {
+		var node store.Node
+		if err := json.Unmarshal(iter.Value(), &node); err != nil {
+			d.logger.Errorf("Failed to unmarshal node: %v", err)
+			continue
+		}
+		if len(node.Parents) == 0 {
+			genesis = append(genesis, node.ID)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate nodes: %v", err)
+	}
+	return genesis, nil
+}
+
+// GetTips returns the ID of every node without children in ID order. Unlike
+// the MCMC selection it is the full, deterministic tip set; it reads keys and
+// the children index only, never the node records.
+func (d *DAG) GetTips() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.getTipsInternal()
+}
+
+func (d *DAG) getTipsInternal() ([]string, error) {
+	tips := []string{}
+	iter := d.store.Iterator()
+	defer iter.Release()
+	for iter.Next() {
+		id := string(iter.Key())
+		isTip, err := d.isTipInternal(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read children of %s: %v", id, err)
+		}
+		if isTip {
+			tips = append(tips, id)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate nodes: %v", err)
+	}
+	return tips, nil
+}
+
+// EnsureGenesis adds a genesis node with the given ID and data when the store
+// holds no nodes, giving clients an attachment point from the first request.
+// It reports whether the node was created.
+func (d *DAG) EnsureGenesis(id, data string) (bool, error) {
+	d.mu.RLock()
+	iter := d.store.Iterator()
+	empty := !iter.Next()
+	iter.Release()
+	d.mu.RUnlock()
+	if !empty {
+		return false, nil
+	}
+
+	if err := d.AddNode(&store.Node{ID: id, Data: data, Parents: []string{}}); err != nil {
+		return false, fmt.Errorf("failed to create genesis node %s: %w", id, err)
+	}
+	return true, nil
+}
+
+// checkTipParents flags parents of node that are no longer tips according to
+// isTip, rejecting the node when tip parents are required.
+func (d *DAG) checkTipParents(node *store.Node, dryRun bool, isTip func(string) (bool, error)) error {
+	var stale []string
+	for _, p := range node.Parents {
+		isTip, err := isTip(p)
+		if err != nil {
+			return d.storeFailure("failed to check parent "+p, err)
+		}
+		if !isTip {
+			stale = append(stale, p)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	if d.requireTipParents {
+		d.logger.Warnf("Rejecting node %s: parents %v are not tips", node.ID, stale)
+		return fmt.Errorf("%w: node %s attaches to %v", ErrNonTipParent, node.ID, stale)
+	}
+	d.logger.Warnf("Node %s attaches to non-tip parents %v", node.ID, stale)
+	if !dryRun {
+		d.nonTipAttachments.Add(1)
+	}
+	return nil
+}
+
+// checkType rejects a node whose type is not in the allowed set, when one
+// is configured. Untyped nodes are always accepted.
+func (d *DAG) checkType(node *store.Node) error {
+	if node.Type == "" || d.allowedTypes == nil || d.allowedTypes[node.Type] {
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrTypeNotAllowed, node.Type)
+}
+
+// checkGenesis rejects a parentless node on a non-empty DAG unless multiple
+// genesis nodes are allowed.
+func (d *DAG) checkGenesis(node *store.Node) error {
+	if d.allowMultipleGenesis || len(node.Parents) > 0 {
+		return nil
+	}
+	iter := d.store.Iterator()
+	defer iter.Release()
+	if iter.Next() {
+		return fmt.Errorf("%w: node %s has no parents, attach it to existing tips instead", ErrMultipleGenesis, node.ID)
+	}
+	return nil
+}
+
+// checkCycle rejects self-parents, missing parents and parents that descend
+// from nodeID. Only an ID some node already names as a parent can be its
+// own ancestor, as when a peer sends a child before its parent or replaces
+// a node that has children, so the ancestor walk runs only then.
+func (d *DAG) checkCycle(nodeID string, parents []string) error {
+	for _, parentID := range parents {
+		if parentID == nodeID {
+			return fmt.Errorf("cycle detected: node %s cannot be its own parent", nodeID)
+		}
+		p, err := d.getNodeInternal(parentID)
+		if err != nil {
+			return d.storeFailure("failed to check parent "+parentID, err)
+		}
+		if p == nil {
+			return &ErrParentNotFound{ParentID: parentID}
+		}
+	}
+	referenced, err := d.store.HasChildren(nodeID)
+	if err != nil {
+		return d.storeFailure("failed to check children of "+nodeID, err)
+	}
+	if referenced {
+		return d.checkReachable(nodeID, parents)
+	}
+	return nil
+}
+
+func (d *DAG) updateCumulativeWeights(node *store.Node, delta float64) error {
+	deltas := make(map[string]float64)
+	if err := d.addWeightDeltas(node, delta, deltas, 0); err != nil {
+		return err
+	}
+	return d.commitWeightDeltas(deltas)
+}
+
+// addWeightDeltas adds delta to deltas for every ancestor of node. Each
+// ancestor gets delta once however many paths reach it, so in a diamond the
+// shared ancestor counts the node once, as RecomputeCumulativeWeights does.
+// Deltas from several nodes can be accumulated and applied together, so
+// ancestors shared by a batch are rewritten once. If limit is positive and
+// node has more ancestors, errTooManyAncestors is returned and deltas is
+// unchanged.
+func (d *DAG) addWeightDeltas(node *store.Node, delta float64, deltas map[string]float64, limit int) error {
+	return d.addWeightDeltasWith(node, delta, deltas, limit, d.getNodeInternal)
+}
+
+// addWeightDeltasWith is addWeightDeltas reading ancestors through lookup.
+func (d *DAG) addWeightDeltasWith(node *store.Node, delta float64, deltas map[string]float64, limit int, lookup func(string) (*store.Node, error)) error {
+	if len(node.Parents) == 0 {
+		return nil
+	}
+
+	ancestors := make(map[string]struct{})
+	queue := make([]string, 0, len(node.Parents))
+	for _, p := range node.Parents {
+		if _, seen := ancestors[p]; !seen {
+			ancestors[p] = struct{}{}
+			queue = append(queue, p)
+		}
+	}
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		parent, err := lookup(current)
+		if err != nil {
+			d.logger.Errorf("Error fetching parent %s: %v", current, err)
+			return fmt.Errorf("failed to fetch parent %s: %v", current, err)
+		}
+		if parent == nil {
+			continue
+		}
+
+		for _, gp := range parent.Parents {
+			if _, seen := ancestors[gp]; !seen {
+				ancestors[gp] = struct{}{}
+				queue = append(queue, gp)
+			}
+		}
+		if limit > 0 && len(ancestors) > limit {
+			return errTooManyAncestors
+		}
+	}
+
+	for ancID := range ancestors {
+		deltas[ancID] += delta
+	}
+	return nil
+}
+
+// applyWeightDeltas adds each accumulated delta to its node's cumulative
+// weight and writes the updated nodes in one batch.
+func (d *DAG) applyWeightDeltas(deltas map[string]float64) error {
+	updated, err := d.weightUpdates(deltas)
+	if err != nil {
+		return err
+	}
+	if err := d.store.AddNodes(updated); err != nil {
+		d.logger.Errorf("Failed to update ancestor weights: %v", err)
+		return fmt.Errorf("failed to update ancestor weights: %v", err)
+	}
+	d.emitConfirmed(updated, deltas)
+	return nil
+}
+
+// weightUpdates returns the nodes in deltas with their deltas applied,
+// without writing them.
+func (d *DAG) weightUpdates(deltas map[string]float64) ([]*store.Node, error) {
+	ids := make([]string, 0, len(deltas))
+	for id := range deltas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	updated := make([]*store.Node, 0, len(ids))
+	for _, ancID := range ids {
+		anc, err := d.store.GetNode(ancID)
+		if err != nil {
+			d.logger.Errorf("Error fetching ancestor %s: %v", ancID, err)
+			return nil, fmt.Errorf("failed to fetch ancestor %s: %v", ancID, err)
+		}
+		if anc == nil {
+			continue
+		}
+
+		anc.CumulativeWeight += deltas[ancID]
+		if anc.CumulativeWeight < anc.Weight {
+			anc.CumulativeWeight = anc.Weight
+		}
+		updated = append(updated, anc)
+	}
+	return updated, nil
+}
+
+// RecomputeCumulativeWeights rebuilds every node's cumulative weight from
+// scratch: a node's cumulative weight is its own weight plus the weight of
+// every distinct descendant. A descendant reached along several paths, as
+// through both sides of a diamond, is counted once, which is also what the
+// incremental updates on AddNode and DeleteNode maintain.
+//
+// With a scan batch size configured the graph is read from a snapshot and the
+// weights are corrected in batches, so writes are not blocked for the whole
+// recompute and the weight they add meanwhile is kept. A read replica takes
+// its weights from the primary and returns ErrReadOnly.
+func (d *DAG) RecomputeCumulativeWeights() error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if d.scanBatchSize > 0 {
+		return d.recomputeCumulativeWeightsBatched()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.recomputeCumulativeWeights()
+}
+
+func (d *DAG) recomputeCumulativeWeights() error {
+	defer d.metrics.observeRecompute(time.Now())
+	// The recompute writes every weight from scratch, so pending deltas
+	// would be counted twice; so would deferred weights. Its callers
+	// rewire parents, so cached depths are dropped too.
+	d.takePendingWeights()
+	d.forgetDepths()
+	deferred, err := d.store.DeferredWeights()
+	if err != nil {
+		return fmt.Errorf("failed to read deferred weights: %v", err)
+	}
+	nodes, children, err := d.loadGraph()
+	if err != nil {
+		return err
+	}
+	if err := d.clearDeferred(deferred); err != nil {
+		return fmt.Errorf("failed to clear deferred weights: %v", err)
+	}
+
+	for id, node := range nodes {
+		total := coneWeight(id, nodes, children)
+		if node.CumulativeWeight == total {
+			continue
+		}
+		node.CumulativeWeight = total
+		if err := d.store.AddNode(node); err != nil {
+			d.logger.Errorf("Failed to store recomputed weight for %s: %v", id, err)
+			return fmt.Errorf("failed to update node %s: %v", id, err)
+		}
+	}
+
+	d.logger.Infof("Recomputed cumulative weights for %d nodes", len(nodes))
+	return nil
+}
+
+// SyncWithPeer pulls new nodes from a peer and merges them. The peer is read
+// before the DAG lock is taken, so a slow or unreachable peer delays only the
+// sync and not the node's reads and writes; only the merge holds the lock.
+// Missing parents pulled under ParentPull are fetched before the lock too and
+// merged as part of the batch. A node whose parents are missing waits until
+// the rest of the batch is merged and is retried until a pass merges none of the waiting
+// nodes; those left are counted as dangling and hold the cursor back.
+// Cancelling ctx aborts the requests to the peer and stops the merge after
+// the current node; what was merged by then is kept.
+func (d *DAG) SyncWithPeer(ctx context.Context, peerAddr string) (mergedNodes []string, err error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	peerAddr, err = NormalizePeerAddr(peerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	label := RedactPeerAddr(peerAddr)
+	d.logger.Infof("Syncing with peer: %s", label)
+
+	filter := d.peerFilter(peerAddr)
+	since := d.peers.cursor(label, filter.Prefix)
+	var cycle SyncMetrics
+	var cursor int64
+	start := time.Now()
+	defer func() {
+		cycle.DurationMs = time.Since(start).Milliseconds()
+		d.savePeer(d.peers.record(label, cycle, mergedNodes, cursor, filter.Prefix, err))
+		if err == nil {
+			d.awaitingPeerSync.Store(false)
+		}
+	}()
+
+	fetched, err := d.fetchPeerNodes(ctx, peerAddr, filter.query(since), &cycle)
+	if err != nil {
+		return nil, err
+	}
+	var tombstones []store.Tombstone
+	if d.softDelete && fetched.streamErr == nil {
+		var tombErr error
+		if tombstones, tombErr = d.fetchTombstones(ctx, peerAddr, filter.Prefix); tombErr != nil {
+			d.logger.Warnf("Failed to fetch tombstones from peer %s: %v", label, tombErr)
+		}
+	}
+
+	if filter.Parents == ParentPull {
+		fetched.nodes = d.pullMissingParents(ctx, peerAddr, fetched.nodes, &cycle)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	mergedNodes = []string{}
+	replaced := false
+	// Weight deltas for the ancestors of every merged node, applied in one
+	// batch once every node is merged.
+	deltas := make(map[string]float64)
+	var orphans []*store.Node
+	stopped := false
+	for _, node := range fetched.nodes {
+		if ctx.Err() != nil {
+			break
+		}
+		// Existence is checked under the lock, since the node may have been
+		// added locally while the peer was being read.
+		existing, err := d.getNodeInternal(node.ID)
+		if err != nil {
+			d.logger.Errorf("Error checking node %s: %v", node.ID, err)
+			cycle.Failed++
+			continue
+		}
+		if existing != nil {
+			ok, err := d.resolveConflict(existing, node, label, &cycle)
+			if err != nil {
+				d.logger.Errorf("Failed to resolve conflict on node %s from peer %s: %v", node.ID, label, err)
+				cycle.Failed++
+				continue
+			}
+			if ok {
+				replaced = true
+				mergedNodes = append(mergedNodes, node.ID)
+				cycle.Merged++
+			}
+			continue
+		}
+
+		missing, err := d.missingParent(node)
+		if err != nil {
+			d.logger.Errorf("Error checking parents of node %s: %v", node.ID, err)
+			cycle.Failed++
+			continue
+		}
+		if missing != "" {
+			orphans = append(orphans, node)
+			continue
+		}
+		if err := d.mergePeerNode(peerAddr, node, &cycle, deltas, &mergedNodes); err != nil {
+			d.logger.Warnf("Stopping sync with peer %s: %v", label, err)
+			stopped = true
+			break
+		}
+	}
+	for len(orphans) > 0 && !stopped && ctx.Err() == nil {
+		var waiting []*store.Node
+		for _, node := range orphans {
+			missing, err := d.missingParent(node)
+			if err != nil {
+				d.logger.Errorf("Error checking parents of node %s: %v", node.ID, err)
+				cycle.Failed++
+				continue
+			}
+			if missing != "" {
+				waiting = append(waiting, node)
+				continue
+			}
+			if err := d.mergePeerNode(peerAddr, node, &cycle, deltas, &mergedNodes); err != nil {
+				d.logger.Warnf("Stopping sync with peer %s: %v", label, err)
+				stopped = true
+				break
+			}
+		}
+		if len(waiting) == len(orphans) {
+			break
+		}
+		orphans = waiting
+	}
+	if !stopped && ctx.Err() == nil {
+		for _, node := range orphans {
+			missing, _ := d.missingParent(node)
+			d.logger.Warnf("Not merging node %s from peer %s: parent %s is missing", node.ID, label, missing)
+		}
+		cycle.Dangling = len(orphans)
+	}
+
+	// A replaced node can change any ancestor's weight, so a full recompute
+	// supersedes the accumulated deltas. Either failing fails the sync and
+	// keeps the cursor, so the peer's nodes are offered again.
+	if replaced {
+		if err := d.recomputeCumulativeWeights(); err != nil {
+			return mergedNodes, d.storeFailure("failed to recompute weights after sync with peer "+label, err)
+		}
+	} else if err := d.commitWeightDeltas(deltas); err != nil {
+		return mergedNodes, d.storeFailure("failed to update weights after sync with peer "+label, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return mergedNodes, err
+	}
+	if fetched.streamErr != nil {
+		return mergedNodes, fetched.streamErr
+	}
+	d.syncTombstones(tombstones, label, &cycle)
+	// Peers that predate cursors send no header and are pulled in full.
+	if cycle.Failed == 0 && cycle.SkippedInvalid == 0 && cycle.Dangling == 0 {
+		cursor, _ = strconv.ParseInt(fetched.lastSeq, 10, 64)
+	}
+
+	if len(mergedNodes) == 0 {
+		d.logger.Warnf("No new nodes merged from peer %s", label)
+	} else {
+		d.logger.Infof("Merged %d nodes from peer %s: %v", len(mergedNodes), label, mergedNodes)
+	}
+	return mergedNodes, nil
+}
+
+// missingParent returns the first parent of node that is not stored here, or
+// "" when all are. A node naming itself is left to the cycle check.
+func (d *DAG) missingParent(node *store.Node) (string, error) {
+	for _, p := range node.Parents {
+		if p == node.ID {
+			continue
+		}
+		ok, err := d.store.Has(p)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return p, nil
+		}
+	}
+	return "", nil
+}
+
+// peerNodes is a peer's /nodes response. A stream that breaks off part way
+// keeps the nodes decoded before the break, with the reason in streamErr.
+type peerNodes struct {
+	nodes     []*store.Node
+	lastSeq   string
+	streamErr error
+}
+
+// fetchPeerNodes reads the nodes a peer serves for query. Decoding stops at
+// the response size cap, so a hostile peer cannot exhaust memory.
+func (d *DAG) fetchPeerNodes(ctx context.Context, peerAddr, query string, cycle *SyncMetrics) (*peerNodes, error) {
+	label := RedactPeerAddr(peerAddr)
+	endpoint, err := url.JoinPath(peerAddr, "nodes")
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address %s: %v", label, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+query, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer address %s: %v", label, err)
+	}
+	d.authorizePeerRequest(req, peerAddr)
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		d.logger.Errorf("Failed to fetch nodes from peer %s: %v", label, err)
+		return nil, fmt.Errorf("failed to fetch nodes from peer %s: %w", label, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		d.logger.Errorf("Peer %s returned status %d", label, resp.StatusCode)
+		return nil, fmt.Errorf("peer %s returned status %d", label, resp.StatusCode)
+	}
+
+	limited := &io.LimitedReader{R: resp.Body, N: d.maxSyncResponseBytes + 1}
+	body := &countingReader{r: limited}
+	defer func() { cycle.Bytes = body.n }()
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		d.logger.Errorf("Failed to decode nodes from peer %s: expected a JSON array", label)
+		return nil, fmt.Errorf("failed to decode nodes: expected a JSON array")
+	}
+
+	fetched := &peerNodes{lastSeq: resp.Header.Get(LastSeqHeader)}
+	for dec.More() {
+		var node store.Node
+		if err := dec.Decode(&node); err != nil {
+			if limited.N <= 0 {
+				fetched.streamErr = fmt.Errorf("%w: peer %s sent more than %d bytes", ErrSyncResponseTooLarge, label, d.maxSyncResponseBytes)
+			} else {
+				fetched.streamErr = fmt.Errorf("failed to decode nodes: %v", err)
+			}
+			d.logger.Errorf("Aborting sync with peer %s after %d nodes: %v", label, cycle.Pulled, fetched.streamErr)
+			break
+		}
+		cycle.Pulled++
+		fetched.nodes = append(fetched.nodes, &node)
+	}
+	fetched.nodes = parentsFirst(fetched.nodes)
+	return fetched, nil
+}
+
+// parentsFirst reorders nodes so that every node comes after those of its
+// parents in the same batch. A peer serves nodes in changefeed order, where
+// a parent rewritten after its child comes later; merged in that order the
+// child would be rejected for a missing parent and hold the cursor back.
+// Nodes on a parent cycle keep their order and fail the cycle check.
+func parentsFirst(nodes []*store.Node) []*store.Node {
+	byID := make(map[string]*store.Node, len(nodes))
+	for _, n := range nodes {
+		if _, ok := byID[n.ID]; !ok {
+			byID[n.ID] = n
+		}
+	}
+	ordered := make([]*store.Node, 0, len(nodes))
+	placed := make(map[*store.Node]bool, len(nodes))
+	visiting := make(map[*store.Node]bool)
+	var place func(n *store.Node)
+	place = func(n *store.Node) {
+		if placed[n] || visiting[n] {
+			return
+		}
+		visiting[n] = true
+		for _, p := range n.Parents {
+			if parent, ok := byID[p]; ok {
+				place(parent)
+			}
+		}
+		visiting[n] = false
+		placed[n] = true
+		ordered = append(ordered, n)
+	}
+	for _, n := range nodes {
+		place(n)
+	}
+	return ordered
+}
+
+// SelectTipsMCMC runs MCMC selection whatever TipSelector is configured.
+func (d *DAG) SelectTipsMCMC(maxTips int, opts ...TipOption) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	excluded, err := d.excludedSet(opts)
+	if err != nil {
+		return nil, err
+	}
+	return d.selectTipsMCMCInternal(maxTips, excluded, nil)
+}
+
+// SelectTipsMCMCWithTrace runs the same selection as SelectTipsMCMC and also
+// returns the path every walker took, for debugging tip selection.
+func (d *DAG) SelectTipsMCMCWithTrace(maxTips int, opts ...TipOption) ([]string, *WalkTrace, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	excluded, err := d.excludedSet(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	trace := &WalkTrace{Walks: [][]string{}}
+	tips, err := d.selectTipsMCMCInternal(maxTips, excluded, trace)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tips, trace, nil
+}
+
+// SelectTipsMCMCDetailed returns the full records of the selected tips, read
+// under the same lock as the selection.
+func (d *DAG) SelectTipsMCMCDetailed(maxTips int, opts ...TipOption) ([]store.Node, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	excluded, err := d.excludedSet(opts)
+	if err != nil {
+		return nil, err
+	}
+	tips, err := d.selectTipsMCMCInternal(maxTips, excluded, nil)
+	if err != nil {
+		return nil, err
+	}
+	return d.tipNodes(tips)
+}
+
+func (d *DAG) tipNodes(tips []string) ([]store.Node, error) {
+	nodes := make([]store.Node, 0, len(tips))
+	for _, id := range tips {
+		node, err := d.getNodeInternal(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch tip %s: %v", id, err)
+		}
+		if node != nil {
+			nodes = append(nodes, *node)
+		}
+	}
+	return nodes, nil
+}
+
+// WalkTrace holds the sequence of node IDs visited by each MCMC walker. A nil
+// *WalkTrace records nothing, so untraced selection pays no cost.
+type WalkTrace struct {
+	Walks  [][]string  `json:"walks"`
+	Params *MCMCParams `json:"params"`
+}
+
+func (t *WalkTrace) setParams(p *MCMCParams) {
+	if t == nil {
+		return
+	}
+	t.Params = p
+}
+
+func (t *WalkTrace) begin(id string) {
+	if t == nil {
+		return
+	}
+	t.Walks = append(t.Walks, []string{id})
+}
+
+func (t *WalkTrace) visit(id string) {
+	if t == nil || len(t.Walks) == 0 {
+		return
+	}
+	last := len(t.Walks) - 1
+	t.Walks[last] = append(t.Walks[last], id)
+}
+
+func (d *DAG) selectTipsMCMCInternal(maxTips int, excluded map[string]bool, trace *WalkTrace) ([]string, error) {
+	params, err := d.mcmcParams(maxTips)
+	if err != nil {
+		return nil, err
+	}
+	if params.NodeCount == 0 {
+		return nil, ErrEmptyDAG
+	}
+	trace.setParams(params)
+	maxTips = params.MaxTips
+	tips := make(map[string]int)
+	maxAttempts := params.MaxAttempts
+	maxWalkSteps := params.MaxWalkSteps
+	pool, err := d.walkStartPool(params)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(tips) < params.CandidatePool && maxAttempts > 0 {
+		startNode, err := d.walkStartNode(pool)
+		if err != nil {
+			return nil, err
+		}
+		trace.begin(startNode.ID)
+
+		// A walker that starts on or is fenced in by excluded nodes gives up.
+		current := startNode
+		for steps := 0; steps < maxWalkSteps && !excluded[current.ID]; steps++ {
+			isTip, err := d.isTipInternal(current.ID)
+			if err != nil {
+				return nil, err
+			}
+			if isTip {
+				tips[current.ID]++
+				break
+			}
+
+			children, err := d.getChildren(current.ID)
+			if err != nil {
+				return nil, err
+			}
+			if len(children) == 0 {
+				tips[current.ID]++
+				break
+			}
+			if children = withoutExcluded(children, excluded); len(children) == 0 {
+				break
+			}
+
+			current = weightedRandomChoice(children, params, trace)
+		}
+		maxAttempts--
+	}
+
+	if len(tips) == 0 && excluded != nil {
+		return d.fallbackTips(maxTips, excluded)
+	}
+	if len(tips) == 0 {
+		d.logger.Warnf("No tips found after %d attempts", maxAttempts)
+		return nil, fmt.Errorf("no tips available")
+	}
+
+	if d.tipDiversity > 0 {
+		return d.diversify(tips, maxTips)
+	}
+	result := make([]string, 0, len(tips))
+	for id := range tips {
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// getRandomNode picks a uniformly random node by its position in key order,
+// reading keys only up to that position.
+func (d *DAG) getRandomNode() (*store.Node, error) {
+	count := d.store.NodeCount()
+	if count == 0 {
+		return nil, ErrEmptyDAG
+	}
+	target := rand.Intn(count)
+
+	iter := d.store.Iterator()
+	defer iter.Release()
+	id := ""
+	for i := 0; i <= target && iter.Next(); i++ {
+		id = string(iter.Key())
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate nodes: %v", err)
+	}
+	if id == "" {
+		return nil, ErrEmptyDAG
+	}
+	return d.getNodeInternal(id)
+}
+
+func (d *DAG) getChildren(parentID string) ([]*store.Node, error) {
+	ids, err := d.store.GetChildren(parentID)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make([]*store.Node, 0, len(ids))
+	for _, id := range ids {
+		node, err := d.getNodeInternal(id)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			children = append(children, node)
+		}
+	}
+	return children, nil
+}
+
+// weightedRandomChoice picks one of nodes for the next walk step, weighting
+// each by its cumulative weight or, with tip bias, by exp(alpha * w) with w
+// normalized to the heaviest node. Shifting the exponent by alpha keeps it at
+// or below zero, so large alphas cannot overflow.
+func weightedRandomChoice(nodes []*store.Node, params *MCMCParams, trace *WalkTrace) *store.Node {
+	weights := make([]float64, len(nodes))
+	heaviest := 0.0
+	for i, n := range nodes {
+		weights[i] = math.Max(n.CumulativeWeight, minWalkWeight)
+		heaviest = math.Max(heaviest, weights[i])
+	}
+	if params.TipBias {
+		for i, w := range weights {
+			weights[i] = math.Exp(params.Alpha * (w/heaviest - 1))
+		}
+	}
+
+	totalWeight := 0.0
+	for _, w := range weights {
+		totalWeight += w
+	}
+
+	r := rand.Float64() * totalWeight
+	cumSum := 0.0
+	for i, n := range nodes {
+		cumSum += weights[i]
+		if r <= cumSum {
+			trace.visit(n.ID)
+			return n
+		}
+	}
+
+	chosen := nodes[len(nodes)-1]
+	trace.visit(chosen.ID)
+	return chosen
+}
+
+func (d *DAG) GetNode(id string) (*store.Node, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	d.logger.Infof("Fetching node: %s", id)
+	return d.getNodeInternal(id)
+}
+
+// GetNodes returns the nodes with the given IDs in request order. Unknown and
+// duplicate IDs are omitted. The lookup stops early if ctx is canceled.
+func (d *DAG) GetNodes(ctx context.Context, ids []string) ([]store.Node, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	nodes := make([]store.Node, 0, len(ids))
+	seen := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+
+		node, err := d.getNodeInternal(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch node %s: %v", id, err)
+		}
+		if node != nil {
+			nodes = append(nodes, *node)
+		}
+	}
+	return nodes, nil
+}
+
+// HasMany reports for each of ids whether the node exists. Records are not
+// decoded, so it is cheaper than GetNodes when only presence matters.
+func (d *DAG) HasMany(ctx context.Context, ids []string) (map[string]bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	exists := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, ok := exists[id]; ok {
+			continue
+		}
+		ok, err := d.store.Has(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check node %s: %v", id, err)
+		}
+		exists[id] = ok
+	}
+	return exists, nil
+}
+
+func (d *DAG) getNodeInternal(id string) (*store.Node, error) {
+	node, err := d.store.GetNode(id)
+	if err != nil {
+		return nil, err
+	}
+	d.applyPendingWeight(node)
+	return node, nil
+}
+
+func (d *DAG) IsTip(id string) (bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.isTipInternal(id)
+}
+
+func (d *DAG) isTipInternal(id string) (bool, error) {
+	hasChildren, err := d.store.HasChildren(id)
+	if err != nil {
+		return false, err
+	}
+	return !hasChildren, nil
+}
+
+func (d *DAG) DeleteNode(id string) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.deleteNodeLocked(id)
+}
+
+// DeleteIfTip deletes id only if it is still a tip. Tip status is checked
+// under the same write lock as the delete, so an add that gives the node a
+// child first wins and the node is kept. It reports whether the node was
+// deleted; a node that is no longer a tip is not an error.
+func (d *DAG) DeleteIfTip(id string) (bool, error) {
+	if err := d.checkWritable(); err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	isTip, err := d.isTipInternal(id)
+	if err != nil {
+		return false, d.storeFailure("failed to check children of "+id, err)
+	}
+	if !isTip {
+		d.logger.Infof("Keeping node %s: no longer a tip", id)
+		return false, nil
+	}
+	if err := d.deleteNodeLocked(id); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ForceDeleteNode deletes a node even if it has children, for removing a
+// corrupt node by hand. With repairChildren the ID is dropped from each
+// child's parent list, which turns a child left with no parents into a
+// genesis node; without it the children keep a dangling parent reference,
+// which VerifyStructure reports and which makes them fail parent checks until
+// repaired. Either way the genesis and min-parents rules are not enforced on
+// the children. Cumulative weights are recomputed afterwards, since the
+// node's ancestors lose the weight of its whole subtree.
+func (d *DAG) ForceDeleteNode(id string, repairChildren bool) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.logger.Warnf("Force deleting node: %s (repair children: %v)", id, repairChildren)
+
+	node, err := d.getNodeInternal(id)
+	if err != nil {
+		return d.storeFailure("failed to read node "+id, err)
+	}
+	if node == nil {
+		return fmt.Errorf("node with ID %s not found", id)
+	}
+
+	if repairChildren {
+		childIDs, err := d.store.GetChildren(id)
+		if err != nil {
+			return d.storeFailure("failed to read children of "+id, err)
+		}
+		children := make([]*store.Node, 0, len(childIDs))
+		for _, childID := range childIDs {
+			child, err := d.getNodeInternal(childID)
+			if err != nil {
+				return d.storeFailure("failed to read child "+childID, err)
+			}
+			if child == nil {
+				continue
+			}
+			parents := make([]string, 0, len(child.Parents))
+			for _, p := range child.Parents {
+				if p != id {
+					parents = append(parents, p)
+				}
+			}
+			child.Parents = parents
+			children = append(children, child)
+		}
+		if err := d.store.AddNodes(children); err != nil {
+			return d.storeFailure("failed to repair children", err)
+		}
+	}
+
+	if err := d.removeNode(id, time.Now().UTC()); err != nil {
+		return d.storeFailure("failed to delete node", err)
+	}
+	d.dropPendingWeight(id)
+	d.emit(EventNodeDeleted, id, nil)
+
+	if err := d.recomputeCumulativeWeights(); err != nil {
+		return d.storeFailure("failed to recompute weights", err)
+	}
+	return nil
+}
+
+// DeleteNodeByHash deletes the tip whose ContentHash is hash and returns its
+// ID. It fails if no node or more than one node has that hash.
+func (d *DAG) DeleteNodeByHash(hash string) (string, error) {
+	if err := d.checkWritable(); err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids, err := d.store.NodesByHash(hash)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up hash %s: %v", hash, err)
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("node with hash %s not found", hash)
+	case 1:
+		return ids[0], d.deleteNodeLocked(ids[0])
+	}
+	return "", fmt.Errorf("%w: hash %s matches %d nodes", ErrAmbiguousHash, hash, len(ids))
+}
+
+func (d *DAG) deleteNodeLocked(id string) error {
+	return d.deleteNodeAt(id, time.Now().UTC())
+}
+
+// deleteNodeAt deletes the tip id, dating its tombstone at when soft deletes
+// are enabled. The ancestors' weights, the delete and any deferred mark are
+// written in one batch, so a crash cannot leave the weight of a deleted node
+// counted or a deferred node's weight taken off twice. With weight
+// coalescing the ancestors' deltas are queued once the batch is written, as
+// an add's are.
+func (d *DAG) deleteNodeAt(id string, at time.Time) error {
+	d.logger.Infof("Deleting node: %s", id)
+
+	node, err := d.getNodeInternal(id)
+	if err != nil {
+		return d.storeFailure("failed to read node "+id, err)
+	}
+	if node == nil {
+		return fmt.Errorf("node with ID %s not found", id)
+	}
+
+	hasChildren, err := d.store.HasChildren(id)
+	if err != nil {
+		return d.storeFailure("failed to check children of "+id, err)
+	}
+	if hasChildren {
+		return fmt.Errorf("cannot delete node %s because it has children", id)
+	}
+
+	// A deferred node's weight never reached its ancestors, so only its mark
+	// is cleared.
+	deferred, err := d.store.IsWeightDeferred(id)
+	if err != nil {
+		return d.storeFailure("failed to read deferred weight", err)
+	}
+	update := &store.Update{Delete: id}
+	deltas := make(map[string]float64)
+	if deferred {
+		update.ClearDeferred = []string{id}
+	} else {
+		if err := d.addWeightDeltas(node, -node.Weight, deltas, 0); err != nil {
+			return d.storeFailure("failed to update weights", err)
+		}
+		if d.coalescer == nil {
+			if update.Nodes, err = d.weightUpdates(deltas); err != nil {
+				return d.storeFailure("failed to update weights", err)
+			}
+		}
+	}
+	if d.softDelete {
+		update.Tombstone = &store.Tombstone{ID: id, DeletedAt: at.UTC()}
+	}
+
+	if err := d.store.Apply(update); err != nil {
+		return d.storeFailure("failed to delete node", err)
+	}
+	if deferred {
+		d.deferredWeights.Add(-1)
+	}
+	if !d.queueWeightDeltas(deltas) {
+		d.emitConfirmed(update.Nodes, deltas)
+	}
+	d.dropPendingWeight(id)
+	delete(d.depths, id)
+
+	d.emit(EventNodeDeleted, id, nil)
+	return nil
+}
+
+// IdempotencyRecord returns the saved response for an Idempotency-Key.
+func (d *DAG) IdempotencyRecord(key string) (*store.IdempotencyRecord, error) {
+	return d.store.GetIdempotencyRecord(key)
+}
+
+func (d *DAG) SaveIdempotencyRecord(key string, rec *store.IdempotencyRecord) error {
+	return d.store.PutIdempotencyRecord(key, rec)
+}
+
+// PurgeIdempotencyRecords drops expired Idempotency-Key records.
+func (d *DAG) PurgeIdempotencyRecords() error {
+	n, err := d.store.PurgeIdempotencyRecords(time.Now())
+	if err != nil {
+		d.logger.Errorf("Failed to purge idempotency records: %v", err)
+		return err
+	}
+	if n > 0 {
+		d.logger.Infof("Purged %d expired idempotency records", n)
+	}
+	return nil
+}
+
+// RebuildIndexes recomputes every secondary index from the node records. It
+// holds the write lock so no mutation interleaves with the rebuild. A
+// successful rebuild clears a failed startup build.
+func (d *DAG) RebuildIndexes() error {
+	if d.building.Load() {
+		return ErrNotReady
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.logger.Infof("Rebuilding indexes")
+	entries, err := d.store.RebuildIndexes()
+	if err != nil {
+		d.logger.Errorf("Failed to rebuild indexes: %v", err)
+		return fmt.Errorf("failed to rebuild indexes: %v", err)
+	}
+	d.logger.Infof("Rebuilt indexes with %d entries", entries)
+	if d.indexBuildFailed.CompareAndSwap(true, false) {
+		d.logger.Infof("Indexes repaired, ready for writes")
+	}
+	return nil
+}
+
+func (d *DAG) Logger() *logrus.Logger {
+	return d.logger
+}
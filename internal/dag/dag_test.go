@@ -0,0 +1,56 @@
+package dag
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+func TestGetChildrenDistinct(t *testing.T) {
+	st, err := store.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to initialize store: %v", err)
+	}
+	defer st.Close()
+	d := New(st, logrus.New(), 5, 1.0)
+
+	for _, n := range []*store.Node{
+		{ID: "p", Parents: []string{}, Weight: 1.0},
+		{ID: "c1", Parents: []string{"p"}, Weight: 2.0},
+		{ID: "c2", Parents: []string{"p"}, Weight: 3.0},
+		{ID: "c3", Parents: []string{"p"}, Weight: 4.0},
+	} {
+		if err := d.AddNode(n); err != nil {
+			t.Fatalf("AddNode %s failed: %v", n.ID, err)
+		}
+	}
+
+	children, err := d.getChildren("p")
+	if err != nil {
+		t.Fatalf("getChildren failed: %v", err)
+	}
+	want := map[string]float64{"c1": 2.0, "c2": 3.0, "c3": 4.0}
+	if len(children) != len(want) {
+		t.Fatalf("Expected %d children, got %d", len(want), len(children))
+	}
+	seen := map[*store.Node]bool{}
+	for _, c := range children {
+		if seen[c] {
+			t.Errorf("Expected a distinct node per child, got %s twice", c.ID)
+		}
+		seen[c] = true
+		weight, ok := want[c.ID]
+		if !ok {
+			t.Errorf("Unexpected child %s", c.ID)
+			continue
+		}
+		delete(want, c.ID)
+		if c.CumulativeWeight != weight {
+			t.Errorf("Expected %s cumulative weight %v, got %v", c.ID, weight, c.CumulativeWeight)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("Expected children %v to be returned", want)
+	}
+}
@@ -0,0 +1,190 @@
+package dag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// errTooManyAncestors stops an ancestor walk that exceeds maxAncestorUpdates.
+var errTooManyAncestors = errors.New("too many ancestors")
+
+// WithMaxAncestorUpdates caps how many ancestors an add updates
+// synchronously. A node with more ancestors is stored with its own weight
+// only and marked deferred; ReconcileWeights later adds its weight to the
+// ancestors. Until then the ancestors' cumulative weights are too low, so
+// tip selection and confirmation see a slightly stale graph, WeightsPending
+// reports true and WeightPending flags each of those ancestors. Deletes
+// always update ancestors in full. Zero, the default, disables the cap.
+func WithMaxAncestorUpdates(n int) Option {
+	return func(d *DAG) {
+		d.maxAncestorUpdates = n
+	}
+}
+
+func (d *DAG) loadDeferredWeights() {
+	ids, err := d.store.DeferredWeights()
+	if err != nil {
+		d.logger.Errorf("Failed to load deferred weights: %v", err)
+		return
+	}
+	d.deferredWeights.Store(int64(len(ids)))
+}
+
+// WeightsPending reports whether some node's weight has not yet been added
+// to its ancestors, in which case any cumulative weight may be too low.
+func (d *DAG) WeightsPending() bool {
+	return d.deferredWeights.Load() > 0
+}
+
+// storeNodes writes nodes, marking those in deferred for reconciliation in
+// the same batch, so a crash cannot keep a node whose ancestor walk hit the
+// cap and lose its mark. The caller holds d.mu.
+func (d *DAG) storeNodes(nodes, deferred []*store.Node) error {
+	if len(deferred) == 0 {
+		return d.store.AddNodes(nodes)
+	}
+	ids := make([]string, len(deferred))
+	for i, node := range deferred {
+		ids[i] = node.ID
+	}
+	if err := d.store.Apply(&store.Update{Nodes: nodes, DeferWeights: ids}); err != nil {
+		return err
+	}
+	d.deferredWeights.Add(int64(len(deferred)))
+	for _, node := range deferred {
+		d.logger.Infof("Node %s has more than %d ancestors, deferring weight update", node.ID, d.maxAncestorUpdates)
+	}
+	return nil
+}
+
+// WeightPending reports whether id is an ancestor of a deferred node, in
+// which case its cumulative weight is still missing that node's weight.
+func (d *DAG) WeightPending(id string) (bool, error) {
+	pending, err := d.PendingWeights(id)
+	return pending[id], err
+}
+
+// PendingWeights returns the IDs of the ancestors of every deferred node,
+// whose cumulative weights are missing a deferred weight. With a non-empty
+// stop the walk ends as soon as stop is found. It is empty unless
+// WeightsPending reports true.
+func (d *DAG) PendingWeights(stop string) (map[string]bool, error) {
+	pending := map[string]bool{}
+	if !d.WeightsPending() {
+		return pending, nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	ids, err := d.store.DeferredWeights()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deferred weights: %v", err)
+	}
+	for _, id := range ids {
+		queue := []string{id}
+		for len(queue) > 0 {
+			node, err := d.getNodeInternal(queue[0])
+			queue = queue[1:]
+			if err != nil {
+				return nil, err
+			}
+			if node == nil {
+				continue
+			}
+			for _, p := range node.Parents {
+				if pending[p] {
+					continue
+				}
+				pending[p] = true
+				if p == stop {
+					return pending, nil
+				}
+				queue = append(queue, p)
+			}
+		}
+	}
+	return pending, nil
+}
+
+func (d *DAG) clearDeferred(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := d.store.ClearWeightDeferred(ids...); err != nil {
+		return err
+	}
+	d.deferredWeights.Add(-int64(len(ids)))
+	return nil
+}
+
+// ReconcileWeights adds the weight of every deferred node to its ancestors
+// and returns how many nodes were reconciled.
+func (d *DAG) ReconcileWeights() (int, error) {
+	if err := d.checkWritable(); err != nil {
+		return 0, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids, err := d.store.DeferredWeights()
+	if err != nil {
+		return 0, d.storeFailure("failed to read deferred weights", err)
+	}
+	done := 0
+	for _, id := range ids {
+		node, err := d.getNodeInternal(id)
+		if err != nil {
+			return done, d.storeFailure("failed to read node "+id, err)
+		}
+		// The ancestors are written directly, bypassing the coalescer, so
+		// that their new weights and the cleared mark land in one batch
+		// and a crash cannot count the weight twice.
+		deltas := make(map[string]float64)
+		var updated []*store.Node
+		if node != nil {
+			if err := d.addWeightDeltas(node, node.Weight, deltas, 0); err != nil {
+				return done, d.storeFailure("failed to update weights", err)
+			}
+			if updated, err = d.weightUpdates(deltas); err != nil {
+				return done, d.storeFailure("failed to update weights", err)
+			}
+		}
+		if err := d.store.Apply(&store.Update{Nodes: updated, ClearDeferred: []string{id}}); err != nil {
+			return done, d.storeFailure("failed to reconcile weight of "+id, err)
+		}
+		d.deferredWeights.Add(-1)
+		d.emitConfirmed(updated, deltas)
+		done++
+	}
+	return done, nil
+}
+
+// RunWeightReconciler calls ReconcileWeights every interval until ctx is
+// cancelled. It returns at once when the ancestor cap is disabled.
+func (d *DAG) RunWeightReconciler(ctx context.Context, interval time.Duration) {
+	if d.maxAncestorUpdates <= 0 || d.replication != nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !d.WeightsPending() {
+				continue
+			}
+			n, err := d.ReconcileWeights()
+			if err != nil {
+				d.logger.Errorf("Weight reconciliation failed: %v", err)
+			}
+			if n > 0 {
+				d.logger.Infof("Reconciled deferred weights of %d nodes", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
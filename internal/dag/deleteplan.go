@@ -0,0 +1,171 @@
+package dag
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// WeightChange is the cumulative weight a node has now and would have after
+// a planned delete.
+type WeightChange struct {
+	ID     string  `json:"id"`
+	Before float64 `json:"before"`
+	After  float64 `json:"after"`
+}
+
+// DeletePlan is what a delete would do. Deleted lists the nodes that would
+// be deleted, in order. Children lists the nodes that would lose the
+// deleted node as a parent, which only a forced delete allows.
+type DeletePlan struct {
+	Deleted  []string       `json:"deleted"`
+	Children []string       `json:"children"`
+	Weights  []WeightChange `json:"weights"`
+}
+
+// PlanDelete reports what DeleteNode, ForceDeleteNode when force is set or
+// DeleteSubtree when cascade is set would do to id without writing anything.
+// It fails where the delete would. repairChildren does not change the plan,
+// since repaired and dangling children keep the same descendants.
+func (d *DAG) PlanDelete(id string, force, cascade bool) (*DeletePlan, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	node, err := d.getNodeInternal(id)
+	if err != nil {
+		return nil, d.storeFailure("failed to read node "+id, err)
+	}
+	if node == nil {
+		return nil, fmt.Errorf("node with ID %s not found", id)
+	}
+	if cascade {
+		return d.planSubtree(id)
+	}
+	children, err := d.store.GetChildren(id)
+	if err != nil {
+		return nil, d.storeFailure("failed to read children of "+id, err)
+	}
+	if len(children) > 0 && !force {
+		return nil, fmt.Errorf("cannot delete node %s because it has children", id)
+	}
+
+	plan := &DeletePlan{Deleted: []string{id}, Children: children, Weights: []WeightChange{}}
+	if force {
+		plan.Weights, err = d.planRecompute(node)
+	} else {
+		plan.Weights, err = d.planAncestorUpdate([]*store.Node{node})
+	}
+	if err != nil {
+		return nil, err
+	}
+	sortWeightChanges(plan.Weights)
+	return plan, nil
+}
+
+// planSubtree mirrors DeleteSubtree, which deletes the subtree of id leaves
+// first, each node taking its weight off the ancestors still stored.
+func (d *DAG) planSubtree(id string) (*DeletePlan, error) {
+	order, err := d.subtreeLeavesFirst(id)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*store.Node, 0, len(order))
+	for _, nodeID := range order {
+		node, err := d.getNodeInternal(nodeID)
+		if err != nil {
+			return nil, d.storeFailure("failed to read node "+nodeID, err)
+		}
+		if node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	weights, err := d.planAncestorUpdate(nodes)
+	if err != nil {
+		return nil, err
+	}
+	sortWeightChanges(weights)
+	return &DeletePlan{Deleted: order, Children: []string{}, Weights: weights}, nil
+}
+
+func sortWeightChanges(changes []WeightChange) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ID < changes[j].ID })
+}
+
+// planAncestorUpdate mirrors deleteNodeLocked for each of nodes, which takes
+// the node's weight off each ancestor unless it was deferred and never
+// added. Ancestors among nodes are deleted too and left out of the plan.
+func (d *DAG) planAncestorUpdate(nodes []*store.Node) ([]WeightChange, error) {
+	changes := []WeightChange{}
+	removed := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		removed[node.ID] = true
+	}
+	deltas := make(map[string]float64)
+	for _, node := range nodes {
+		deferred, err := d.store.IsWeightDeferred(node.ID)
+		if err != nil {
+			return nil, d.storeFailure("failed to read deferred weight", err)
+		}
+		if deferred {
+			continue
+		}
+		if err := d.addWeightDeltas(node, -node.Weight, deltas, 0); err != nil {
+			return nil, d.storeFailure("failed to read ancestors", err)
+		}
+	}
+	for id, delta := range deltas {
+		if removed[id] {
+			continue
+		}
+		ancestor, err := d.getNodeInternal(id)
+		if err != nil {
+			return nil, d.storeFailure("failed to read node "+id, err)
+		}
+		if ancestor != nil {
+			changes = append(changes, WeightChange{ID: id, Before: ancestor.CumulativeWeight, After: ancestor.CumulativeWeight + delta})
+		}
+	}
+	return changes, nil
+}
+
+// planRecompute mirrors ForceDeleteNode, which recomputes every weight once
+// the node is gone, and reports the ancestors whose weight would change.
+func (d *DAG) planRecompute(node *store.Node) ([]WeightChange, error) {
+	nodes, children, err := d.loadGraph()
+	if err != nil {
+		return nil, err
+	}
+	delete(nodes, node.ID)
+	for _, p := range node.Parents {
+		kept := []string{}
+		for _, c := range children[p] {
+			if c != node.ID {
+				kept = append(kept, c)
+			}
+		}
+		children[p] = kept
+	}
+
+	changes := []WeightChange{}
+	seen := map[string]bool{}
+	queue := append([]string{}, node.Parents...)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		ancestor, ok := nodes[id]
+		if seen[id] || !ok {
+			continue
+		}
+		seen[id] = true
+		if after := coneWeight(id, nodes, children); after != ancestor.CumulativeWeight {
+			changes = append(changes, WeightChange{ID: id, Before: ancestor.CumulativeWeight, After: after})
+		}
+		queue = append(queue, ancestor.Parents...)
+	}
+	return changes, nil
+}
@@ -0,0 +1,111 @@
+package dag
+
+import (
+	"fmt"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// WithMaxDepthDiff rejects adds whose parents' depths differ by more than n,
+// which catches attachments to a stale part of the graph. A node's depth is
+// the length of its longest path to a genesis node. Zero, the default,
+// disables the check.
+func WithMaxDepthDiff(n int) Option {
+	return func(d *DAG) {
+		d.maxDepthDiff = n
+	}
+}
+
+// checkDepthSpread enforces maxDepthDiff on parents, reading their depths
+// through depth. The caller holds d.mu for writing.
+func (d *DAG) checkDepthSpread(id string, parents []string, depth func(string) (int, error)) error {
+	if d.maxDepthDiff <= 0 || len(parents) == 0 {
+		return nil
+	}
+	lo, hi := -1, -1
+	for _, p := range parents {
+		depth, err := depth(p)
+		if err != nil {
+			return err
+		}
+		if lo < 0 || depth < lo {
+			lo = depth
+		}
+		if depth > hi {
+			hi = depth
+		}
+	}
+	if hi-lo > d.maxDepthDiff {
+		return fmt.Errorf("%w: node %s has parents at depths %d to %d, max spread: %d", ErrDepthSpread, id, lo, hi, d.maxDepthDiff)
+	}
+	return nil
+}
+
+// depth returns the depth of id, computing and caching it and any uncached
+// ancestors. Missing parents count as genesis. The caller holds d.mu for
+// writing.
+func (d *DAG) depth(id string) (int, error) {
+	if depth, ok := d.depths[id]; ok {
+		return depth, nil
+	}
+	if d.depths == nil {
+		d.depths = map[string]int{}
+	}
+	return depthFrom(id, d.depths, d.getNodeInternal)
+}
+
+// depthFrom is depth over the nodes lookup returns, caching in depths.
+func depthFrom(id string, depths map[string]int, lookup func(string) (*store.Node, error)) (int, error) {
+	parents := map[string][]string{}
+	stack := []string{id}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		if _, ok := depths[current]; ok {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		ps, ok := parents[current]
+		if !ok {
+			node, err := lookup(current)
+			if err != nil {
+				return 0, fmt.Errorf("failed to fetch node %s: %v", current, err)
+			}
+			if node != nil {
+				ps = node.Parents
+			}
+			if ps == nil {
+				ps = []string{}
+			}
+			parents[current] = ps
+		}
+
+		depth, ready := 0, true
+		for _, p := range ps {
+			pd, ok := depths[p]
+			if !ok {
+				if _, loaded := parents[p]; loaded {
+					// p is on the stack, so the graph has a cycle; treat
+					// the back edge as missing rather than loop forever.
+					continue
+				}
+				stack = append(stack, p)
+				ready = false
+				continue
+			}
+			if pd+1 > depth {
+				depth = pd + 1
+			}
+		}
+		if ready {
+			depths[current] = depth
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return depths[id], nil
+}
+
+// forgetDepths drops cached depths after a change that can rewire parents,
+// such as a node replaced by a peer sync or a forced delete.
+func (d *DAG) forgetDepths() {
+	d.depths = nil
+}
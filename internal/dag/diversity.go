@@ -0,0 +1,96 @@
+package dag
+
+import (
+	"fmt"
+	"sort"
+)
+
+// diversityPoolFactor is how many candidate tips per requested tip MCMC
+// gathers when the diversity filter is on.
+const diversityPoolFactor = 3
+
+// WithTipDiversity makes tip selection skip tips whose ancestor cone overlaps
+// an already selected tip by more than maxOverlap, measured as the Jaccard
+// index of the two ancestor sets. Candidates are considered in order of how
+// many walkers reached them, so the first tip is the one plain MCMC favours.
+// Selection may return fewer tips than requested rather than several from the
+// same subtree. Zero, the default, disables the filter.
+func WithTipDiversity(maxOverlap float64) Option {
+	return func(d *DAG) {
+		d.tipDiversity = maxOverlap
+	}
+}
+
+// diversify picks up to maxTips of the candidate tips, most hit first,
+// skipping any whose ancestors overlap a picked tip by more than
+// d.tipDiversity.
+func (d *DAG) diversify(hits map[string]int, maxTips int) ([]string, error) {
+	candidates := make([]string, 0, len(hits))
+	for id := range hits {
+		candidates = append(candidates, id)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if hits[candidates[i]] != hits[candidates[j]] {
+			return hits[candidates[i]] > hits[candidates[j]]
+		}
+		return candidates[i] < candidates[j]
+	})
+
+	result := []string{}
+	cones := []map[string]struct{}{}
+	for _, id := range candidates {
+		if len(result) == maxTips {
+			break
+		}
+		cone, err := d.ancestorCone(id)
+		if err != nil {
+			return nil, err
+		}
+		overlapping := false
+		for _, picked := range cones {
+			if jaccard(cone, picked) > d.tipDiversity {
+				overlapping = true
+				break
+			}
+		}
+		if !overlapping {
+			result = append(result, id)
+			cones = append(cones, cone)
+		}
+	}
+	return result, nil
+}
+
+// ancestorCone returns id and every node reachable through its parents.
+func (d *DAG) ancestorCone(id string) (map[string]struct{}, error) {
+	cone := map[string]struct{}{id: {}}
+	queue := []string{id}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		node, err := d.getNodeInternal(current)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch node %s: %v", current, err)
+		}
+		if node == nil {
+			continue
+		}
+		for _, p := range node.Parents {
+			if _, ok := cone[p]; !ok {
+				cone[p] = struct{}{}
+				queue = append(queue, p)
+			}
+		}
+	}
+	return cone, nil
+}
+
+func jaccard(a, b map[string]struct{}) float64 {
+	shared := 0
+	for id := range a {
+		if _, ok := b[id]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
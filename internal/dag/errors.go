@@ -0,0 +1,95 @@
+package dag
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrEmptyDAG is returned by tip selection when the store holds no nodes.
+var ErrEmptyDAG = errors.New("no nodes in DAG")
+
+// ErrMultipleGenesis is returned when a parentless node is added to a
+// non-empty DAG while multiple genesis nodes are disallowed.
+var ErrMultipleGenesis = errors.New("multiple genesis nodes are not allowed")
+
+// ErrTooFewParents is returned when a non-genesis node would have fewer
+// parents than the configured minimum.
+var ErrTooFewParents = errors.New("too few parents")
+
+// ErrNonTipParent is returned when tip parents are required and a node
+// names a parent that already has children.
+var ErrNonTipParent = errors.New("parent is not a tip")
+
+// ErrAllTipsExcluded is returned by tip selection when every tip was
+// excluded by the caller.
+var ErrAllTipsExcluded = errors.New("every tip is excluded")
+
+// ErrTypeNotAllowed is returned when a node's type is not in the configured
+// allowed list.
+var ErrTypeNotAllowed = errors.New("node type is not allowed")
+
+// ErrDepthSpread is returned when a node's parents differ in depth by more
+// than the configured maximum.
+var ErrDepthSpread = errors.New("parent depth spread too large")
+
+// ErrStoreFull is returned when a write would exceed the configured maximum
+// store size.
+var ErrStoreFull = errors.New("store size limit reached")
+
+// ErrSyncResponseTooLarge is returned when a peer's sync response exceeds the
+// configured maximum size.
+var ErrSyncResponseTooLarge = errors.New("sync response too large")
+
+// ErrReadOnly is returned for writes to a replica.
+var ErrReadOnly = errors.New("node is a read-only replica")
+
+// ErrNotReady is returned for writes while the startup index build runs, and
+// after it failed until the indexes are rebuilt.
+var ErrNotReady = errors.New("node is building indexes and not ready for writes")
+
+// ErrStoreUnavailable is returned when the underlying store fails mid-write.
+// The node reports not ready until a probe of the store succeeds.
+var ErrStoreUnavailable = errors.New("store unavailable")
+
+// ErrStoreCorrupt is returned for writes after Recover found records it
+// could not repair.
+var ErrStoreCorrupt = errors.New("store has unrecoverable records")
+
+// ErrInvalidID is returned for a node ID that is empty, too long, inside a
+// reserved key space or contains a control character, and for a parent ID
+// with a control character.
+var ErrInvalidID = errors.New("invalid node ID")
+
+// ErrAmbiguousHash is returned when a content hash lookup matches more than
+// one node.
+var ErrAmbiguousHash = errors.New("content hash is ambiguous")
+
+// ErrSharedDescendant is returned by DeleteSubtree when a descendant also
+// has a parent outside the subtree.
+var ErrSharedDescendant = errors.New("descendant is shared with another branch")
+
+// ErrContentAddressed is returned when an edit would change the content of a
+// node whose ID is its content hash.
+var ErrContentAddressed = errors.New("node is content-addressed")
+
+// ErrInvalidWeight is returned when a weight update is not a positive
+// number.
+var ErrInvalidWeight = errors.New("weight must be a positive number")
+
+// ErrCycle is returned by TopologicalSort when the stored parent links form
+// a cycle.
+var ErrCycle = errors.New("DAG contains a cycle")
+
+// ErrMaintenanceSkipped is returned when a maintenance operation is not run
+// because another is running or traffic is too high.
+var ErrMaintenanceSkipped = errors.New("maintenance skipped")
+
+// ErrParentNotFound is returned when a node names a parent that is not in the
+// store.
+type ErrParentNotFound struct {
+	ParentID string
+}
+
+func (e *ErrParentNotFound) Error() string {
+	return fmt.Sprintf("parent %s does not exist", e.ParentID)
+}
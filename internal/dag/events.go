@@ -0,0 +1,166 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// Event types published to an EventSink.
+const (
+	EventNodeAdded   = "node.added"
+	EventNodeDeleted = "node.deleted"
+	EventNodeUpdated = "node.updated"
+	// EventNodeConfirmed is published when an incremental weight update
+	// first lifts a node to the confirmation threshold. Full recomputes do
+	// not publish it.
+	EventNodeConfirmed = "node.confirmed"
+)
+
+// Event describes one committed mutation.
+type Event struct {
+	Type   string      `json:"type"`
+	NodeID string      `json:"node_id"`
+	Node   *store.Node `json:"node,omitempty"`
+	Time   time.Time   `json:"time"`
+}
+
+// EventSink receives events after the mutation they describe has been
+// committed. Publish is called from a single background worker, never from
+// the mutating request.
+type EventSink interface {
+	Publish(Event) error
+}
+
+// EventMetrics counts what happened to emitted events.
+type EventMetrics struct {
+	Published int64 `json:"published"`
+	Retried   int64 `json:"retried"`
+	Failed    int64 `json:"failed"`
+	Dropped   int64 `json:"dropped"`
+}
+
+const (
+	eventPublishAttempts = 3
+	eventRetryBackoff    = 100 * time.Millisecond
+)
+
+// eventPublisher hands events to a sink from a buffered queue. A full queue
+// drops the event instead of blocking the mutation.
+type eventPublisher struct {
+	sink   EventSink
+	logger *logrus.Logger
+	queue  chan Event
+	// done is closed once run has drained the queue after stop.
+	done chan struct{}
+
+	// mu guards closed against sends racing the close of queue.
+	mu     sync.RWMutex
+	closed bool
+
+	published, retried, failed, dropped atomic.Int64
+}
+
+// WithEventSink publishes node add and delete events to sink through a queue
+// of the given size (1024 when zero). A failed publish is retried with
+// backoff and then counted as failed; mutations never wait on the sink.
+func WithEventSink(sink EventSink, buffer int) Option {
+	return func(d *DAG) {
+		if sink == nil {
+			return
+		}
+		if buffer <= 0 {
+			buffer = 1024
+		}
+		d.events = &eventPublisher{sink: sink, logger: d.logger, queue: make(chan Event, buffer), done: make(chan struct{})}
+		go d.events.run()
+	}
+}
+
+func (p *eventPublisher) run() {
+	defer close(p.done)
+	for ev := range p.queue {
+		backoff := eventRetryBackoff
+		for attempt := 1; ; attempt++ {
+			err := p.sink.Publish(ev)
+			if err == nil {
+				p.published.Add(1)
+				break
+			}
+			if attempt == eventPublishAttempts {
+				p.failed.Add(1)
+				p.logger.Errorf("Failed to publish %s event for %s after %d attempts: %v", ev.Type, ev.NodeID, attempt, err)
+				break
+			}
+			p.retried.Add(1)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// emit queues an event; it is a no-op without a sink.
+func (d *DAG) emit(eventType string, id string, node *store.Node) {
+	d.metrics.countEvent(eventType)
+	if d.events == nil {
+		return
+	}
+	ev := Event{Type: eventType, NodeID: id, Time: time.Now().UTC()}
+	if node != nil {
+		c := *node
+		ev.Node = &c
+	}
+	d.events.mu.RLock()
+	defer d.events.mu.RUnlock()
+	if d.events.closed {
+		d.events.dropped.Add(1)
+		d.logger.Warnf("Event publisher stopped, dropping %s event for %s", eventType, id)
+		return
+	}
+	select {
+	case d.events.queue <- ev:
+	default:
+		d.events.dropped.Add(1)
+		d.logger.Warnf("Event queue full, dropping %s event for %s", eventType, id)
+	}
+}
+
+// StopEvents stops accepting events and waits until the ones already queued
+// have been published or have failed, or until ctx is done. Events emitted
+// afterwards are counted as dropped. It is a no-op without a sink and safe to
+// call more than once.
+func (d *DAG) StopEvents(ctx context.Context) error {
+	if d.events == nil {
+		return nil
+	}
+	d.events.mu.Lock()
+	if !d.events.closed {
+		d.events.closed = true
+		close(d.events.queue)
+	}
+	d.events.mu.Unlock()
+	select {
+	case <-d.events.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d events still queued: %w", len(d.events.queue), ctx.Err())
+	}
+}
+
+// EventMetrics reports event delivery counters, or nil without a sink.
+func (d *DAG) EventMetrics() *EventMetrics {
+	if d.events == nil {
+		return nil
+	}
+	return &EventMetrics{
+		Published: d.events.published.Load(),
+		Retried:   d.events.retried.Load(),
+		Failed:    d.events.failed.Load(),
+		Dropped:   d.events.dropped.Load(),
+	}
+}
@@ -0,0 +1,114 @@
+package dag
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// TipOption adjusts a single tip selection.
+type TipOption func(*tipSelection)
+
+type tipSelection struct {
+	exclude []string
+	cones   bool
+}
+
+// ExcludeTips keeps ids out of the selection. Walkers never step onto an
+// excluded node, so with cones set nothing that descends from one is chosen
+// either.
+func ExcludeTips(ids []string, cones bool) TipOption {
+	return func(s *tipSelection) {
+		s.exclude = append(s.exclude, ids...)
+		s.cones = s.cones || cones
+	}
+}
+
+// excludedSet resolves opts to the set of node IDs a selection must avoid,
+// or nil when nothing is excluded. The caller holds d.mu.
+func (d *DAG) excludedSet(opts []TipOption) (map[string]bool, error) {
+	var sel tipSelection
+	for _, opt := range opts {
+		opt(&sel)
+	}
+	if len(sel.exclude) == 0 {
+		return nil, nil
+	}
+
+	excluded := make(map[string]bool, len(sel.exclude))
+	queue := []string{}
+	for _, id := range sel.exclude {
+		if !excluded[id] {
+			excluded[id] = true
+			queue = append(queue, id)
+		}
+	}
+	for sel.cones && len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		children, err := d.store.GetChildren(current)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read children of %s: %v", current, err)
+		}
+		for _, child := range children {
+			if !excluded[child] {
+				excluded[child] = true
+				queue = append(queue, child)
+			}
+		}
+	}
+	return excluded, nil
+}
+
+// withoutExcluded drops excluded nodes from children.
+func withoutExcluded(children []*store.Node, excluded map[string]bool) []*store.Node {
+	if excluded == nil {
+		return children
+	}
+	kept := children[:0]
+	for _, c := range children {
+		if !excluded[c.ID] {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// fallbackTips picks up to maxTips tips uniformly from those not excluded,
+// for when every walker ran into excluded nodes. It returns
+// ErrAllTipsExcluded when there are none.
+func (d *DAG) fallbackTips(maxTips int, excluded map[string]bool) ([]string, error) {
+	candidates := []string{}
+	iter := d.store.Iterator()
+	for iter.Next() {
+		var node store.Node
+		if err := json.Unmarshal(iter.Value(), &node); err != nil || excluded[node.ID] {
+			continue
+		}
+		hasChildren, err := d.store.HasChildren(node.ID)
+		if err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("failed to check children of %s: %v", node.ID, err)
+		}
+		if !hasChildren {
+			candidates = append(candidates, node.ID)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to scan nodes: %v", err)
+	}
+	if len(candidates) == 0 {
+		return nil, ErrAllTipsExcluded
+	}
+
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > maxTips {
+		candidates = candidates[:maxTips]
+	}
+	return candidates, nil
+}
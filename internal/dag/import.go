@@ -0,0 +1,215 @@
+package dag
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+type ImportFailure struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// ImportResult summarizes an ImportNodes call. MissingParents lists, per
+// node, the parents that were still absent once the whole batch was loaded.
+type ImportResult struct {
+	Imported        []string            `json:"imported"`
+	SkippedExisting []string            `json:"skipped_existing"`
+	Failed          []ImportFailure     `json:"failed"`
+	MissingParents  map[string][]string `json:"missing_parents,omitempty"`
+}
+
+// ImportNodes loads a batch of nodes. In strict mode every node goes through
+// AddNode, so parents must precede their children. With deferValidation the
+// nodes are checked against the whole batch at once, which tolerates dumps in
+// any order: if any node fails, including by closing a cycle, nothing is
+// written and the returned *BatchError lists every failure. Cumulative
+// weights are then rebuilt for the whole DAG.
+func (d *DAG) ImportNodes(nodes []store.Node, deferValidation bool) (*ImportResult, error) {
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{
+		Imported:        []string{},
+		SkippedExisting: []string{},
+		Failed:          []ImportFailure{},
+	}
+
+	if !deferValidation {
+		for _, node := range nodes {
+			if err := d.AddNode(&node); err != nil {
+				if strings.Contains(err.Error(), "already exists") {
+					result.SkippedExisting = append(result.SkippedExisting, node.ID)
+					continue
+				}
+				result.Failed = append(result.Failed, ImportFailure{ID: node.ID, Reason: err.Error()})
+				continue
+			}
+			result.Imported = append(result.Imported, node.ID)
+		}
+		return result, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.logger.Infof("Importing %d nodes with deferred validation", len(nodes))
+
+	graph, _, err := d.loadGraph()
+	if err != nil {
+		return nil, d.storeFailure("failed to load the DAG", err)
+	}
+	stored := len(graph)
+	var candidates []*store.Node
+	for i := range nodes {
+		node := &nodes[i]
+		if _, ok := graph[node.ID]; ok {
+			result.SkippedExisting = append(result.SkippedExisting, node.ID)
+			continue
+		}
+		graph[node.ID] = node
+		candidates = append(candidates, node)
+	}
+
+	failures, err := d.validateImport(candidates, graph, stored)
+	if err != nil {
+		return nil, err
+	}
+	if len(failures) > 0 {
+		d.logger.Warnf("Rejecting import of %d nodes: %d invalid", len(candidates), len(failures))
+		return nil, &BatchError{Failures: failures}
+	}
+	if len(candidates) == 0 {
+		return result, nil
+	}
+
+	for _, node := range candidates {
+		if node.Weight == 0 {
+			node.Weight = d.defaultWeight
+		}
+		node.CumulativeWeight = node.Weight
+	}
+	if err := d.checkStoreSize(); err != nil {
+		d.logger.Warnf("Rejecting import: %v", err)
+		return nil, err
+	}
+	if err := d.store.AddNodes(candidates); err != nil {
+		return nil, d.storeFailure("failed to store imported nodes", err)
+	}
+	for _, node := range candidates {
+		d.recordWrite(node)
+		d.emit(EventNodeAdded, node.ID, node)
+		result.Imported = append(result.Imported, node.ID)
+		for _, parentID := range node.Parents {
+			if _, ok := graph[parentID]; !ok {
+				if result.MissingParents == nil {
+					result.MissingParents = map[string][]string{}
+				}
+				result.MissingParents[node.ID] = append(result.MissingParents[node.ID], parentID)
+			}
+		}
+	}
+	if len(result.MissingParents) > 0 {
+		d.logger.Warnf("Import left %d nodes with missing parents", len(result.MissingParents))
+	}
+
+	if err := d.recomputeCumulativeWeights(); err != nil {
+		return nil, d.storeFailure("failed to rebuild cumulative weights", err)
+	}
+	return result, nil
+}
+
+// validateImport runs AddNode's checks on the nodes of a deferred import
+// against graph, which holds the stored nodes and the whole batch; stored is
+// how many of them were already in the store. Parents may be anywhere in the
+// batch and may be missing altogether, in which case they count as genesis
+// nodes for the depth check.
+func (d *DAG) validateImport(nodes []*store.Node, graph map[string]*store.Node, stored int) ([]ImportFailure, error) {
+	var failures []ImportFailure
+	batch := make(map[string]bool, len(nodes))
+	ids := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		batch[node.ID] = true
+		ids = append(ids, node.ID)
+	}
+
+	// The stored graph is acyclic, so any cycle runs through the batch and
+	// a walk from the batch nodes finds it.
+	cycles := findCycles(ids, graph)
+	for _, e := range cycles {
+		if e.id == e.parent {
+			// validateImportedNode names self-parents.
+			continue
+		}
+		failures = append(failures, ImportFailure{ID: e.id, Reason: fmt.Sprintf("cycle detected: parent %s closes a cycle", e.parent)})
+	}
+
+	lookup := func(id string) (*store.Node, error) {
+		return graph[id], nil
+	}
+	depths := map[string]int{}
+	depth := func(id string) (int, error) {
+		return depthFrom(id, depths, lookup)
+	}
+	// Parents in the batch may have been written in any order, so only the
+	// stored ones are held to requireTipParents.
+	isTip := func(id string) (bool, error) {
+		if batch[id] {
+			return true, nil
+		}
+		if _, ok := graph[id]; !ok {
+			return true, nil
+		}
+		return d.isTipInternal(id)
+	}
+	genesis := stored > 0
+	for _, node := range nodes {
+		if err := d.validateImportedNode(node, genesis, isTip); err != nil {
+			if errors.Is(err, ErrStoreUnavailable) {
+				return nil, err
+			}
+			failures = append(failures, ImportFailure{ID: node.ID, Reason: err.Error()})
+			continue
+		}
+		if len(node.Parents) == 0 {
+			genesis = true
+		}
+		if len(cycles) > 0 {
+			continue
+		}
+		if err := d.checkDepthSpread(node.ID, node.Parents, depth); err != nil {
+			failures = append(failures, ImportFailure{ID: node.ID, Reason: err.Error()})
+		}
+	}
+	return failures, nil
+}
+
+// validateImportedNode runs the checks on node that need no other batch
+// node. genesis reports whether a parentless node would be another genesis.
+func (d *DAG) validateImportedNode(node *store.Node, genesis bool, isTip func(string) (bool, error)) error {
+	if err := d.checkNodeKeys(node); err != nil {
+		return err
+	}
+	if err := d.checkType(node); err != nil {
+		return err
+	}
+	if len(node.Parents) > d.maxParents {
+		return fmt.Errorf("node %s has too many parents: %d, max allowed: %d", node.ID, len(node.Parents), d.maxParents)
+	}
+	if len(node.Parents) > 0 && len(node.Parents) < d.minParents {
+		return fmt.Errorf("%w: node %s has %d parents, min required: %d", ErrTooFewParents, node.ID, len(node.Parents), d.minParents)
+	}
+	if !d.allowMultipleGenesis && len(node.Parents) == 0 && genesis {
+		return fmt.Errorf("%w: node %s has no parents, attach it to existing tips instead", ErrMultipleGenesis, node.ID)
+	}
+	for _, parentID := range node.Parents {
+		if parentID == node.ID {
+			return fmt.Errorf("cycle detected: node %s cannot be its own parent", node.ID)
+		}
+	}
+	return d.checkTipParents(node, true, isTip)
+}
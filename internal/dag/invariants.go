@@ -0,0 +1,214 @@
+package dag
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// WithInvariantChecks runs checkInvariants before every release of the write
+// lock and logs each violation as an error. Every check reads the whole
+// graph, so this is for development only. Operations that release the lock
+// part way, such as a batched recompute, can produce transient reports.
+func WithInvariantChecks(enabled bool) Option {
+	return func(d *DAG) {
+		if !enabled {
+			d.mu.onUnlock = nil
+			return
+		}
+		d.mu.onUnlock = func() {
+			for _, err := range d.checkInvariants() {
+				d.logger.Errorf("Invariant violated: %v", err)
+			}
+		}
+	}
+}
+
+// dagLock is the DAG's RWMutex with an optional hook run by Unlock while the
+// write lock is still held, when every mutation has been fully applied.
+type dagLock struct {
+	sync.RWMutex
+	onUnlock func()
+}
+
+func (l *dagLock) Unlock() {
+	if l.onUnlock != nil {
+		l.onUnlock()
+	}
+	l.RWMutex.Unlock()
+}
+
+// CheckInvariants returns every violation of the DAG's internal consistency:
+// parent cycles, cumulative weights that do not match the graph, child,
+// hash and type index entries that do not match the node records, and tip
+// flags that disagree with the parent lists. Missing parents are not
+// reported, since imports and forced deletes can leave them on purpose.
+func (d *DAG) CheckInvariants() []error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.checkInvariants()
+}
+
+func (d *DAG) checkInvariants() []error {
+	nodes, children, err := d.loadGraph()
+	if err != nil {
+		return []error{err}
+	}
+	deferredIDs, err := d.store.DeferredWeights()
+	if err != nil {
+		return []error{fmt.Errorf("failed to read deferred weights: %v", err)}
+	}
+	deferred := make(map[string]bool, len(deferredIDs))
+	for _, id := range deferredIDs {
+		deferred[id] = true
+	}
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var errs []error
+	for _, e := range findCycles(ids, nodes) {
+		errs = append(errs, fmt.Errorf("node %s: parent %s closes a cycle", e.id, e.parent))
+	}
+	for _, id := range ids {
+		node := nodes[id]
+		if expected := settledWeight(id, nodes, children, deferred); math.Abs(node.CumulativeWeight-expected) > weightTolerance {
+			errs = append(errs, fmt.Errorf("node %s: cumulative weight %g, expected %g", id, node.CumulativeWeight, expected))
+		}
+
+		indexed, err := d.store.GetChildren(id)
+		if err != nil {
+			return append(errs, fmt.Errorf("failed to read children of %s: %v", id, err))
+		}
+		if !sameIDs(indexed, children[id]) {
+			errs = append(errs, fmt.Errorf("node %s: child index has %v, parent lists give %v", id, indexed, children[id]))
+		}
+		isTip, err := d.isTipInternal(id)
+		if err != nil {
+			return append(errs, fmt.Errorf("failed to check tip %s: %v", id, err))
+		}
+		if isTip != (len(children[id]) == 0) {
+			errs = append(errs, fmt.Errorf("node %s: tip is %v but it has %d children", id, isTip, len(children[id])))
+		}
+
+		byHash, err := d.store.NodesByHash(store.ContentHash(node))
+		if err != nil {
+			return append(errs, fmt.Errorf("failed to look up hash of %s: %v", id, err))
+		}
+		if !containsID(byHash, id) {
+			errs = append(errs, fmt.Errorf("node %s: missing from the hash index", id))
+		}
+		if node.Type != "" {
+			byType, err := d.store.NodesByType(node.Type)
+			if err != nil {
+				return append(errs, fmt.Errorf("failed to look up type of %s: %v", id, err))
+			}
+			if !containsID(byType, id) {
+				errs = append(errs, fmt.Errorf("node %s: missing from the index of type %s", id, node.Type))
+			}
+		}
+	}
+	return errs
+}
+
+// findCycles reports each node at which a walk up the parent lists comes
+// back onto its own path.
+func findCycles(ids []string, nodes map[string]*store.Node) []cycleEdge {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	var edges []cycleEdge
+	state := map[string]int{}
+	for _, root := range ids {
+		if state[root] != 0 {
+			continue
+		}
+		type frame struct {
+			id   string
+			next int
+		}
+		stack := []frame{{id: root}}
+		state[root] = visiting
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			parents := nodes[top.id].Parents
+			if top.next == len(parents) {
+				state[top.id] = done
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			p := parents[top.next]
+			top.next++
+			if _, ok := nodes[p]; !ok {
+				continue
+			}
+			switch state[p] {
+			case visiting:
+				edges = append(edges, cycleEdge{id: top.id, parent: p})
+			case 0:
+				state[p] = visiting
+				stack = append(stack, frame{id: p})
+			}
+		}
+	}
+	return edges
+}
+
+// cycleEdge is a parent link that findCycles found closing a cycle.
+type cycleEdge struct {
+	id     string
+	parent string
+}
+
+// settledWeight is coneWeight without the weight of deferred descendants,
+// which has not yet been added to their ancestors.
+func settledWeight(id string, nodes map[string]*store.Node, children map[string][]string, deferred map[string]bool) float64 {
+	total := nodes[id].Weight
+	seen := map[string]bool{id: true}
+	queue := append([]string{}, children[id]...)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if seen[current] {
+			continue
+		}
+		seen[current] = true
+		if desc, ok := nodes[current]; ok && !deferred[current] {
+			total += desc.Weight
+		}
+		queue = append(queue, children[current]...)
+	}
+	return total
+}
+
+// sameIDs reports whether a and b hold the same set of IDs.
+func sameIDs(a, b []string) bool {
+	set := make(map[string]bool, len(a))
+	for _, id := range a {
+		set[id] = true
+	}
+	seen := make(map[string]bool, len(b))
+	for _, id := range b {
+		if !set[id] {
+			return false
+		}
+		seen[id] = true
+	}
+	return len(seen) == len(set)
+}
+
+func containsID(ids []string, id string) bool {
+	for _, x := range ids {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maintenance operations accepted by StartMaintenance and RunMaintenance.
+const (
+	MaintenanceCompact          = "compact"
+	MaintenanceRecompute        = "recompute"
+	MaintenanceRebuildIndexes   = "rebuild-indexes"
+	MaintenancePurgeIdempotency = "purge-idempotency"
+	MaintenancePurgeTombstones  = "purge-tombstones"
+)
+
+// MaintenanceTask schedules one operation with a five-field cron expression.
+type MaintenanceTask struct {
+	Operation string
+	Schedule  string
+}
+
+// MaintenanceStatus reports the runs of one maintenance operation.
+type MaintenanceStatus struct {
+	Operation      string    `json:"operation"`
+	Schedule       string    `json:"schedule,omitempty"`
+	Running        bool      `json:"running"`
+	Runs           int64     `json:"runs"`
+	Failures       int64     `json:"failures"`
+	Skipped        int64     `json:"skipped"`
+	LastRunAt      time.Time `json:"last_run_at"`
+	LastDurationMs int64     `json:"last_duration_ms"`
+	LastError      string    `json:"last_error,omitempty"`
+	LastSkipReason string    `json:"last_skip_reason,omitempty"`
+}
+
+type maintenanceState struct {
+	// running is held for the duration of a heavy operation so at most one
+	// runs at a time, whether scheduled or triggered by an admin.
+	running sync.Mutex
+
+	mu             sync.Mutex
+	status         map[string]*MaintenanceStatus
+	maxRequestRate float64
+	requestRate    func() float64
+}
+
+// WithMaintenanceGuard makes maintenance runs skip while requestRate reports
+// more than maxRequestRate requests per second. Zero disables the check.
+func WithMaintenanceGuard(maxRequestRate float64, requestRate func() float64) Option {
+	return func(d *DAG) {
+		d.maintenance.maxRequestRate = maxRequestRate
+		d.maintenance.requestRate = requestRate
+	}
+}
+
+func (d *DAG) maintenanceOp(op string) (func() error, bool) {
+	switch op {
+	case MaintenanceCompact:
+		return d.Compact, true
+	case MaintenanceRecompute:
+		return d.RecomputeCumulativeWeights, true
+	case MaintenanceRebuildIndexes:
+		return d.RebuildIndexes, true
+	case MaintenancePurgeIdempotency:
+		return d.PurgeIdempotencyRecords, true
+	case MaintenancePurgeTombstones:
+		return d.PurgeTombstones, true
+	}
+	return nil, false
+}
+
+// maintenanceWrites names the operations that rewrite node records. A read
+// replica must only change its nodes by replicating them, so it skips these;
+// the others tidy local state and run on replicas too.
+var maintenanceWrites = map[string]bool{MaintenanceRecompute: true}
+
+// Compact compacts the whole LevelDB keyspace.
+func (d *DAG) Compact() error {
+	d.logger.Infof("Compacting store")
+	if err := d.store.Compact(); err != nil {
+		d.logger.Errorf("Failed to compact store: %v", err)
+		return fmt.Errorf("failed to compact store: %v", err)
+	}
+	return d.RefreshStoreSize()
+}
+
+// RunMaintenance runs op now unless another maintenance operation is running
+// or the request rate is above the guard's threshold, in which case it
+// returns an error wrapping ErrMaintenanceSkipped.
+func (d *DAG) RunMaintenance(op string) error {
+	fn, ok := d.maintenanceOp(op)
+	if !ok {
+		return fmt.Errorf("unknown maintenance operation %q", op)
+	}
+	m := &d.maintenance
+
+	if d.building.Load() {
+		return d.skipMaintenance(op, "indexes are still building")
+	}
+	if maintenanceWrites[op] {
+		if err := d.checkWritable(); err != nil {
+			return d.skipMaintenance(op, err.Error())
+		}
+	}
+	if m.maxRequestRate > 0 && m.requestRate != nil {
+		if rate := m.requestRate(); rate > m.maxRequestRate {
+			return d.skipMaintenance(op, fmt.Sprintf("request rate %.1f/s above %.1f/s", rate, m.maxRequestRate))
+		}
+	}
+	if !m.running.TryLock() {
+		return d.skipMaintenance(op, "another maintenance operation is running")
+	}
+	defer m.running.Unlock()
+
+	d.logger.Infof("Running maintenance operation %s", op)
+	m.mu.Lock()
+	m.statusLocked(op).Running = true
+	m.mu.Unlock()
+
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+
+	m.mu.Lock()
+	s := m.statusLocked(op)
+	s.Running = false
+	s.Runs++
+	s.LastRunAt = start
+	s.LastDurationMs = elapsed.Milliseconds()
+	s.LastError = ""
+	if err != nil {
+		s.Failures++
+		s.LastError = err.Error()
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		d.logger.Errorf("Maintenance operation %s failed after %s: %v", op, elapsed, err)
+		return err
+	}
+	d.logger.Infof("Maintenance operation %s finished in %s", op, elapsed)
+	return nil
+}
+
+func (d *DAG) skipMaintenance(op, reason string) error {
+	m := &d.maintenance
+	m.mu.Lock()
+	s := m.statusLocked(op)
+	s.Skipped++
+	s.LastSkipReason = reason
+	m.mu.Unlock()
+	d.logger.Infof("Skipping maintenance operation %s: %s", op, reason)
+	return fmt.Errorf("%w: %s", ErrMaintenanceSkipped, reason)
+}
+
+func (m *maintenanceState) statusLocked(op string) *MaintenanceStatus {
+	if m.status == nil {
+		m.status = map[string]*MaintenanceStatus{}
+	}
+	s, ok := m.status[op]
+	if !ok {
+		s = &MaintenanceStatus{Operation: op}
+		m.status[op] = s
+	}
+	return s
+}
+
+// MaintenanceStatus returns the status of every operation that has been
+// scheduled or run, sorted by operation.
+func (d *DAG) MaintenanceStatus() []MaintenanceStatus {
+	m := &d.maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]MaintenanceStatus, 0, len(m.status))
+	for _, s := range m.status {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Operation < out[j].Operation })
+	return out
+}
+
+// StartMaintenance validates tasks and runs each one in the background every
+// minute its schedule matches, until ctx is cancelled. Tasks due in the same
+// minute run one after another. The returned channel is closed once the
+// scheduler has stopped, so shutdown can wait for a running operation.
+func (d *DAG) StartMaintenance(ctx context.Context, tasks []MaintenanceTask) (<-chan struct{}, error) {
+	type scheduled struct {
+		op    string
+		sched *cronSchedule
+	}
+	parsed := make([]scheduled, 0, len(tasks))
+	for _, t := range tasks {
+		if _, ok := d.maintenanceOp(t.Operation); !ok {
+			return nil, fmt.Errorf("unknown maintenance operation %q", t.Operation)
+		}
+		sched, err := parseCron(t.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, scheduled{t.Operation, sched})
+
+		d.maintenance.mu.Lock()
+		d.maintenance.statusLocked(t.Operation).Schedule = t.Schedule
+		d.maintenance.mu.Unlock()
+	}
+	done := make(chan struct{})
+	if len(parsed) == 0 {
+		close(done)
+		return done, nil
+	}
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				for _, t := range parsed {
+					if t.sched.matches(now) {
+						d.RunMaintenance(t.op)
+					}
+				}
+			}
+		}
+	}()
+	return done, nil
+}
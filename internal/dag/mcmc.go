@@ -0,0 +1,185 @@
+package dag
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// minWalkWeight is the weight floor a walker uses for a child, so children
+// with zero cumulative weight can still be chosen.
+const minWalkWeight = 0.0001
+
+// WalkStart decides where each MCMC walker starts.
+type WalkStart string
+
+const (
+	// WalkStartRandom starts from a uniformly random node.
+	WalkStartRandom WalkStart = "random"
+	// WalkStartRecent starts from one of the last window nodes created,
+	// read from the store's creation index.
+	WalkStartRecent WalkStart = "recent"
+	// WalkStartDepth starts from a node at most window steps behind a tip.
+	WalkStartDepth WalkStart = "depth"
+)
+
+// defaultWalkStartWindow is the window used when none is configured.
+const defaultWalkStartWindow = 100
+
+// ParseWalkStart validates a configured walk start. An empty value selects
+// WalkStartRandom.
+func ParseWalkStart(s string) (WalkStart, error) {
+	switch w := WalkStart(s); w {
+	case "":
+		return WalkStartRandom, nil
+	case WalkStartRandom, WalkStartRecent, WalkStartDepth:
+		return w, nil
+	}
+	return "", fmt.Errorf("unknown walk start %q", s)
+}
+
+// WithWalkStart starts walkers near the tips instead of anywhere in the
+// graph, so on a large DAG they spend fewer steps walking through confirmed
+// history. window bounds the start pool; zero selects 100.
+func WithWalkStart(start WalkStart, window int) Option {
+	return func(d *DAG) {
+		d.walkStart = start
+		d.walkStartWindow = window
+	}
+}
+
+// WithTipBias, when enabled, makes walkers choose each child with
+// probability proportional to exp(alpha * w), where w is the child's
+// cumulative weight divided by its heaviest sibling's, so alpha does not
+// depend on the weight scale. Zero chooses uniformly and larger values
+// favour heavier subtrees more strongly. By default walkers choose in plain
+// proportion to cumulative weight and alpha is unused.
+func WithTipBias(enabled bool, alpha float64) Option {
+	return func(d *DAG) {
+		d.tipBias = enabled
+		d.alpha = alpha
+	}
+}
+
+// MCMCParams are the tip selection parameters in effect for one selection.
+// Attempts and walk length depend on the request and the graph size, so they
+// are derived per call rather than configured.
+type MCMCParams struct {
+	MaxTips       int     `json:"max_tips"`
+	CandidatePool int     `json:"candidate_pool"`
+	MaxAttempts   int     `json:"max_attempts"`
+	MaxWalkSteps  int     `json:"max_walk_steps"`
+	MinWeight     float64 `json:"min_weight"`
+	// Alpha applies only with TipBias; without it walks are proportional
+	// to cumulative weight.
+	TipBias      bool      `json:"tip_bias"`
+	Alpha        float64   `json:"alpha"`
+	TipDiversity float64   `json:"tip_diversity"`
+	AutoParents  int       `json:"auto_parents"`
+	NodeCount    int       `json:"node_count"`
+	WalkStart    WalkStart `json:"walk_start"`
+	// WalkStartWindow is omitted for WalkStartRandom.
+	WalkStartWindow int `json:"walk_start_window,omitempty"`
+}
+
+// MCMCParams returns the parameters a selection of maxTips tips would use
+// now. A zero maxTips selects the DAG's max parents, as SelectTipsMCMC does.
+func (d *DAG) MCMCParams(maxTips int) (*MCMCParams, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.mcmcParams(maxTips)
+}
+
+func (d *DAG) mcmcParams(maxTips int) (*MCMCParams, error) {
+	if maxTips <= 0 {
+		maxTips = d.maxParents
+	}
+	nodeCount := d.store.NodeCount()
+
+	p := &MCMCParams{
+		MaxTips:       maxTips,
+		CandidatePool: maxTips,
+		MaxAttempts:   10 * maxTips,
+		MaxWalkSteps:  max(10, nodeCount/2),
+		MinWeight:     minWalkWeight,
+		TipBias:       d.tipBias,
+		Alpha:         d.alpha,
+		TipDiversity:  d.tipDiversity,
+		AutoParents:   min(d.autoParents, d.maxParents),
+		NodeCount:     nodeCount,
+		WalkStart:     WalkStartRandom,
+	}
+	if d.walkStart != "" && d.walkStart != WalkStartRandom {
+		p.WalkStart = d.walkStart
+		p.WalkStartWindow = d.walkStartWindow
+		if p.WalkStartWindow <= 0 {
+			p.WalkStartWindow = defaultWalkStartWindow
+		}
+	}
+	if d.tipDiversity > 0 {
+		p.CandidatePool = maxTips * diversityPoolFactor
+	}
+	return p, nil
+}
+
+// walkStartPool returns the IDs walkers start from under the configured
+// policy, or nil to start anywhere.
+func (d *DAG) walkStartPool(p *MCMCParams) ([]string, error) {
+	switch p.WalkStart {
+	case WalkStartRecent:
+		ids, err := d.store.RecentlyCreated(p.WalkStartWindow)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read recent nodes: %v", err)
+		}
+		return ids, nil
+	case WalkStartDepth:
+		return d.nodesNearTips(p.WalkStartWindow)
+	}
+	return nil, nil
+}
+
+// nodesNearTips returns every node at most depth parent steps from a tip.
+// It starts from the tip set and reads only the records it walks through.
+func (d *DAG) nodesNearTips(depth int) ([]string, error) {
+	level, err := d.getTipsInternal()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	pool := []string{}
+	for step := 0; step <= depth && len(level) > 0; step++ {
+		next := []string{}
+		for _, id := range level {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			pool = append(pool, id)
+			if step == depth {
+				continue
+			}
+			node, err := d.getNodeInternal(id)
+			if err != nil {
+				return nil, err
+			}
+			if node != nil {
+				next = append(next, node.Parents...)
+			}
+		}
+		level = next
+	}
+	return pool, nil
+}
+
+// walkStartNode picks a start node from pool, falling back to a uniformly
+// random node when the pool is empty or the picked node has been deleted.
+func (d *DAG) walkStartNode(pool []string) (*store.Node, error) {
+	if len(pool) > 0 {
+		node, err := d.getNodeInternal(pool[rand.Intn(len(pool))])
+		if err != nil || node != nil {
+			return node, err
+		}
+	}
+	return d.getRandomNode()
+}
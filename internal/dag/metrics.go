@@ -0,0 +1,123 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// metricsState holds the counters behind Metrics. The node and tip gauges
+// need a full scan, so RefreshGraphGauges updates them on a timer instead of
+// every scrape reading the whole store.
+type metricsState struct {
+	nodesAdded     atomic.Int64
+	nodesDeleted   atomic.Int64
+	recomputes     atomic.Int64
+	recomputeNanos atomic.Int64
+
+	mu          sync.Mutex
+	nodes       int
+	tips        int
+	refreshedAt time.Time
+}
+
+// Metrics is a read of the counters served by GET /metrics. Nodes and Tips
+// are as of GaugesRefreshedAt, which is zero before the first refresh. The
+// added and deleted counters cover every path that emits node.added and
+// node.deleted, sync and import included, since startup. NodeCache is nil
+// when the store has no node cache.
+type Metrics struct {
+	Nodes             int
+	Tips              int
+	GaugesRefreshedAt time.Time
+	NodesAdded        int64
+	NodesDeleted      int64
+	Recomputes        int64
+	RecomputeSeconds  float64
+	Peers             []PeerStats
+	NodeCache         *store.CacheStats
+}
+
+// Metrics returns the current counters and the last refreshed gauges.
+func (d *DAG) Metrics() Metrics {
+	d.metrics.mu.Lock()
+	m := Metrics{Nodes: d.metrics.nodes, Tips: d.metrics.tips, GaugesRefreshedAt: d.metrics.refreshedAt}
+	d.metrics.mu.Unlock()
+
+	m.NodesAdded = d.metrics.nodesAdded.Load()
+	m.NodesDeleted = d.metrics.nodesDeleted.Load()
+	m.Recomputes = d.metrics.recomputes.Load()
+	m.RecomputeSeconds = time.Duration(d.metrics.recomputeNanos.Load()).Seconds()
+	m.Peers = d.Peers()
+	m.NodeCache = d.store.CacheStats()
+	return m
+}
+
+// RefreshGraphGauges counts the nodes and tips in one pass over the keys
+// and the children index.
+func (d *DAG) RefreshGraphGauges() error {
+	d.mu.RLock()
+	nodes, tips := 0, 0
+	iter := d.store.Iterator()
+	for iter.Next() {
+		nodes++
+		id := string(iter.Key())
+		isTip, err := d.isTipInternal(id)
+		if err != nil {
+			iter.Release()
+			d.mu.RUnlock()
+			return fmt.Errorf("failed to read children of %s: %v", id, err)
+		}
+		if isTip {
+			tips++
+		}
+	}
+	iter.Release()
+	err := iter.Error()
+	d.mu.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to iterate nodes: %v", err)
+	}
+
+	d.metrics.mu.Lock()
+	d.metrics.nodes, d.metrics.tips, d.metrics.refreshedAt = nodes, tips, time.Now()
+	d.metrics.mu.Unlock()
+	return nil
+}
+
+// RunMetricsRefresher calls RefreshGraphGauges at once and then every
+// interval until ctx is cancelled.
+func (d *DAG) RunMetricsRefresher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := d.RefreshGraphGauges(); err != nil {
+			d.logger.Errorf("Failed to refresh metrics: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// countEvent feeds the added and deleted counters from emitted events.
+func (m *metricsState) countEvent(eventType string) {
+	switch eventType {
+	case EventNodeAdded:
+		m.nodesAdded.Add(1)
+	case EventNodeDeleted:
+		m.nodesDeleted.Add(1)
+	}
+}
+
+// observeRecompute records a recompute that started at start.
+func (m *metricsState) observeRecompute(start time.Time) {
+	m.recomputes.Add(1)
+	m.recomputeNanos.Add(int64(time.Since(start)))
+}
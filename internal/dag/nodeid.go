@@ -0,0 +1,66 @@
+package dag
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// DefaultMaxIDLength is the longest node ID accepted unless WithMaxIDLength
+// sets another limit.
+const DefaultMaxIDLength = 256
+
+// WithMaxIDLength sets the longest node ID, in bytes, that AddNode, sync and
+// import accept. Zero or less keeps DefaultMaxIDLength.
+func WithMaxIDLength(n int) Option {
+	return func(d *DAG) {
+		if n > 0 {
+			d.maxIDLength = n
+		}
+	}
+}
+
+// checkNodeKeys rejects a node whose ID, parent IDs or type cannot be part of
+// a store key. The child, hash and type index keys separate their parts with
+// a NUL byte, so a NUL inside a parent ID or type would make one node's
+// entries match another's prefix: a parent "a\x00b" would give "a" a child.
+func (d *DAG) checkNodeKeys(node *store.Node) error {
+	if err := d.checkID(node.ID); err != nil {
+		return err
+	}
+	for _, p := range node.Parents {
+		if hasControl(p) {
+			return fmt.Errorf("%w: parent ID %q contains a control character", ErrInvalidID, p)
+		}
+	}
+	if hasControl(node.Type) {
+		return fmt.Errorf("%w: %q contains a control character", ErrTypeNotAllowed, node.Type)
+	}
+	return nil
+}
+
+// checkID rejects IDs that cannot be stored as a node key: empty IDs, IDs
+// longer than maxIDLength, IDs with control characters and IDs inside a key
+// space the store reserves for its indexes and metadata.
+func (d *DAG) checkID(id string) error {
+	if id == "" {
+		return fmt.Errorf("%w: ID is empty", ErrInvalidID)
+	}
+	if hasControl(id) {
+		return fmt.Errorf("%w: ID %q contains a control character", ErrInvalidID, id)
+	}
+	if len(id) > d.maxIDLength {
+		return fmt.Errorf("%w: ID is %d bytes, max allowed: %d", ErrInvalidID, len(id), d.maxIDLength)
+	}
+	if prefix := store.ReservedPrefix(id); prefix != "" {
+		return fmt.Errorf("%w: ID %q starts with the reserved prefix %q", ErrInvalidID, id, prefix)
+	}
+	return nil
+}
+
+// hasControl reports whether s contains a control character, NUL included.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
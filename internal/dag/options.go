@@ -0,0 +1,142 @@
+package dag
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// Option configures optional DAG behaviour in New.
+type Option func(*DAG)
+
+// WithAutoParents sets how many tips AddNode selects when a node arrives with
+// null parents. Zero means min(2, maxParents); values above maxParents are
+// capped so auto-selected nodes always pass the max-parents check.
+func WithAutoParents(n int) Option {
+	return func(d *DAG) {
+		d.autoParents = n
+	}
+}
+
+// WithMinParents sets the minimum number of parents every non-genesis node
+// must reference, whether supplied by the client or auto-selected.
+func WithMinParents(n int) Option {
+	return func(d *DAG) {
+		d.minParents = n
+	}
+}
+
+// WithRequireTipParents rejects client-supplied parents that already have
+// children with ErrNonTipParent. When false, the default, such nodes are
+// accepted with a warning and counted in GraphStats.NonTipAttachments.
+func WithRequireTipParents(require bool) Option {
+	return func(d *DAG) {
+		d.requireTipParents = require
+	}
+}
+
+// WithPeers registers the configured peers so they are listed by Peers
+// before their first sync, and holds ProbeReadiness back until a sync with
+// one of them has succeeded.
+func WithPeers(peers []string) Option {
+	return func(d *DAG) {
+		d.awaitingPeerSync.Store(len(peers) > 0)
+		for _, p := range peers {
+			d.peers.register(RedactPeerAddr(normalizedOrRaw(p)))
+		}
+	}
+}
+
+// WithAllowedTypes restricts node types to types. Untyped nodes are always
+// accepted; an empty list, the default, accepts any type.
+func WithAllowedTypes(types []string) Option {
+	return func(d *DAG) {
+		if len(types) == 0 {
+			d.allowedTypes = nil
+			return
+		}
+		d.allowedTypes = make(map[string]bool, len(types))
+		for _, t := range types {
+			d.allowedTypes[t] = true
+		}
+	}
+}
+
+// SyncHTTPOptions tunes the HTTP client shared by every peer sync. Zero
+// values fall back to a 5s timeout and the net/http transport defaults.
+type SyncHTTPOptions struct {
+	Timeout             time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	// InsecureSkipVerify disables TLS certificate checks; only meant for tests.
+	InsecureSkipVerify bool
+	// MaxResponseBytes caps the /nodes body read from a peer; a sync that
+	// exceeds it is aborted with ErrSyncResponseTooLarge. Zero selects 64 MiB.
+	MaxResponseBytes int64
+}
+
+const defaultMaxSyncResponseBytes = 64 << 20
+
+// WithSyncHTTP replaces the sync HTTP client with one built from o. The client
+// is reused across peers and sync ticks so connections are pooled.
+func WithSyncHTTP(o SyncHTTPOptions) Option {
+	return func(d *DAG) {
+		d.httpClient = newSyncHTTPClient(o)
+		if o.MaxResponseBytes > 0 {
+			d.maxSyncResponseBytes = o.MaxResponseBytes
+		}
+	}
+}
+
+func newSyncHTTPClient(o SyncHTTPOptions) *http.Client {
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Second
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if o.MaxIdleConns > 0 {
+		transport.MaxIdleConns = o.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+	}
+	if o.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Timeout: o.Timeout, Transport: transport}
+}
+
+// WithAllowMultipleGenesis controls whether a node with explicitly empty
+// parents may be added once the DAG already holds nodes. It defaults to true.
+func WithAllowMultipleGenesis(allow bool) Option {
+	return func(d *DAG) {
+		d.allowMultipleGenesis = allow
+	}
+}
+
+// WithScanBatchSize makes full scans such as GetAllNodes and
+// RecomputeCumulativeWeights read from a store snapshot instead of holding
+// the lock, and makes RecomputeCumulativeWeights write its updates size
+// nodes per write lock. Weight deltas still being coalesced are applied as
+// of the read, not the snapshot. Zero (the default) keeps the strict
+// behaviour of holding the lock for the whole scan.
+func WithScanBatchSize(size int) Option {
+	return func(d *DAG) {
+		if size > 0 {
+			d.scanBatchSize = size
+		}
+	}
+}
+
+// WithMaxStoreBytes rejects new nodes with ErrStoreFull once the estimated
+// store size reaches bytes. Zero disables the limit.
+func WithMaxStoreBytes(bytes int64) Option {
+	return func(d *DAG) {
+		if bytes > 0 {
+			d.maxStoreBytes = bytes
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package dag
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// PeerCredentials authenticate sync requests to one peer. A Token is sent as
+// a bearer token; otherwise Username and Password are sent as basic auth.
+type PeerCredentials struct {
+	Token    string
+	Username string
+	Password string
+}
+
+// String keeps credentials out of logs and debug output.
+func (c PeerCredentials) String() string {
+	switch {
+	case c.Token != "":
+		return "bearer [REDACTED]"
+	case c.Username != "":
+		return "basic " + c.Username + ":[REDACTED]"
+	}
+	return "none"
+}
+
+// GoString keeps credentials out of %#v output.
+func (c PeerCredentials) GoString() string {
+	return c.String()
+}
+
+// WithPeerAuth sets the credentials sent with sync requests. perPeer is keyed
+// by peer address and takes precedence; peers without an entry get
+// clusterToken as a bearer token when it is set.
+func WithPeerAuth(clusterToken string, perPeer map[string]PeerCredentials) Option {
+	return func(d *DAG) {
+		d.clusterToken = clusterToken
+		d.peerAuth = make(map[string]PeerCredentials, len(perPeer))
+		for addr, creds := range perPeer {
+			d.peerAuth[normalizedOrRaw(addr)] = creds
+		}
+	}
+}
+
+func (d *DAG) authorizePeerRequest(req *http.Request, peerAddr string) {
+	creds, ok := d.peerAuth[peerAddr]
+	switch {
+	case ok && creds.Token != "":
+		req.Header.Set("Authorization", "Bearer "+creds.Token)
+	case ok && creds.Username != "":
+		req.SetBasicAuth(creds.Username, creds.Password)
+	case d.clusterToken != "":
+		req.Header.Set("Authorization", "Bearer "+d.clusterToken)
+	}
+}
+
+// NormalizePeerAddr checks that addr is an absolute http or https URL and
+// strips trailing slashes, so endpoints can be joined onto it and the same
+// peer configured in several places always matches. The config package
+// applies it to every peer and primary URL at load time.
+func NormalizePeerAddr(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if !strings.Contains(addr, "://") {
+		// Without a scheme "host:port" does not parse as a URL at all.
+		return "", fmt.Errorf("invalid peer address: missing http or https scheme")
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		// The url.Error text repeats addr, password included.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return "", fmt.Errorf("invalid peer address: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid peer address %s: scheme must be http or https", RedactPeerAddr(addr))
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid peer address %s: missing host", RedactPeerAddr(addr))
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid peer address %s: query and fragment are not allowed", RedactPeerAddr(addr))
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// normalizedOrRaw keys per-peer settings by the normalized address, leaving
+// a malformed one as given so SyncWithPeer reports it.
+func normalizedOrRaw(addr string) string {
+	if n, err := NormalizePeerAddr(addr); err == nil {
+		return n
+	}
+	return addr
+}
+
+// RedactPeerAddr hides any password embedded in a peer address before it is
+// logged or reported by Peers.
+func RedactPeerAddr(addr string) string {
+	u, err := url.Parse(addr)
+	if err != nil || u.User == nil {
+		return addr
+	}
+	return u.Redacted()
+}
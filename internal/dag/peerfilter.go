@@ -0,0 +1,243 @@
+package dag
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// ParentPolicy decides what a filtered sync does with a node whose parent is
+// neither stored locally nor part of the filtered set.
+type ParentPolicy string
+
+const (
+	// ParentSkip rejects the node; it is counted as skipped-invalid and
+	// retried on the next sync, so it lands once its parent arrives by
+	// another route.
+	ParentSkip ParentPolicy = "skip"
+	// ParentPull fetches each missing parent from the same peer with
+	// GET /nodes/{id}, outside the filter, and merges it before the child.
+	ParentPull ParentPolicy = "pull"
+)
+
+// maxParentPullDepth bounds how far ParentPull follows a chain of missing
+// ancestors for a single node.
+const maxParentPullDepth = 64
+
+// ParseParentPolicy validates a configured policy. An empty value selects
+// ParentSkip.
+func ParseParentPolicy(s string) (ParentPolicy, error) {
+	switch p := ParentPolicy(s); p {
+	case "":
+		return ParentSkip, nil
+	case ParentSkip, ParentPull:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown parent policy %q", s)
+}
+
+// PeerFilter limits SyncWithPeer to the peer's nodes whose IDs start with
+// Prefix. Parents decides how parents outside the prefix are handled.
+type PeerFilter struct {
+	Prefix  string
+	Parents ParentPolicy
+}
+
+// WithPeerFilters sets a sync filter per peer address. Peers without a
+// filter are synced in full.
+func WithPeerFilters(filters map[string]PeerFilter) Option {
+	return func(d *DAG) {
+		d.peerFilters = make(map[string]PeerFilter, len(filters))
+		for addr, f := range filters {
+			d.peerFilters[normalizedOrRaw(addr)] = f
+		}
+	}
+}
+
+func (d *DAG) peerFilter(peerAddr string) PeerFilter {
+	return d.peerFilters[peerAddr]
+}
+
+// query returns the GET /nodes query string for the filter, asking only
+// for changes after since when it is positive.
+func (f PeerFilter) query(since int64) string {
+	q := url.Values{}
+	if f.Prefix != "" {
+		q.Set("prefix", f.Prefix)
+	}
+	if since > 0 {
+		q.Set("since_seq", strconv.FormatInt(since, 10))
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
+
+// mergePeerNode validates and stores a new node received from a peer and
+// adds its ancestor weight deltas to deltas once the node is stored. Invalid
+// nodes and nodes whose ancestors cannot be read are counted and skipped;
+// the returned error is non-nil only when the sync must stop. The caller
+// holds d.mu.
+func (d *DAG) mergePeerNode(peerAddr string, node *store.Node, cycle *SyncMetrics, deltas map[string]float64, merged *[]string) error {
+	label := RedactPeerAddr(peerAddr)
+
+	if err := d.checkNodeKeys(node); err != nil {
+		d.logger.Warnf("Skipping node from peer %s: %v", label, err)
+		cycle.SkippedInvalid++
+		return nil
+	}
+
+	deleted, err := d.tombstoned(node)
+	if err != nil {
+		cycle.Failed++
+		return d.storeFailure("failed to read tombstone of "+node.ID, err)
+	}
+	if deleted {
+		d.logger.Infof("Not merging node %s from peer %s: deleted here", node.ID, label)
+		cycle.SkippedDeleted++
+		return nil
+	}
+
+	if err := d.checkGenesis(node); err != nil {
+		d.logger.Warnf("Genesis check failed for node %s from peer %s: %v", node.ID, label, err)
+		cycle.SkippedInvalid++
+		return nil
+	}
+
+	if err := d.checkType(node); err != nil {
+		d.logger.Warnf("Type check failed for node %s from peer %s: %v", node.ID, label, err)
+		cycle.SkippedInvalid++
+		return nil
+	}
+
+	if err := d.validateParents(node.ID, node.Parents); err != nil {
+		d.logger.Warnf("Cycle check failed for node %s from peer %s: %v", node.ID, label, err)
+		cycle.SkippedInvalid++
+		return nil
+	}
+
+	if len(node.Parents) > d.maxParents {
+		d.logger.Warnf("Node %s has too many parents: %d, max allowed: %d", node.ID, len(node.Parents), d.maxParents)
+		cycle.SkippedInvalid++
+		return nil
+	}
+
+	if node.Weight == 0 {
+		node.Weight = d.defaultWeight
+	}
+	node.CumulativeWeight = node.Weight
+
+	if err := d.checkStoreSize(); err != nil {
+		cycle.Failed++
+		return err
+	}
+
+	// The deltas join the sync's batch only once the node is stored, so a
+	// node that fails to store credits no ancestor.
+	nodeDeltas := make(map[string]float64)
+	err = d.addWeightDeltas(node, node.Weight, nodeDeltas, d.maxAncestorUpdates)
+	deferred := errors.Is(err, errTooManyAncestors)
+	if err != nil && !deferred {
+		d.logger.Errorf("Not merging node %s from peer %s: failed to read its ancestors: %v", node.ID, label, err)
+		cycle.Failed++
+		return nil
+	}
+
+	var deferrals []*store.Node
+	if deferred {
+		deferrals = []*store.Node{node}
+	}
+	if err := d.storeNodes([]*store.Node{node}, deferrals); err != nil {
+		d.logger.Errorf("Failed to add node %s from peer %s: %v", node.ID, label, err)
+		cycle.Failed++
+		return nil
+	}
+	for id, delta := range nodeDeltas {
+		deltas[id] += delta
+	}
+	d.recordWrite(node)
+	d.logger.Infof("Node %s merged from peer %s with weight %f", node.ID, label, node.Weight)
+	d.emit(EventNodeAdded, node.ID, node)
+	*merged = append(*merged, node.ID)
+	cycle.Merged++
+	return nil
+}
+
+// pullMissingParents fetches, for ParentPull, each parent of nodes that is
+// neither stored here nor in nodes, following chains of missing ancestors up
+// to maxParentPullDepth. It runs before the merge takes the DAG lock, so the
+// requests to the peer never hold up reads and writes. The pulled parents
+// are returned ancestors first, ahead of nodes; the merge then orders them
+// like any other node. A parent the peer cannot serve is left missing, so
+// its child is counted as dangling.
+func (d *DAG) pullMissingParents(ctx context.Context, peerAddr string, nodes []*store.Node, cycle *SyncMetrics) []*store.Node {
+	known := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		known[node.ID] = true
+	}
+	var pulled []*store.Node
+	var pull func(node *store.Node, depth int)
+	pull = func(node *store.Node, depth int) {
+		for _, parentID := range node.Parents {
+			if depth == 0 || ctx.Err() != nil {
+				return
+			}
+			if parentID == node.ID || known[parentID] {
+				continue
+			}
+			known[parentID] = true
+			if ok, err := d.store.Has(parentID); err != nil || ok {
+				continue
+			}
+			parent, err := d.fetchPeerNode(ctx, peerAddr, parentID)
+			if err != nil {
+				d.logger.Warnf("Failed to pull parent %s of %s from peer %s: %v", parentID, node.ID, RedactPeerAddr(peerAddr), err)
+				continue
+			}
+			cycle.Pulled++
+			pull(parent, depth-1)
+			pulled = append(pulled, parent)
+		}
+	}
+	for _, node := range nodes {
+		pull(node, maxParentPullDepth)
+	}
+	return append(pulled, nodes...)
+}
+
+func (d *DAG) fetchPeerNode(ctx context.Context, peerAddr, id string) (*store.Node, error) {
+	endpoint, err := url.JoinPath(peerAddr, "nodes", url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	d.authorizePeerRequest(req, peerAddr)
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+
+	var node store.Node
+	if err := json.NewDecoder(io.LimitReader(resp.Body, d.maxSyncResponseBytes)).Decode(&node); err != nil {
+		return nil, fmt.Errorf("failed to decode node: %v", err)
+	}
+	if node.ID != id {
+		return nil, fmt.Errorf("peer returned node %s", node.ID)
+	}
+	return &node, nil
+}
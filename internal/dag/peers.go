@@ -0,0 +1,199 @@
+package dag
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LastSeqHeader carries the changefeed seq a GET /nodes listing is complete
+// up to. A syncing node saves it as the peer's cursor and sends it back as
+// ?since_seq= to pull only what changed.
+const LastSeqHeader = "X-Last-Seq"
+
+// SyncMetrics counts what a sync with one peer transferred and did.
+type SyncMetrics struct {
+	Pulled          int `json:"pulled"`
+	Merged          int `json:"merged"`
+	SkippedExisting int `json:"skipped_existing"`
+	SkippedInvalid  int `json:"skipped_invalid"`
+	Failed          int `json:"failed"`
+	Conflicts       int `json:"conflicts"`
+	Tampered        int `json:"tampered"`
+	SkippedDeleted  int `json:"skipped_deleted"`
+	Deleted         int `json:"deleted"`
+	// Dangling counts nodes left unmerged because a parent is neither stored
+	// here nor among the nodes the peer sent.
+	Dangling   int   `json:"dangling"`
+	Bytes      int64 `json:"bytes"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+func (m *SyncMetrics) add(o SyncMetrics) {
+	m.Pulled += o.Pulled
+	m.Merged += o.Merged
+	m.SkippedExisting += o.SkippedExisting
+	m.SkippedInvalid += o.SkippedInvalid
+	m.Failed += o.Failed
+	m.Conflicts += o.Conflicts
+	m.Tampered += o.Tampered
+	m.SkippedDeleted += o.SkippedDeleted
+	m.Deleted += o.Deleted
+	m.Dangling += o.Dangling
+	m.Bytes += o.Bytes
+	m.DurationMs += o.DurationMs
+}
+
+// PeerStats is the registry entry for one peer: the last sync cycle, the
+// cumulative totals and the IDs merged by the last cycle. Entries are saved
+// in the store after every sync, so they survive restarts.
+//
+// Cursor is the peer's changefeed seq up to which every node has been
+// merged; CursorPrefix is the sync filter it was taken under. The cursor
+// only advances after a cycle with no failed or invalid nodes, so a node
+// that could not be merged is offered again.
+type PeerStats struct {
+	Address       string      `json:"address"`
+	Syncs         int         `json:"syncs"`
+	Failures      int         `json:"failures"`
+	LastSyncAt    time.Time   `json:"last_sync_at"`
+	LastSuccessAt time.Time   `json:"last_success_at"`
+	LastError     string      `json:"last_error,omitempty"`
+	LastCycle     SyncMetrics `json:"last_cycle"`
+	Totals        SyncMetrics `json:"totals"`
+	LastMerged    []string    `json:"last_merged"`
+	Cursor        int64       `json:"cursor"`
+	CursorPrefix  string      `json:"cursor_prefix,omitempty"`
+}
+
+type peerRegistry struct {
+	mu    sync.Mutex
+	peers map[string]*PeerStats
+}
+
+func (r *peerRegistry) entry(addr string) *PeerStats {
+	if r.peers == nil {
+		r.peers = map[string]*PeerStats{}
+	}
+	p, ok := r.peers[addr]
+	if !ok {
+		p = &PeerStats{Address: addr, LastMerged: []string{}}
+		r.peers[addr] = p
+	}
+	return p
+}
+
+func (r *peerRegistry) register(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entry(addr)
+}
+
+// cursor returns the saved cursor for addr if it was taken under prefix.
+func (r *peerRegistry) cursor(addr, prefix string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := r.entry(addr)
+	if p.CursorPrefix != prefix {
+		return 0
+	}
+	return p.Cursor
+}
+
+// record folds a finished cycle into the entry for addr and returns the
+// updated entry. A positive cursor replaces the saved one.
+func (r *peerRegistry) record(addr string, cycle SyncMetrics, merged []string, cursor int64, prefix string, err error) PeerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.entry(addr)
+	p.Syncs++
+	p.LastSyncAt = time.Now()
+	p.LastCycle = cycle
+	p.Totals.add(cycle)
+	if err != nil {
+		p.Failures++
+		p.LastError = err.Error()
+		return *p
+	}
+	p.LastSuccessAt = p.LastSyncAt
+	p.LastError = ""
+	p.LastMerged = append([]string{}, merged...)
+	if cursor > 0 {
+		p.Cursor = cursor
+		p.CursorPrefix = prefix
+	}
+	return *p
+}
+
+func (r *peerRegistry) restore(p PeerStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peers == nil {
+		r.peers = map[string]*PeerStats{}
+	}
+	if p.LastMerged == nil {
+		p.LastMerged = []string{}
+	}
+	r.peers[p.Address] = &p
+}
+
+func (r *peerRegistry) list() []PeerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peers := make([]PeerStats, 0, len(r.peers))
+	for _, p := range r.peers {
+		c := *p
+		c.LastMerged = append([]string{}, p.LastMerged...)
+		peers = append(peers, c)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	return peers
+}
+
+// Peers returns a snapshot of the sync registry, sorted by address.
+func (d *DAG) Peers() []PeerStats {
+	return d.peers.list()
+}
+
+// loadPeers restores the registry saved by earlier runs.
+func (d *DAG) loadPeers() {
+	states, err := d.store.PeerStates()
+	if err != nil {
+		d.logger.Errorf("Failed to load peer registry: %v", err)
+		return
+	}
+	for addr, data := range states {
+		var p PeerStats
+		if err := json.Unmarshal(data, &p); err != nil {
+			d.logger.Errorf("Failed to decode saved state of peer %s: %v", addr, err)
+			continue
+		}
+		p.Address = addr
+		d.peers.restore(p)
+	}
+}
+
+func (d *DAG) savePeer(p PeerStats) {
+	data, err := json.Marshal(p)
+	if err == nil {
+		err = d.store.PutPeerState(p.Address, data)
+	}
+	if err != nil {
+		d.logger.Errorf("Failed to save state of peer %s: %v", p.Address, err)
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
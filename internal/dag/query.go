@@ -0,0 +1,224 @@
+package dag
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// NodeQuery filters and pages ListNodes. The zero value lists every node.
+type NodeQuery struct {
+	// IsTip keeps only tips when true and only non-tips when false.
+	IsTip *bool
+	// Limit caps the page size; zero means no limit.
+	Limit int
+	// Offset skips this many matching nodes before the page starts.
+	Offset int
+	// After resumes the listing after this node ID, as returned in
+	// NodePage.NextCursor.
+	After string
+	// Prefix keeps only nodes whose IDs start with it.
+	Prefix string
+	// Type keeps only nodes of this type, read from the type index.
+	Type string
+}
+
+// NodePage is one page of ListNodes in node ID order, which is LevelDB key
+// order: IDs compare bytewise, so "B" sorts before "a" and "n10" before
+// "n9". NextCursor is empty on the last page. Total counts every node
+// matching the query regardless of After, Offset and Limit when that is
+// known without an extra scan, and is -1 otherwise.
+type NodePage struct {
+	Nodes      []store.Node
+	NextCursor string
+	Total      int
+}
+
+// ListNodes returns the nodes matching q. Tip filtering uses the children
+// index, so the cost is one index lookup per scanned node.
+func (d *DAG) ListNodes(q NodeQuery) (*NodePage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if q.Type != "" {
+		return d.listNodesByType(q)
+	}
+
+	iter := d.store.IteratorPrefix(q.Prefix, q.After)
+	defer iter.Release()
+
+	page := &NodePage{Nodes: []store.Node{}, Total: -1}
+	skipped := 0
+	for iter.Next() {
+		var node store.Node
+		if err := json.Unmarshal(iter.Value(), &node); err != nil {
+			d.logger.Errorf("Failed to unmarshal node: %v", err)
+			continue
+		}
+		if q.IsTip != nil {
+			children, err := d.store.GetChildren(node.ID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read children of %s: %v", node.ID, err)
+			}
+			if (len(children) == 0) != *q.IsTip {
+				continue
+			}
+		}
+		if skipped < q.Offset {
+			skipped++
+			continue
+		}
+		if q.Limit > 0 && len(page.Nodes) == q.Limit {
+			page.NextCursor = page.Nodes[len(page.Nodes)-1].ID
+			break
+		}
+		d.applyPendingWeight(&node)
+		page.Nodes = append(page.Nodes, node)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to iterate nodes: %v", err)
+	}
+	if page.NextCursor == "" && q.After == "" {
+		page.Total = skipped + len(page.Nodes)
+	}
+	return page, nil
+}
+
+// listNodesByType is ListNodes for a query with a Type, walking the type
+// index instead of every node. The caller holds d.mu.
+func (d *DAG) listNodesByType(q NodeQuery) (*NodePage, error) {
+	ids, err := d.store.NodesByType(q.Type)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read type index: %v", err)
+	}
+
+	page := &NodePage{Nodes: []store.Node{}, Total: -1}
+	if q.IsTip == nil {
+		page.Total = 0
+		for _, id := range ids {
+			if strings.HasPrefix(id, q.Prefix) {
+				page.Total++
+			}
+		}
+	}
+	skipped := 0
+	for _, id := range ids {
+		if id <= q.After || !strings.HasPrefix(id, q.Prefix) {
+			continue
+		}
+		if q.IsTip != nil {
+			hasChildren, err := d.store.HasChildren(id)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read children of %s: %v", id, err)
+			}
+			if !hasChildren != *q.IsTip {
+				continue
+			}
+		}
+		if skipped < q.Offset {
+			skipped++
+			continue
+		}
+		if q.Limit > 0 && len(page.Nodes) == q.Limit {
+			page.NextCursor = page.Nodes[len(page.Nodes)-1].ID
+			break
+		}
+		node, err := d.getNodeInternal(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch node %s: %v", id, err)
+		}
+		if node != nil {
+			page.Nodes = append(page.Nodes, *node)
+		}
+	}
+	if page.Total < 0 && page.NextCursor == "" && q.After == "" {
+		page.Total = skipped + len(page.Nodes)
+	}
+	return page, nil
+}
+
+// NodesByType returns every node of type typ in ID order.
+func (d *DAG) NodesByType(typ string) ([]store.Node, error) {
+	page, err := d.ListNodes(NodeQuery{Type: typ})
+	if err != nil {
+		return nil, err
+	}
+	return page.Nodes, nil
+}
+
+// NodesChangedSince returns the current state of every node written after
+// changefeed seq since whose ID starts with prefix, in first-write order so
+// parents precede their children, and the seq the result is complete up to.
+// Deleted nodes are left out.
+func (d *DAG) NodesChangedSince(since int64, prefix string) ([]store.Node, int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	until := d.store.LastSeq()
+	seen := map[string]bool{}
+	ids := []string{}
+	err := d.store.ReplayChanges(since, until, func(c *store.Change) bool {
+		if c.Op == store.ChangePut && !seen[c.ID] && strings.HasPrefix(c.ID, prefix) {
+			seen[c.ID] = true
+			ids = append(ids, c.ID)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read changefeed: %v", err)
+	}
+
+	nodes := make([]store.Node, 0, len(ids))
+	for _, id := range ids {
+		node, err := d.getNodeInternal(id)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to fetch node %s: %v", id, err)
+		}
+		if node != nil {
+			nodes = append(nodes, *node)
+		}
+	}
+	return nodes, until, nil
+}
+
+// TipFlags reports for each of ids whether it currently has no children,
+// using the children index.
+func (d *DAG) TipFlags(ids []string) (map[string]bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	flags := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		children, err := d.store.GetChildren(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read children of %s: %v", id, err)
+		}
+		flags[id] = len(children) == 0
+	}
+	return flags, nil
+}
+
+// Snapshot returns a point-in-time view of the stored nodes for exports.
+// It is taken under the lock, so no add or delete is half-applied in it.
+// Pending weight deltas are flushed first, so its cumulative weights match
+// what GET /nodes/{id} returned at that point. The caller must Release it.
+func (d *DAG) Snapshot() (*store.Snapshot, error) {
+	if d.coalescer == nil || d.building.Load() {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+	} else {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if err := d.flushLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	snap, err := d.store.Snapshot()
+	if err != nil {
+		return nil, d.storeFailure("failed to take snapshot", err)
+	}
+	return snap, nil
+}
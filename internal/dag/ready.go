@@ -0,0 +1,107 @@
+package dag
+
+import (
+	"fmt"
+)
+
+// StartIndexBuild rebuilds the secondary indexes in the background if the
+// store's indexes are missing or were built with an older layout. Until the
+// build finishes Ready reports false and writes fail with ErrNotReady, so a
+// load balancer polling /readyz withholds traffic while the server is already
+// listening. The returned channel is closed when the build ends. If it
+// fails the node stays not ready until POST /admin/rebuild-indexes succeeds.
+//
+// The build holds the read lock, so reads are served throughout. Writes are
+// gated by ErrNotReady, and the background writers that do not go through
+// checkWritable skip their work while the build runs instead of queueing on
+// the lock behind it.
+func (d *DAG) StartIndexBuild() (<-chan struct{}, error) {
+	done := make(chan struct{})
+	current, err := d.store.IndexesCurrent()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check indexes: %v", err)
+	}
+	if current {
+		close(done)
+		return done, nil
+	}
+
+	d.building.Store(true)
+	go func() {
+		defer close(done)
+		defer d.building.Store(false)
+
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		d.logger.Infof("Building indexes before accepting writes")
+		entries, err := d.store.RebuildIndexesWithProgress(func(nodes int) {
+			d.logger.Infof("Indexed %d nodes", nodes)
+		})
+		if err != nil {
+			d.logger.Errorf("Failed to build indexes, staying not ready: %v", err)
+			d.indexBuildFailed.Store(true)
+			return
+		}
+		d.logger.Infof("Built indexes with %d entries, ready for writes", entries)
+	}()
+	return done, nil
+}
+
+// Readiness returns nil when the node can accept writes, ErrNotReady while
+// the startup index build runs or after it failed, ErrStoreCorrupt once
+// Recover has found unrecoverable records, or ErrStoreUnavailable after a
+// store failure until a probe of the store succeeds again.
+func (d *DAG) Readiness() error {
+	if d.building.Load() {
+		return ErrNotReady
+	}
+	if d.indexBuildFailed.Load() {
+		return fmt.Errorf("%w: the index build failed", ErrNotReady)
+	}
+	if n := d.unrecoverable.Load(); n > 0 {
+		return fmt.Errorf("%w: %d found during recovery", ErrStoreCorrupt, n)
+	}
+	if d.storeDown.Load() {
+		if err := d.store.Ping(); err != nil {
+			return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+		}
+		if d.storeDown.CompareAndSwap(true, false) {
+			d.logger.Infof("Store recovered, ready for writes")
+		}
+	}
+	return nil
+}
+
+// ProbeReadiness is Readiness for a readiness probe. It also checks that the
+// store answers a read and a write and, on a node with configured peers
+// that is not a replica, that a sync with one of them has succeeded since
+// startup, so a fresh node gets no traffic before it has caught up. Writes
+// do not wait for that sync.
+func (d *DAG) ProbeReadiness() error {
+	if err := d.Readiness(); err != nil {
+		return err
+	}
+	if err := d.store.Ping(); err != nil {
+		return d.storeFailure("readiness probe failed", err)
+	}
+	if d.primaryAddr == "" && d.awaitingPeerSync.Load() {
+		return fmt.Errorf("%w: waiting for the first peer sync", ErrNotReady)
+	}
+	return nil
+}
+
+// Ready reports whether the node can accept writes.
+func (d *DAG) Ready() bool {
+	return d.Readiness() == nil
+}
+
+func (d *DAG) checkReady() error {
+	return d.Readiness()
+}
+
+// storeFailure marks the node not ready and wraps err in ErrStoreUnavailable.
+func (d *DAG) storeFailure(context string, err error) error {
+	d.logger.Errorf("Store failure, marking node not ready: %s: %v", context, err)
+	d.storeDown.Store(true)
+	return fmt.Errorf("%w: %s: %v", ErrStoreUnavailable, context, err)
+}
@@ -0,0 +1,79 @@
+package dag
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// RecoveryReport summarizes a Recover pass. Structure defects such as
+// missing parents are reported but left alone, since an import with
+// deferred validation can store them deliberately; Unrecoverable lists the
+// keys of records that could not be decoded as the node they are stored
+// under.
+type RecoveryReport struct {
+	Structure     StructureReport `json:"structure"`
+	Unrecoverable []string        `json:"unrecoverable"`
+	DurationMs    int64           `json:"duration_ms"`
+}
+
+// Recover checks and repairs the store by running the verify-structure,
+// rebuild-indexes and recompute admin operations in turn. If it finds
+// unrecoverable records the node stops accepting writes and Readiness
+// reports ErrStoreCorrupt until the process is restarted.
+func (d *DAG) Recover() (*RecoveryReport, error) {
+	start := time.Now()
+	d.logger.Infof("Running store recovery")
+
+	unrecoverable, err := d.findUnrecoverable()
+	if err != nil {
+		return nil, err
+	}
+	structure, err := d.VerifyStructure()
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range []string{MaintenanceRebuildIndexes, MaintenanceRecompute} {
+		fn, _ := d.maintenanceOp(step)
+		if err := fn(); err != nil {
+			return nil, fmt.Errorf("recovery step %s failed: %v", step, err)
+		}
+	}
+
+	report := &RecoveryReport{
+		Structure:     structure,
+		Unrecoverable: unrecoverable,
+		DurationMs:    time.Since(start).Milliseconds(),
+	}
+	d.unrecoverable.Store(int64(len(unrecoverable)))
+	d.logger.Infof("Recovery checked %d nodes in %dms: %d self loops, %d duplicate parents, %d missing parents, %d unrecoverable records",
+		structure.NodesChecked, report.DurationMs, len(structure.SelfLoops), len(structure.DuplicateParents),
+		len(structure.MissingParents), len(unrecoverable))
+	if len(unrecoverable) > 0 {
+		d.logger.Errorf("Refusing writes: unrecoverable records %v", unrecoverable)
+	}
+	return report, nil
+}
+
+// findUnrecoverable returns the keys of node records that do not decode or
+// that hold a node with a different ID.
+func (d *DAG) findUnrecoverable() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	keys := []string{}
+	iter := d.store.Iterator()
+	defer iter.Release()
+	for iter.Next() {
+		var node store.Node
+		if err := json.Unmarshal(iter.Value(), &node); err != nil || node.ID != string(iter.Key()) {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("failed to scan nodes: %v", err)
+	}
+	return keys, nil
+}
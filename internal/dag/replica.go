@@ -0,0 +1,216 @@
+package dag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// replicationPageSize is how many changes a replica requests per poll. A
+// full page is followed immediately by the next one.
+const replicationPageSize = 1000
+
+// ChangesPage is the body of GET /changes.
+type ChangesPage struct {
+	Changes []store.Change `json:"changes"`
+	LastSeq int64          `json:"last_seq"`
+}
+
+// ReplicationStatus reports how far a replica is behind its primary.
+type ReplicationStatus struct {
+	Primary    string    `json:"primary"`
+	AppliedSeq int64     `json:"applied_seq"`
+	PrimarySeq int64     `json:"primary_seq"`
+	Lag        int64     `json:"lag"`
+	LastPollAt time.Time `json:"last_poll_at"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+type replicationState struct {
+	mu     sync.Mutex
+	status ReplicationStatus
+}
+
+// WithReplicaOf makes the DAG a read-only replica of the node at primary.
+// Client writes, imports and peer syncs are rejected with ErrReadOnly; the
+// DAG only changes through RunReplication.
+func WithReplicaOf(primary string) Option {
+	return func(d *DAG) {
+		if primary != "" {
+			d.replication = &replicationState{status: ReplicationStatus{Primary: RedactPeerAddr(primary)}}
+			d.primaryAddr = normalizedOrRaw(primary)
+		}
+	}
+}
+
+// Changes returns up to limit changefeed entries after since.
+func (d *DAG) Changes(since int64, limit int) (*ChangesPage, error) {
+	changes, err := d.store.Changes(since, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read changefeed: %v", err)
+	}
+	return &ChangesPage{Changes: changes, LastSeq: d.store.LastSeq()}, nil
+}
+
+// LastSeq returns the seq of the most recent change.
+func (d *DAG) LastSeq() int64 {
+	return d.store.LastSeq()
+}
+
+// ChangeNotify returns a channel that is closed when the next change is
+// committed.
+func (d *DAG) ChangeNotify() <-chan struct{} {
+	return d.store.ChangeNotify()
+}
+
+// ReplicationStatus returns the replica's progress, or nil on a primary.
+func (d *DAG) ReplicationStatus() *ReplicationStatus {
+	if d.replication == nil {
+		return nil
+	}
+	d.replication.mu.Lock()
+	defer d.replication.mu.Unlock()
+	s := d.replication.status
+	return &s
+}
+
+// checkWritable rejects writes on a replica or while indexes are building.
+// It is called before taking d.mu, which the index build holds.
+func (d *DAG) checkWritable() error {
+	if err := d.checkReady(); err != nil {
+		return err
+	}
+	if d.replication != nil {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// RunReplication tails the primary's changefeed until ctx is cancelled. The
+// last applied primary seq is persisted after every change, so after a
+// disconnect or restart the replica resumes where it stopped. A change may be
+// applied twice if the node stops between the write and the seq update; both
+// puts and deletes are idempotent, so this is harmless.
+func (d *DAG) RunReplication(ctx context.Context, interval time.Duration) {
+	if d.replication == nil {
+		return
+	}
+	for {
+		full, err := d.pollPrimary(ctx)
+		if err != nil {
+			d.logger.Errorf("Replication from %s failed: %v", d.replication.status.Primary, err)
+		}
+		if full && err == nil {
+			continue
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pollPrimary fetches and applies one page of changes and reports whether
+// the page was full. It does nothing while the startup index build runs.
+func (d *DAG) pollPrimary(ctx context.Context) (bool, error) {
+	if d.building.Load() {
+		return false, nil
+	}
+	applied, err := d.store.ReplicationSeq()
+	if err != nil {
+		return false, fmt.Errorf("failed to read replication seq: %v", err)
+	}
+
+	page, err := d.fetchChanges(ctx, applied)
+	d.replication.mu.Lock()
+	d.replication.status.LastPollAt = time.Now()
+	d.replication.status.AppliedSeq = applied
+	if err != nil {
+		d.replication.status.LastError = err.Error()
+		d.replication.mu.Unlock()
+		return false, err
+	}
+	d.replication.status.PrimarySeq = page.LastSeq
+	d.replication.mu.Unlock()
+
+	for _, c := range page.Changes {
+		if err := d.applyChange(&c); err != nil {
+			d.setReplicationError(applied, err)
+			return false, err
+		}
+		applied = c.Seq
+	}
+
+	lag := page.LastSeq - applied
+	if lag < 0 {
+		lag = 0
+	}
+	d.replication.mu.Lock()
+	d.replication.status.AppliedSeq = applied
+	d.replication.status.Lag = lag
+	d.replication.status.LastError = ""
+	d.replication.mu.Unlock()
+	return len(page.Changes) == replicationPageSize, nil
+}
+
+func (d *DAG) fetchChanges(ctx context.Context, since int64) (*ChangesPage, error) {
+	endpoint, err := url.JoinPath(d.primaryAddr, "changes")
+	if err != nil {
+		return nil, fmt.Errorf("invalid primary address: %v", err)
+	}
+	endpoint += "?since=" + strconv.FormatInt(since, 10) + "&limit=" + strconv.Itoa(replicationPageSize)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	d.authorizePeerRequest(req, d.primaryAddr)
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch changes: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("primary returned status %d", resp.StatusCode)
+	}
+
+	var page ChangesPage
+	if err := json.NewDecoder(io.LimitReader(resp.Body, d.maxSyncResponseBytes)).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to decode changes: %v", err)
+	}
+	return &page, nil
+}
+
+func (d *DAG) applyChange(c *store.Change) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch {
+	case c.Op == store.ChangePut && c.After != nil:
+		if err := d.store.PutNode(c.After); err != nil {
+			return fmt.Errorf("failed to apply change %d: %v", c.Seq, err)
+		}
+	case c.Op == store.ChangeDelete:
+		if err := d.store.DeleteNode(c.ID); err != nil {
+			return fmt.Errorf("failed to apply change %d: %v", c.Seq, err)
+		}
+	default:
+		d.logger.Warnf("Skipping malformed change %d for %s", c.Seq, c.ID)
+	}
+	return d.store.SetReplicationSeq(c.Seq)
+}
+
+func (d *DAG) setReplicationError(applied int64, err error) {
+	d.replication.mu.Lock()
+	defer d.replication.mu.Unlock()
+	d.replication.status.AppliedSeq = applied
+	d.replication.status.LastError = err.Error()
+}
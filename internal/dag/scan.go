@@ -0,0 +1,135 @@
+package dag
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+// scanNodes calls fn for every stored node. In strict mode (no scan batch
+// size) the read lock is held for the whole scan; otherwise the scan reads a
+// store snapshot taken under the lock and releases the lock at once, so a
+// long scan does not block writers and still sees a single point in time.
+func (d *DAG) scanNodes(fn func(*store.Node)) error {
+	if d.scanBatchSize <= 0 {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return d.scanIterator(d.store.Iterator(), true, fn)
+	}
+
+	snap, err := d.Snapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+	return d.scanIterator(snap.Iterator(), false, fn)
+}
+
+// scanIterator calls fn for every node iter yields and releases iter. Nodes
+// read from the live store get their pending weight deltas applied; a
+// snapshot already holds the deltas Snapshot flushed into it, and those
+// queued since belong to a later point in time.
+func (d *DAG) scanIterator(iter iterator.Iterator, live bool, fn func(*store.Node)) error {
+	defer iter.Release()
+	for iter.Next() {
+		var node store.Node
+		if err := json.Unmarshal(iter.Value(), &node); err != nil {
+			d.logger.Errorf("Failed to unmarshal node: %v", err)
+			continue
+		}
+		if live {
+			d.applyPendingWeight(&node)
+		}
+		fn(&node)
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("failed to iterate nodes: %v", err)
+	}
+	return nil
+}
+
+// recomputeCumulativeWeightsBatched is RecomputeCumulativeWeights for a
+// configured scan batch size: the graph is read from a snapshot and the
+// weights are corrected scanBatchSize nodes per write lock. Each correction
+// is the difference between the recomputed total and the snapshot's weight,
+// added to the node's current weight, so deltas committed by writes since
+// the snapshot are kept.
+func (d *DAG) recomputeCumulativeWeightsBatched() error {
+	defer d.metrics.observeRecompute(time.Now())
+	snap, err := d.recomputeSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snap.Release()
+
+	nodes, children, err := d.loadGraphFrom(snap.Iterator(), false)
+	if err != nil {
+		return err
+	}
+
+	corrections := map[string]float64{}
+	stale := []string{}
+	for id, node := range nodes {
+		total := coneWeight(id, nodes, children)
+		if node.CumulativeWeight != total {
+			corrections[id] = total - node.CumulativeWeight
+			stale = append(stale, id)
+		}
+	}
+	sort.Strings(stale)
+
+	for start := 0; start < len(stale); start += d.scanBatchSize {
+		end := start + d.scanBatchSize
+		if end > len(stale) {
+			end = len(stale)
+		}
+		if err := d.writeWeightCorrections(stale[start:end], corrections); err != nil {
+			return err
+		}
+	}
+
+	d.logger.Infof("Recomputed cumulative weights for %d nodes in batches of %d", len(nodes), d.scanBatchSize)
+	return nil
+}
+
+// recomputeSnapshot flushes pending weight deltas, takes a snapshot and
+// clears the deferred marks, all under one write lock. The recomputed
+// totals include the deferred weights, so from then on those nodes count
+// like any other: a reconcile no longer adds their weight again, and a
+// concurrent delete subtracts it from the ancestors as usual.
+func (d *DAG) recomputeSnapshot() (*store.Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.flushLocked(); err != nil {
+		return nil, err
+	}
+	deferred, err := d.store.DeferredWeights()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deferred weights: %v", err)
+	}
+	snap, err := d.store.Snapshot()
+	if err != nil {
+		return nil, d.storeFailure("failed to take snapshot", err)
+	}
+	if err := d.clearDeferred(deferred); err != nil {
+		snap.Release()
+		return nil, fmt.Errorf("failed to clear deferred weights: %v", err)
+	}
+	return snap, nil
+}
+
+// writeWeightCorrections adds the corrections of ids to their current
+// cumulative weights in one batch.
+func (d *DAG) writeWeightCorrections(ids []string, corrections map[string]float64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deltas := make(map[string]float64, len(ids))
+	for _, id := range ids {
+		deltas[id] = corrections[id]
+	}
+	return d.applyWeightDeltas(deltas)
+}
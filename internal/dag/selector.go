@@ -0,0 +1,48 @@
+package dag
+
+import "github.com/sivaram/dag-leveldb/internal/store"
+
+// TipSelector chooses up to maxTips tips, for parent selection and
+// SelectTips. SelectTips is called with d's lock held, read or write, so it
+// must read the graph through TipsLocked and NodeLocked; the DAG's other
+// methods take the lock themselves and would deadlock.
+type TipSelector interface {
+	SelectTips(d *DAG, maxTips int) ([]string, error)
+}
+
+// MCMCSelector is the default TipSelector: weighted random walks from the
+// configured start pool towards the tips, biased by cumulative weight.
+type MCMCSelector struct{}
+
+func (MCMCSelector) SelectTips(d *DAG, maxTips int) ([]string, error) {
+	return d.selectTipsMCMCInternal(maxTips, nil, nil)
+}
+
+// WithTipSelector replaces MCMC selection with s for auto-selected parents
+// and SelectTips. SelectTipsMCMC and its variants always run MCMC. A nil s
+// keeps MCMC.
+func WithTipSelector(s TipSelector) Option {
+	return func(d *DAG) {
+		if s == nil {
+			s = MCMCSelector{}
+		}
+		d.tipSelector = s
+	}
+}
+
+// SelectTips returns up to maxTips tips chosen by the configured TipSelector.
+func (d *DAG) SelectTips(maxTips int) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.tipSelector.SelectTips(d, maxTips)
+}
+
+// TipsLocked is GetTips for a TipSelector, which runs with the lock held.
+func (d *DAG) TipsLocked() ([]string, error) {
+	return d.getTipsInternal()
+}
+
+// NodeLocked is GetNode for a TipSelector, which runs with the lock held.
+func (d *DAG) NodeLocked(id string) (*store.Node, error) {
+	return d.getNodeInternal(id)
+}
@@ -0,0 +1,97 @@
+package dag
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// GraphStats is the summary served by GET /stats.
+type GraphStats struct {
+	NodeCount     int   `json:"node_count"`
+	StoreBytes    int64 `json:"store_bytes"`
+	MaxStoreBytes int64 `json:"max_store_bytes,omitempty"`
+	// NonTipAttachments counts nodes accepted with client-supplied parents
+	// that were not tips, since startup.
+	NonTipAttachments int64 `json:"non_tip_attachments"`
+	// DeferredWeights counts nodes whose weight has not yet been added to
+	// their ancestors.
+	DeferredWeights int64               `json:"deferred_weights"`
+	Events          *EventMetrics       `json:"events,omitempty"`
+	Replication     *ReplicationStatus  `json:"replication,omitempty"`
+	Maintenance     []MaintenanceStatus `json:"maintenance,omitempty"`
+	Storage         *store.StorageStats `json:"storage,omitempty"`
+}
+
+// Stats counts the nodes and reports the current store size estimate.
+func (d *DAG) Stats() (*GraphStats, error) {
+	stats := &GraphStats{
+		StoreBytes:        d.storeBytes.Load(),
+		MaxStoreBytes:     d.maxStoreBytes,
+		NonTipAttachments: d.nonTipAttachments.Load(),
+		DeferredWeights:   d.deferredWeights.Load(),
+		Events:            d.EventMetrics(),
+		Replication:       d.ReplicationStatus(),
+		Maintenance:       d.MaintenanceStatus(),
+	}
+	err := d.scanNodes(func(*store.Node) {
+		stats.NodeCount++
+	})
+	if err != nil {
+		return nil, err
+	}
+	if stats.Storage, err = d.store.StorageStats(); err != nil {
+		d.logger.Errorf("Failed to read storage stats: %v", err)
+	}
+	return stats, nil
+}
+
+// RefreshStoreSize replaces the store size estimate with LevelDB's current
+// on-disk size. Between refreshes the estimate grows by the approximate size
+// of every node written, so the limit also holds inside the memtable.
+func (d *DAG) RefreshStoreSize() error {
+	size, err := d.store.ApproximateSize()
+	if err != nil {
+		d.logger.Errorf("Failed to estimate store size: %v", err)
+		return err
+	}
+	d.storeBytes.Store(size)
+	return nil
+}
+
+// RunStoreSizeEstimator refreshes the store size estimate every interval
+// until ctx is cancelled.
+func (d *DAG) RunStoreSizeEstimator(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.RefreshStoreSize()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *DAG) checkStoreSize() error {
+	if d.maxStoreBytes <= 0 {
+		return nil
+	}
+	if size := d.storeBytes.Load(); size >= d.maxStoreBytes {
+		return fmt.Errorf("%w: %d of %d bytes used", ErrStoreFull, size, d.maxStoreBytes)
+	}
+	return nil
+}
+
+// recordWrite adds the approximate size of a newly written node to the
+// store size estimate.
+func (d *DAG) recordWrite(node *store.Node) {
+	n := len(node.ID)*2 + len(node.Data) + 128
+	for _, p := range node.Parents {
+		n += len(p)*2 + 16
+	}
+	d.storeBytes.Add(int64(n))
+}
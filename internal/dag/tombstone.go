@@ -0,0 +1,169 @@
+package dag
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// WithSoftDelete makes deletes leave a tombstone in place of the node.
+// Tombstoned nodes are gone from reads, tips and scans, but sync serves the
+// tombstones to peers, which delete their copy, and refuses to merge the
+// node back from a peer that has not caught up. Between a tombstone and a
+// copy of the node, whichever was written last wins. PurgeTombstones drops
+// tombstones older than ttl; a peer that stays out of sync for longer can
+// bring the node back. A zero ttl keeps tombstones forever.
+func WithSoftDelete(enabled bool, ttl time.Duration) Option {
+	return func(d *DAG) {
+		d.softDelete = enabled
+		d.tombstoneTTL = ttl
+	}
+}
+
+// removeNode deletes id from the store, leaving a tombstone dated at when
+// soft deletes are enabled. The caller holds d.mu.
+func (d *DAG) removeNode(id string, at time.Time) error {
+	if d.softDelete {
+		return d.store.TombstoneNode(id, at)
+	}
+	return d.store.DeleteNode(id)
+}
+
+// tombstoned reports whether node, as received from a peer, was deleted here
+// after the peer last wrote it.
+func (d *DAG) tombstoned(node *store.Node) (bool, error) {
+	if !d.softDelete {
+		return false, nil
+	}
+	ts, err := d.store.GetTombstone(node.ID)
+	if err != nil || ts == nil {
+		return false, err
+	}
+	return !node.UpdatedAt.After(ts.DeletedAt), nil
+}
+
+// Tombstones returns the tombstones of nodes whose IDs start with prefix.
+func (d *DAG) Tombstones(prefix string) ([]store.Tombstone, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.store.Tombstones(prefix)
+}
+
+// syncTombstones applies tombstones fetched from a peer. The caller holds
+// d.mu.
+func (d *DAG) syncTombstones(tombstones []store.Tombstone, label string, cycle *SyncMetrics) {
+	for _, ts := range tombstones {
+		if err := d.applyTombstone(ts, label, cycle); err != nil {
+			d.logger.Errorf("Failed to apply tombstone of %s from peer %s: %v", ts.ID, label, err)
+			cycle.Failed++
+		}
+	}
+}
+
+// applyTombstone deletes the local copy of a node a peer deleted, unless it
+// was written after the deletion or has gained children since. A tombstone
+// for a node never seen here is kept so no other peer can bring it in.
+func (d *DAG) applyTombstone(ts store.Tombstone, label string, cycle *SyncMetrics) error {
+	local, err := d.store.GetTombstone(ts.ID)
+	if err != nil {
+		return err
+	}
+	if local != nil && !ts.DeletedAt.After(local.DeletedAt) {
+		return nil
+	}
+	node, err := d.getNodeInternal(ts.ID)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return d.store.TombstoneNode(ts.ID, ts.DeletedAt)
+	}
+	if node.UpdatedAt.After(ts.DeletedAt) {
+		return nil
+	}
+	hasChildren, err := d.store.HasChildren(ts.ID)
+	if err != nil {
+		return err
+	}
+	if hasChildren {
+		d.logger.Warnf("Keeping node %s deleted by peer %s: it has children here", ts.ID, label)
+		return nil
+	}
+	if err := d.deleteNodeAt(ts.ID, ts.DeletedAt); err != nil {
+		return err
+	}
+	cycle.Deleted++
+	return nil
+}
+
+func (d *DAG) fetchTombstones(ctx context.Context, peerAddr, prefix string) ([]store.Tombstone, error) {
+	endpoint, err := url.JoinPath(peerAddr, "tombstones")
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		endpoint += "?" + url.Values{"prefix": {prefix}}.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	d.authorizePeerRequest(req, peerAddr)
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("peer returned status %d", resp.StatusCode)
+	}
+
+	var tombstones []store.Tombstone
+	if err := json.NewDecoder(io.LimitReader(resp.Body, d.maxSyncResponseBytes)).Decode(&tombstones); err != nil {
+		return nil, fmt.Errorf("failed to decode tombstones: %v", err)
+	}
+	return tombstones, nil
+}
+
+// PurgeTombstones drops tombstones older than the configured TTL.
+func (d *DAG) PurgeTombstones() error {
+	if d.tombstoneTTL <= 0 {
+		return nil
+	}
+	n, err := d.store.PurgeTombstones(time.Now().Add(-d.tombstoneTTL))
+	if err != nil {
+		d.logger.Errorf("Failed to purge tombstones: %v", err)
+		return err
+	}
+	if n > 0 {
+		d.logger.Infof("Purged %d expired tombstones", n)
+	}
+	return nil
+}
+
+// RunTombstoneGC calls PurgeTombstones every interval until ctx is
+// cancelled. It returns at once unless soft deletes with a TTL are enabled.
+func (d *DAG) RunTombstoneGC(ctx context.Context, interval time.Duration) {
+	if !d.softDelete || d.tombstoneTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.PurgeTombstones()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
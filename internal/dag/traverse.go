@@ -0,0 +1,395 @@
+package dag
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// ErrInvalidCursor is returned when a traversal cursor is unknown, has
+// expired or belongs to a different traversal.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TraversalPage is one page of a breadth-first traversal. Truncated is set
+// while more IDs remain, which NextCursor resumes from until it expires
+// after cursorTTL.
+type TraversalPage struct {
+	IDs        []string `json:"ids"`
+	Truncated  bool     `json:"truncated"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// traversalCursor is the resumable state of a BFS: the pending frontier and
+// every ID already queued or emitted, so a resumed walk never repeats a node.
+// depths holds the depth of each queued ID. The state stays on the server,
+// since the seen set grows with the walk; clients get an opaque token.
+type traversalCursor struct {
+	root      string
+	direction string
+	maxDepth  int
+	queue     []string
+	depths    []int
+	seen      map[string]struct{}
+	expires   time.Time
+}
+
+// cursorTTL is how long a traversal can be resumed after the page that
+// returned its cursor.
+const cursorTTL = 10 * time.Minute
+
+// maxCursors caps the traversals held for resuming. Once full, the cursor
+// closest to expiry is dropped to make room.
+const maxCursors = 1000
+
+// cursorStore holds the state of paged traversals by token. A token can be
+// resumed more than once, so a client may retry a page, until it expires.
+type cursorStore struct {
+	mu      sync.Mutex
+	entries map[string]*traversalCursor
+}
+
+func (c *cursorStore) put(state *traversalCursor) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate cursor: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b[:])
+	now := time.Now()
+	state.expires = now.Add(cursorTTL)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]*traversalCursor{}
+	}
+	var oldest string
+	for t, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, t)
+		} else if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = t
+		}
+	}
+	if len(c.entries) >= maxCursors {
+		delete(c.entries, oldest)
+	}
+	c.entries[token] = state
+	return token, nil
+}
+
+// get returns the state saved under token, or nil if it is unknown or has
+// expired. The state is shared, so callers must not modify it.
+func (c *cursorStore) get(token string) *traversalCursor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.entries[token]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(state.expires) {
+		delete(c.entries, token)
+		return nil
+	}
+	return state
+}
+
+// Ancestors returns up to limit ancestors of id in BFS order, resuming from
+// cursor when it is non-empty. A positive maxDepth stops the walk that many
+// parent links above id.
+func (d *DAG) Ancestors(id string, limit, maxDepth int, cursor string) (*TraversalPage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.traverse(id, "ancestors", limit, maxDepth, cursor, func(current string) ([]string, error) {
+		node, err := d.getNodeInternal(current)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			return nil, nil
+		}
+		return node.Parents, nil
+	})
+}
+
+// GetAncestors returns every ancestor of id in BFS order, without paging.
+func (d *DAG) GetAncestors(id string) ([]string, error) {
+	page, err := d.Ancestors(id, 0, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return page.IDs, nil
+}
+
+// Descendants returns up to limit descendants of id in BFS order, resuming
+// from cursor when it is non-empty. A positive maxDepth stops the walk that
+// many child links below id.
+func (d *DAG) Descendants(id string, limit, maxDepth int, cursor string) (*TraversalPage, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.traverse(id, "descendants", limit, maxDepth, cursor, d.store.GetChildren)
+}
+
+// GetDescendants returns every descendant of id in BFS order over the child
+// index, without paging.
+func (d *DAG) GetDescendants(id string) ([]string, error) {
+	page, err := d.Descendants(id, 0, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return page.IDs, nil
+}
+
+func (d *DAG) traverse(id, direction string, limit, maxDepth int, cursor string, next func(string) ([]string, error)) (*TraversalPage, error) {
+	root, err := d.getNodeInternal(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch node %s: %v", id, err)
+	}
+	if root == nil {
+		return nil, fmt.Errorf("node with ID %s not found", id)
+	}
+
+	if maxDepth < 0 {
+		maxDepth = 0
+	}
+	var queue []string
+	var depths []int
+	seen := map[string]struct{}{}
+	if cursor == "" {
+		seen[id] = struct{}{}
+		neighbours, err := next(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range neighbours {
+			if _, ok := seen[n]; !ok {
+				seen[n] = struct{}{}
+				queue = append(queue, n)
+				depths = append(depths, 1)
+			}
+		}
+	} else {
+		state := d.cursors.get(cursor)
+		if state == nil || state.root != id || state.direction != direction || state.maxDepth != maxDepth {
+			return nil, ErrInvalidCursor
+		}
+		queue = append([]string{}, state.queue...)
+		depths = append([]int{}, state.depths...)
+		for s := range state.seen {
+			seen[s] = struct{}{}
+		}
+	}
+
+	page := &TraversalPage{IDs: []string{}}
+	for len(queue) > 0 && (limit <= 0 || len(page.IDs) < limit) {
+		current, depth := queue[0], depths[0]
+		queue, depths = queue[1:], depths[1:]
+
+		node, err := d.getNodeInternal(current)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch node %s: %v", current, err)
+		}
+		if node == nil {
+			d.logger.Warnf("Skipping dangling reference %s while walking %s of %s", current, direction, id)
+			continue
+		}
+		page.IDs = append(page.IDs, current)
+		if maxDepth > 0 && depth >= maxDepth {
+			continue
+		}
+
+		neighbours, err := next(current)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range neighbours {
+			if _, ok := seen[n]; !ok {
+				seen[n] = struct{}{}
+				queue = append(queue, n)
+				depths = append(depths, depth+1)
+			}
+		}
+	}
+
+	if len(queue) > 0 {
+		page.Truncated = true
+		state := &traversalCursor{root: id, direction: direction, maxDepth: maxDepth, queue: queue, depths: depths, seen: seen}
+		page.NextCursor, err = d.cursors.put(state)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// HeaviestPath returns the chain from a genesis node to id that follows, at
+// each step down from id, the parent with the highest cumulative weight. Ties
+// go to the lower ID so the path is stable. A parent missing from the store
+// ends the path early.
+func (d *DAG) HeaviestPath(id string) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	node, err := d.getNodeInternal(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch node %s: %v", id, err)
+	}
+	if node == nil {
+		return nil, fmt.Errorf("node with ID %s not found", id)
+	}
+
+	path := []string{id}
+	seen := map[string]bool{id: true}
+	for len(node.Parents) > 0 {
+		var heaviest *store.Node
+		for _, p := range node.Parents {
+			parent, err := d.getNodeInternal(p)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch node %s: %v", p, err)
+			}
+			if parent == nil || seen[p] {
+				continue
+			}
+			if heaviest == nil || parent.CumulativeWeight > heaviest.CumulativeWeight ||
+				(parent.CumulativeWeight == heaviest.CumulativeWeight && parent.ID < heaviest.ID) {
+				heaviest = parent
+			}
+		}
+		if heaviest == nil {
+			break
+		}
+		seen[heaviest.ID] = true
+		path = append(path, heaviest.ID)
+		node = heaviest
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+// FindPath returns a shortest path by hop count from from down to to along
+// child links, both ends included, or an empty path if to is not a
+// descendant of from. Children are visited in ID order, so among paths of
+// equal length the same one is returned on every call.
+func (d *DAG) FindPath(from, to string) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, id := range []string{from, to} {
+		node, err := d.getNodeInternal(id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch node %s: %v", id, err)
+		}
+		if node == nil {
+			return nil, fmt.Errorf("node with ID %s not found", id)
+		}
+	}
+
+	// prev maps each queued ID to the ID it was reached from.
+	prev := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 && queue[0] != to {
+		current := queue[0]
+		queue = queue[1:]
+		children, err := d.store.GetChildren(current)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch children of %s: %v", current, err)
+		}
+		for _, c := range children {
+			if _, ok := prev[c]; !ok {
+				prev[c] = current
+				queue = append(queue, c)
+			}
+		}
+	}
+	if _, ok := prev[to]; !ok {
+		return []string{}, nil
+	}
+
+	path := []string{}
+	for id := to; id != ""; id = prev[id] {
+		path = append(path, id)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+// TopologicalSort returns every node with each parent before its children,
+// ordering nodes that are ready at the same time by ID so the order is the
+// same on every call. Parents missing from the store are ignored. It returns
+// ErrCycle if the parent links form a cycle. The graph is read from a
+// snapshot, so writes are not held up while the sort runs.
+func (d *DAG) TopologicalSort() ([]store.Node, error) {
+	snap, err := d.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Release()
+
+	nodes, children, err := d.loadGraphFrom(snap.Iterator(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]int, len(nodes))
+	ready := &idHeap{}
+	for id, node := range nodes {
+		seen := map[string]bool{}
+		for _, p := range node.Parents {
+			if _, ok := nodes[p]; ok && !seen[p] {
+				seen[p] = true
+				pending[id]++
+			}
+		}
+		if pending[id] == 0 {
+			*ready = append(*ready, id)
+		}
+	}
+	heap.Init(ready)
+
+	sorted := make([]store.Node, 0, len(nodes))
+	for ready.Len() > 0 {
+		id := heap.Pop(ready).(string)
+		sorted = append(sorted, *nodes[id])
+		seen := map[string]bool{}
+		for _, c := range children[id] {
+			if seen[c] {
+				continue
+			}
+			seen[c] = true
+			if pending[c]--; pending[c] == 0 {
+				heap.Push(ready, c)
+			}
+		}
+	}
+	if len(sorted) < len(nodes) {
+		d.logger.Errorf("Topological sort left %d of %d nodes on a cycle", len(nodes)-len(sorted), len(nodes))
+		return nil, fmt.Errorf("%w: %d nodes are on or behind a cycle", ErrCycle, len(nodes)-len(sorted))
+	}
+	return sorted, nil
+}
+
+// idHeap is a min-heap of node IDs.
+type idHeap []string
+
+func (h idHeap) Len() int            { return len(h) }
+func (h idHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h idHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *idHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *idHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,100 @@
+package dag
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+// UpdateNodeData replaces the data of node id, leaving its parents and
+// weights as they are.
+func (d *DAG) UpdateNodeData(id, data string) error {
+	return d.UpdateNode(id, &data, nil)
+}
+
+// UpdateNodeWeight sets the weight of node id and moves the difference onto
+// its own and every ancestor's cumulative weight, clamped as in AddNode.
+func (d *DAG) UpdateNodeWeight(id string, weight float64) error {
+	return d.UpdateNode(id, nil, &weight)
+}
+
+// UpdateNode applies the non-nil fields to node id in one write, together
+// with any ancestor weights a new weight changes. Parents never change.
+// Content-addressed nodes cannot be edited, since their ID would no longer
+// match their content.
+func (d *DAG) UpdateNode(id string, data *string, weight *float64) error {
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if weight != nil && (*weight <= 0 || math.IsNaN(*weight) || math.IsInf(*weight, 0)) {
+		return fmt.Errorf("%w: %v", ErrInvalidWeight, *weight)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// The stored record is read rather than getNodeInternal's, which can
+	// carry coalesced weight that is not written yet.
+	node, err := d.store.GetNode(id)
+	if err != nil {
+		return d.storeFailure("failed to read node "+id, err)
+	}
+	if node == nil {
+		return fmt.Errorf("node with ID %s not found", id)
+	}
+	if data != nil && *data == node.Data {
+		data = nil
+	}
+	if weight != nil && *weight == node.Weight {
+		weight = nil
+	}
+	if data == nil && weight == nil {
+		return nil
+	}
+	if node.ID == ContentHash(node) {
+		return fmt.Errorf("%w: node %s cannot change its content", ErrContentAddressed, id)
+	}
+	if err := d.checkStoreSize(); err != nil {
+		return err
+	}
+
+	if data != nil {
+		node.Data = *data
+	}
+	deltas := make(map[string]float64)
+	var ancestors []*store.Node
+	if weight != nil {
+		delta := *weight - node.Weight
+		node.Weight = *weight
+		node.CumulativeWeight = math.Max(node.CumulativeWeight+delta, node.Weight)
+
+		// A deferred node's weight never reached its ancestors, so neither
+		// does the change.
+		deferred, err := d.store.IsWeightDeferred(id)
+		if err != nil {
+			return d.storeFailure("failed to read deferred weight", err)
+		}
+		if !deferred {
+			if err := d.addWeightDeltas(node, delta, deltas, 0); err != nil {
+				return d.storeFailure("failed to update weights", err)
+			}
+			if d.coalescer == nil {
+				if ancestors, err = d.weightUpdates(deltas); err != nil {
+					return d.storeFailure("failed to update weights", err)
+				}
+			}
+		}
+	}
+
+	if err := d.store.AddNodes(append([]*store.Node{node}, ancestors...)); err != nil {
+		return d.storeFailure("failed to store node "+id, err)
+	}
+	d.queueWeightDeltas(deltas)
+	d.logger.Infof("Updated node %s", id)
+
+	d.applyPendingWeight(node)
+	d.emit(EventNodeUpdated, id, node)
+	d.emitConfirmed(ancestors, deltas)
+	return nil
+}
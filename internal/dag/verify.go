@@ -0,0 +1,74 @@
+package dag
+
+import (
+	"fmt"
+	"sort"
+)
+
+// EdgeIssue names a single parent reference of a node.
+type EdgeIssue struct {
+	ID     string `json:"id"`
+	Parent string `json:"parent"`
+}
+
+// StructureReport lists every edge-level defect found by VerifyStructure.
+type StructureReport struct {
+	NodesChecked     int         `json:"nodes_checked"`
+	SelfLoops        []string    `json:"self_loops"`
+	DuplicateParents []EdgeIssue `json:"duplicate_parents"`
+	MissingParents   []EdgeIssue `json:"missing_parents"`
+}
+
+// Valid reports whether no defect was found.
+func (r StructureReport) Valid() bool {
+	return len(r.SelfLoops) == 0 && len(r.DuplicateParents) == 0 && len(r.MissingParents) == 0
+}
+
+// VerifyStructure checks every node's parent list for self references,
+// repeated entries and references to nodes that do not exist. Unlike
+// checkCycle it looks only at individual edges, not at reachability.
+func (d *DAG) VerifyStructure() (StructureReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	report := StructureReport{
+		SelfLoops:        []string{},
+		DuplicateParents: []EdgeIssue{},
+		MissingParents:   []EdgeIssue{},
+	}
+	nodes, _, err := d.loadGraph()
+	if err != nil {
+		return report, fmt.Errorf("failed to load nodes: %v", err)
+	}
+	report.NodesChecked = len(nodes)
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		node := nodes[id]
+		seen := map[string]bool{}
+		for _, p := range node.Parents {
+			if p == id {
+				report.SelfLoops = append(report.SelfLoops, id)
+			}
+			if seen[p] {
+				report.DuplicateParents = append(report.DuplicateParents, EdgeIssue{ID: id, Parent: p})
+				continue
+			}
+			seen[p] = true
+			if _, ok := nodes[p]; !ok {
+				report.MissingParents = append(report.MissingParents, EdgeIssue{ID: id, Parent: p})
+			}
+		}
+	}
+
+	if !report.Valid() {
+		d.logger.Warnf("Structure check found %d self loops, %d duplicate parents, %d missing parents",
+			len(report.SelfLoops), len(report.DuplicateParents), len(report.MissingParents))
+	}
+	return report, nil
+}
@@ -0,0 +1,129 @@
+package dag
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/store"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+// weightTolerance is the absolute difference between a stored and a freshly
+// computed cumulative weight that is still considered consistent.
+const weightTolerance = 1e-6
+
+// DriftReport describes a node whose stored cumulative weight differs from
+// the weight of its cone (itself plus every distinct descendant).
+type DriftReport struct {
+	ID       string  `json:"id"`
+	Stored   float64 `json:"stored"`
+	Expected float64 `json:"expected"`
+	Drift    float64 `json:"drift"`
+}
+
+// loadGraph reads every node and builds the parent-to-children adjacency in
+// a single pass over the store.
+func (d *DAG) loadGraph() (map[string]*store.Node, map[string][]string, error) {
+	return d.loadGraphFrom(d.store.Iterator(), true)
+}
+
+// loadGraphFrom is loadGraph over the nodes iter yields, which come from the
+// live store when live is set and from a snapshot otherwise. It releases
+// iter.
+func (d *DAG) loadGraphFrom(iter iterator.Iterator, live bool) (map[string]*store.Node, map[string][]string, error) {
+	nodes := map[string]*store.Node{}
+	children := map[string][]string{}
+	err := d.scanIterator(iter, live, func(node *store.Node) {
+		nodes[node.ID] = node
+		for _, p := range node.Parents {
+			children[p] = append(children[p], node.ID)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return nodes, children, nil
+}
+
+// coneWeight sums the weight of id and of every distinct descendant.
+func coneWeight(id string, nodes map[string]*store.Node, children map[string][]string) float64 {
+	total := 0.0
+	if node, ok := nodes[id]; ok {
+		total = node.Weight
+	}
+	seen := map[string]struct{}{id: {}}
+	queue := append([]string{}, children[id]...)
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, ok := seen[current]; ok {
+			continue
+		}
+		seen[current] = struct{}{}
+		if desc, ok := nodes[current]; ok {
+			total += desc.Weight
+		}
+		queue = append(queue, children[current]...)
+	}
+	return total
+}
+
+// CheckWeightConsistency compares the stored cumulative weight of up to
+// sample randomly chosen nodes (all nodes when sample <= 0) against their
+// cone weight and reports every node drifting beyond the tolerance.
+func (d *DAG) CheckWeightConsistency(sample int) ([]DriftReport, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	nodes, children, err := d.loadGraph()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if sample > 0 && sample < len(ids) {
+		rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		ids = ids[:sample]
+		sort.Strings(ids)
+	}
+
+	drift := []DriftReport{}
+	for _, id := range ids {
+		expected := coneWeight(id, nodes, children)
+		stored := nodes[id].CumulativeWeight
+		if math.Abs(stored-expected) > weightTolerance {
+			drift = append(drift, DriftReport{ID: id, Stored: stored, Expected: expected, Drift: stored - expected})
+		}
+	}
+
+	if len(drift) > 0 {
+		d.logger.Warnf("Cumulative weight drift detected on %d of %d checked nodes", len(drift), len(ids))
+	} else {
+		d.logger.Debugf("Cumulative weights consistent on %d checked nodes", len(ids))
+	}
+	return drift, nil
+}
+
+// RunWeightChecker samples the DAG for weight drift every interval until ctx
+// is canceled.
+func (d *DAG) RunWeightChecker(ctx context.Context, interval time.Duration, sample int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.CheckWeightConsistency(sample); err != nil {
+				d.logger.Errorf("Weight consistency check failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Package events holds EventSink implementations for external brokers.
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/dag"
+)
+
+// NATSSink publishes events as JSON to a NATS subject using the core NATS
+// text protocol. It connects lazily and reconnects on the next Publish after
+// a failure, so retries are left to the caller. Each PUB is followed by a
+// PING, and Publish waits for the PONG, so a -ERR from the server fails the
+// publish it answers instead of passing unnoticed. Authentication and TLS
+// are not supported.
+type NATSSink struct {
+	addr    string
+	subject string
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	// replies carries the PONG and -ERR lines read from conn. readLoop
+	// closes it when conn fails.
+	replies chan string
+}
+
+// NewNATSSink returns a sink for a server address such as
+// "nats://localhost:4222" or "localhost:4222". URLs with credentials or
+// another scheme, such as tls://, are rejected since the sink could only
+// ignore them.
+func NewNATSSink(serverURL, subject string) (*NATSSink, error) {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("invalid NATS subject %q", subject)
+	}
+	addr := serverURL
+	if strings.Contains(serverURL, "://") {
+		u, err := url.Parse(serverURL)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("invalid NATS URL")
+		case u.User != nil:
+			return nil, fmt.Errorf("invalid NATS URL %s: credentials are not supported", u.Redacted())
+		case u.Scheme != "nats":
+			return nil, fmt.Errorf("invalid NATS URL %s: scheme must be nats, TLS is not supported", u.Redacted())
+		case u.Host == "":
+			return nil, fmt.Errorf("invalid NATS URL %s: missing host", u.Redacted())
+		}
+		addr = u.Host
+	}
+	return &NATSSink{addr: addr, subject: subject, timeout: 5 * time.Second}, nil
+}
+
+func (s *NATSSink) Publish(ev dag.Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", s.subject, len(payload), payload)
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.drop()
+		return fmt.Errorf("failed to publish to NATS: %v", err)
+	}
+	if err := s.awaitPong(); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %v", err)
+	}
+	return nil
+}
+
+// connect performs the INFO/CONNECT handshake, starts answering server
+// PINGs so the server keeps the connection open, and waits for the server
+// to accept the CONNECT. s.mu must be held.
+func (s *NATSSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS at %s: %v", s.addr, err)
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting from %s: %q", s.addr, line)
+	}
+	conn.SetReadDeadline(time.Time{})
+	if _, err := conn.Write([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"dag-node\"}\r\nPING\r\n")); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send NATS CONNECT: %v", err)
+	}
+	s.conn = conn
+	s.replies = make(chan string, 16)
+	go readLoop(conn, r, s.replies)
+	if err := s.awaitPong(); err != nil {
+		return fmt.Errorf("NATS server at %s refused the connection: %v", s.addr, err)
+	}
+	return nil
+}
+
+// awaitPong waits for the PONG answering the last PING, dropping the
+// connection on a -ERR, a timeout or a read failure. s.mu must be held.
+func (s *NATSSink) awaitPong() error {
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case line, ok := <-s.replies:
+		switch {
+		case !ok:
+			s.drop()
+			return fmt.Errorf("connection closed")
+		case strings.HasPrefix(line, "-ERR"):
+			s.drop()
+			return fmt.Errorf("server replied %s", strings.TrimSpace(line))
+		}
+		return nil
+	case <-timer.C:
+		s.drop()
+		return fmt.Errorf("no reply within %s", s.timeout)
+	}
+}
+
+// drop closes the connection so the next Publish reconnects. s.mu must be
+// held.
+func (s *NATSSink) drop() {
+	s.conn.Close()
+	s.conn = nil
+	s.replies = nil
+}
+
+// readLoop answers server PINGs and passes PONG and -ERR lines to replies
+// until conn fails. Writes on a net.Conn are safe alongside Publish's.
+func readLoop(conn net.Conn, r *bufio.Reader, replies chan<- string) {
+	defer close(replies)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			conn.Write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "PONG"), strings.HasPrefix(line, "-ERR"):
+			select {
+			case replies <- line:
+			default:
+			}
+		}
+	}
+}
+
+// Close drops the connection.
+func (s *NATSSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	s.replies = nil
+	return err
+}
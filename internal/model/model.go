@@ -1,10 +1,72 @@
-package model
-
-type GetNodeResponse struct {
-	ID               string   `json:"id"`
-	Data             string   `json:"data"`
-	Parents          []string `json:"parents"`
-	Weight           float64  `json:"weight"`
-	CumulativeWeight float64  `json:"cumulative_weight"`
-	Istip            bool     `json:"is_tip"`
-}
+package model
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/sivaram/dag-leveldb/internal/dag"
+	"github.com/sivaram/dag-leveldb/internal/store"
+)
+
+type GetNodeResponse struct {
+	ID               string   `json:"id"`
+	Data             string   `json:"data"`
+	Parents          []string `json:"parents"`
+	Weight           float64  `json:"weight"`
+	CumulativeWeight float64  `json:"cumulative_weight"`
+	Istip            bool     `json:"is_tip"`
+	IsGenesis        bool     `json:"is_genesis"`
+	Type             string   `json:"type,omitempty"`
+	Confirmed        bool     `json:"confirmed"`
+	// WeightPending is true while a descendant's weight is still deferred,
+	// so CumulativeWeight does not yet include every descendant.
+	WeightPending bool      `json:"weight_pending"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// MarshalJSON rounds the weights like store.Node does.
+func (r GetNodeResponse) MarshalJSON() ([]byte, error) {
+	type plain GetNodeResponse
+	p := plain(r)
+	p.Weight = store.RoundWeight(p.Weight)
+	p.CumulativeWeight = store.RoundWeight(p.CumulativeWeight)
+	return json.Marshal(p)
+}
+
+// SyncResponse reports the outcome of every node pushed to POST /sync.
+type SyncResponse struct {
+	Added           []string      `json:"added"`
+	SkippedExisting []string      `json:"skipped_existing"`
+	Failed          []SyncFailure `json:"failed"`
+}
+
+// ParentNotFoundResponse is the 400 body for a node naming a missing parent.
+type ParentNotFoundResponse struct {
+	Error    string `json:"error"`
+	ParentID string `json:"parent_id"`
+}
+
+type SyncFailure struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type TipsResponse struct {
+	Tips  []string     `json:"tips"`
+	Nodes []store.Node `json:"nodes,omitempty"`
+	Trace [][]string   `json:"trace,omitempty"`
+	// Params are the MCMC parameters used, reported with the trace.
+	Params *dag.MCMCParams `json:"params,omitempty"`
+}
+
+type IDsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// DryRunResponse is returned by POST /nodes?dry_run=true with the node as it
+// would have been stored.
+type DryRunResponse struct {
+	DryRun bool       `json:"dry_run"`
+	Node   store.Node `json:"node"`
+}
@@ -0,0 +1,417 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	defaultWriteBufferMax   = 1000
+	defaultWriteBufferFlush = 100 * time.Millisecond
+)
+
+// WithWriteBuffer makes AddNode queue nodes in memory and commit them to
+// LevelDB in one batch once max nodes are queued or every flushInterval,
+// whichever comes first. Point reads, scans and index lookups see queued
+// nodes without flushing; deletes, snapshots and changefeed reads flush the
+// queue first. Repeated writes to a queued node are coalesced into a single
+// changefeed entry. A zero max or interval falls back to a default; the
+// buffer is disabled when both are zero.
+func WithWriteBuffer(max int, flushInterval time.Duration) Option {
+	return func(s *Store) {
+		if max <= 0 && flushInterval <= 0 {
+			return
+		}
+		if max <= 0 {
+			max = defaultWriteBufferMax
+		}
+		if flushInterval <= 0 {
+			flushInterval = defaultWriteBufferFlush
+		}
+		s.buffer = &writeBuffer{
+			max:      max,
+			interval: flushInterval,
+			pending:  map[string]*Node{},
+			children: map[string]map[string]bool{},
+			created:  map[string]bool{},
+		}
+	}
+}
+
+// writeBuffer holds nodes accepted by AddNode but not yet written. Its fields
+// are guarded by Store.mu.
+type writeBuffer struct {
+	max      int
+	interval time.Duration
+	pending  map[string]*Node
+	order    []string
+	// children indexes the queued nodes by parent, as the child index on
+	// disk does for written ones.
+	children map[string]map[string]bool
+	// created holds the queued IDs not yet on disk, for NodeCount.
+	created map[string]bool
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// add queues nodes and flushes the queue once it holds max nodes. The
+// check is made once all of nodes are queued, so they are always flushed
+// together in one batch. If that flush fails, nodes are taken back out of
+// the queue, restoring any queued writes they replaced, so writes reported
+// as failed are not persisted by a later flush.
+func (b *writeBuffer) add(s *Store, nodes ...*Node) error {
+	var created []string
+	for _, node := range nodes {
+		if _, queued := b.pending[node.ID]; queued {
+			continue
+		}
+		onDisk, err := s.db.Has([]byte(node.ID), nil)
+		if err != nil {
+			return err
+		}
+		if !onDisk {
+			created = append(created, node.ID)
+		}
+	}
+	prev := make([]*Node, len(nodes))
+	for i, node := range nodes {
+		prev[i] = b.pending[node.ID]
+		b.put(node.ID, cloneNode(node))
+	}
+	for _, id := range created {
+		b.created[id] = true
+	}
+	if len(b.pending) < b.max {
+		return nil
+	}
+	if err := s.flushLocked(); err != nil {
+		for i := len(nodes) - 1; i >= 0; i-- {
+			b.put(nodes[i].ID, prev[i])
+		}
+		for _, id := range created {
+			delete(b.created, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// put makes node the queued write for id, or drops id from the queue when
+// node is nil.
+func (b *writeBuffer) put(id string, node *Node) {
+	prev, queued := b.pending[id]
+	if queued {
+		for _, p := range prev.Parents {
+			delete(b.children[p], id)
+		}
+	}
+	if node == nil {
+		if queued {
+			delete(b.pending, id)
+			for i, queuedID := range b.order {
+				if queuedID == id {
+					b.order = append(b.order[:i], b.order[i+1:]...)
+					break
+				}
+			}
+		}
+		return
+	}
+	if !queued {
+		b.order = append(b.order, id)
+	}
+	b.pending[id] = node
+	for _, p := range node.Parents {
+		if b.children[p] == nil {
+			b.children[p] = map[string]bool{}
+		}
+		b.children[p][id] = true
+	}
+}
+
+func (b *writeBuffer) start(s *Store) {
+	b.quit = make(chan struct{})
+	b.done = make(chan struct{})
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// A failed flush keeps the queue, so it is retried on the
+				// next tick and surfaces from Close at the latest.
+				s.Flush()
+			case <-b.quit:
+				return
+			}
+		}
+	}()
+}
+
+func (b *writeBuffer) stop() {
+	close(b.quit)
+	<-b.done
+}
+
+// Flush commits every buffered write. It is a no-op without a write buffer.
+func (s *Store) Flush() error {
+	if s.buffer == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *Store) flushLocked() error {
+	b := s.buffer
+	if b == nil || len(b.order) == 0 {
+		return nil
+	}
+	nodes := make([]*Node, 0, len(b.order))
+	for _, id := range b.order {
+		nodes = append(nodes, b.pending[id])
+	}
+	if err := s.putNodes(nodes); err != nil {
+		return err
+	}
+	b.pending = map[string]*Node{}
+	b.order = nil
+	b.children = map[string]map[string]bool{}
+	b.created = map[string]bool{}
+	return nil
+}
+
+// childrenOf returns the IDs of the queued nodes listing parent as a parent.
+func (b *writeBuffer) childrenOf(parent string) []string {
+	ids := make([]string, 0, len(b.children[parent]))
+	for id := range b.children[parent] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// matching returns the IDs of the queued nodes match accepts.
+func (b *writeBuffer) matching(match func(*Node) bool) []string {
+	var ids []string
+	for id, node := range b.pending {
+		if match(node) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// entries returns the queued records whose keys fall in r, sorted by key,
+// as an iterator over LevelDB would return them.
+func (b *writeBuffer) entries(r *util.Range) ([]bufferedEntry, error) {
+	var entries []bufferedEntry
+	for id, node := range b.pending {
+		key := []byte(id)
+		if r != nil && (bytes.Compare(key, r.Start) < 0 || (r.Limit != nil && bytes.Compare(key, r.Limit) >= 0)) {
+			continue
+		}
+		value, err := json.Marshal(node)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, bufferedEntry{key: key, value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+	return entries, nil
+}
+
+type bufferedEntry struct {
+	key, value []byte
+}
+
+// Iterator directions, as a mergedIterator last moved.
+const (
+	dirStart = iota - 2
+	dirBackward
+	dirNone
+	dirForward
+	dirEnd
+)
+
+// mergedIterator walks the node records on disk with the queued ones laid
+// over them. A queued node hides the record on disk with the same ID, so
+// the two sources never yield the same key and are merged by key order.
+type mergedIterator struct {
+	disk   iterator.Iterator
+	diskOK bool
+	hidden map[string]bool
+
+	queued []bufferedEntry
+	i      int
+
+	fromQueue bool
+	dir       int
+	util.BasicReleaser
+}
+
+// skip moves the disk iterator past reserved keys and hidden records in the
+// direction given.
+func (it *mergedIterator) skip(ok, forward bool) bool {
+	for ok && (isReservedKey(it.disk.Key()) || it.hidden[string(it.disk.Key())]) {
+		if forward {
+			ok = it.disk.Next()
+		} else {
+			ok = it.disk.Prev()
+		}
+	}
+	return ok
+}
+
+// pick positions the iterator on the nearer of the two sources' candidates.
+func (it *mergedIterator) pick(forward bool) bool {
+	queuedOK := it.i >= 0 && it.i < len(it.queued)
+	switch {
+	case queuedOK && it.diskOK:
+		it.fromQueue = (bytes.Compare(it.queued[it.i].key, it.disk.Key()) < 0) == forward
+	case queuedOK:
+		it.fromQueue = true
+	case it.diskOK:
+		it.fromQueue = false
+	default:
+		if forward {
+			it.dir = dirEnd
+		} else {
+			it.dir = dirStart
+		}
+		return false
+	}
+	if forward {
+		it.dir = dirForward
+	} else {
+		it.dir = dirBackward
+	}
+	return true
+}
+
+// queuedFrom returns the index of the first queued entry with a key at or
+// after key.
+func (it *mergedIterator) queuedFrom(key []byte) int {
+	return sort.Search(len(it.queued), func(j int) bool { return bytes.Compare(it.queued[j].key, key) >= 0 })
+}
+
+func (it *mergedIterator) First() bool {
+	it.diskOK = it.skip(it.disk.First(), true)
+	it.i = 0
+	return it.pick(true)
+}
+
+func (it *mergedIterator) Last() bool {
+	it.diskOK = it.skip(it.disk.Last(), false)
+	it.i = len(it.queued) - 1
+	return it.pick(false)
+}
+
+func (it *mergedIterator) Seek(key []byte) bool {
+	it.diskOK = it.skip(it.disk.Seek(key), true)
+	it.i = it.queuedFrom(key)
+	return it.pick(true)
+}
+
+func (it *mergedIterator) Next() bool {
+	switch it.dir {
+	case dirNone, dirStart:
+		return it.First()
+	case dirEnd:
+		return false
+	case dirForward:
+		if it.fromQueue {
+			it.i++
+		} else {
+			it.diskOK = it.skip(it.disk.Next(), true)
+		}
+		return it.pick(true)
+	}
+	// Turning around: move both sources to just after the current key.
+	key := append([]byte{}, it.Key()...)
+	ok := it.disk.Seek(key)
+	if ok && bytes.Equal(it.disk.Key(), key) {
+		ok = it.disk.Next()
+	}
+	it.diskOK = it.skip(ok, true)
+	it.i = it.queuedFrom(key)
+	if it.i < len(it.queued) && bytes.Equal(it.queued[it.i].key, key) {
+		it.i++
+	}
+	return it.pick(true)
+}
+
+func (it *mergedIterator) Prev() bool {
+	switch it.dir {
+	case dirNone, dirEnd:
+		return it.Last()
+	case dirStart:
+		return false
+	case dirBackward:
+		if it.fromQueue {
+			it.i--
+		} else {
+			it.diskOK = it.skip(it.disk.Prev(), false)
+		}
+		return it.pick(false)
+	}
+	// Turning around: move both sources to just before the current key.
+	key := append([]byte{}, it.Key()...)
+	ok := it.disk.Seek(key)
+	if ok {
+		ok = it.disk.Prev()
+	} else {
+		ok = it.disk.Last()
+	}
+	it.diskOK = it.skip(ok, false)
+	it.i = it.queuedFrom(key) - 1
+	return it.pick(false)
+}
+
+func (it *mergedIterator) Valid() bool {
+	return it.dir == dirForward || it.dir == dirBackward
+}
+
+func (it *mergedIterator) Key() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	if it.fromQueue {
+		return it.queued[it.i].key
+	}
+	return it.disk.Key()
+}
+
+func (it *mergedIterator) Value() []byte {
+	if !it.Valid() {
+		return nil
+	}
+	if it.fromQueue {
+		return it.queued[it.i].value
+	}
+	return it.disk.Value()
+}
+
+func (it *mergedIterator) Error() error {
+	return it.disk.Error()
+}
+
+func (it *mergedIterator) Release() {
+	it.disk.Release()
+	it.BasicReleaser.Release()
+}
+
+func cloneNode(n *Node) *Node {
+	c := *n
+	if n.Parents != nil {
+		c.Parents = append(make([]string, 0, len(n.Parents)), n.Parents...)
+	}
+	return &c
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// WithNodeCache keeps up to n decoded nodes in memory, evicting the least
+// recently read, so repeated GetNode calls for the same IDs skip LevelDB and
+// JSON decoding. Writes and deletes invalidate the IDs they touch. A
+// non-positive n disables the cache.
+func WithNodeCache(n int) Option {
+	return func(s *Store) {
+		if n <= 0 {
+			return
+		}
+		s.cache = &nodeCache{
+			max:   n,
+			order: list.New(),
+			items: map[string]*list.Element{},
+		}
+	}
+}
+
+// CacheStats counts node cache lookups since the store was opened.
+type CacheStats struct {
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Size     int   `json:"size"`
+	Capacity int   `json:"capacity"`
+}
+
+// CacheStats reports the node cache counters, or nil when the cache is
+// disabled.
+func (s *Store) CacheStats() *CacheStats {
+	if s.cache == nil {
+		return nil
+	}
+	s.cache.mu.Lock()
+	size := s.cache.order.Len()
+	s.cache.mu.Unlock()
+	return &CacheStats{
+		Hits:     s.cache.hits.Load(),
+		Misses:   s.cache.misses.Load(),
+		Size:     size,
+		Capacity: s.cache.max,
+	}
+}
+
+// nodeCache is an LRU of decoded node records. Entries are private copies,
+// so callers may modify what get returns.
+type nodeCache struct {
+	max int
+
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+	// epoch advances on every invalidation. A reader that started before an
+	// invalidation may have decoded the old record, so add drops it.
+	epoch uint64
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// get returns a copy of the cached node and the current epoch, which the
+// caller passes to add after reading the record itself on a miss.
+func (c *nodeCache) get(id string) (*Node, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[id]; ok {
+		c.order.MoveToFront(el)
+		c.hits.Add(1)
+		return cloneNode(el.Value.(*Node)), c.epoch
+	}
+	c.misses.Add(1)
+	return nil, c.epoch
+}
+
+func (c *nodeCache) add(node *Node, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+	if el, ok := c.items[node.ID]; ok {
+		el.Value = cloneNode(node)
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[node.ID] = c.order.PushFront(cloneNode(node))
+	if c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*Node).ID)
+	}
+}
+
+func (c *nodeCache) invalidate(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	for _, id := range ids {
+		if el, ok := c.items[id]; ok {
+			c.order.Remove(el)
+			delete(c.items, id)
+		}
+	}
+}
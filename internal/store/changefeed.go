@@ -0,0 +1,172 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Change operations recorded in the changefeed.
+const (
+	ChangePut    = "put"
+	ChangeDelete = "delete"
+)
+
+var (
+	seqKey            = []byte(metaPrefix + "seq")
+	replicationSeqKey = []byte(metaPrefix + "replication_seq")
+)
+
+// Change is one node mutation in the changefeed. Before is nil when the node
+// was created and After is nil when it was deleted, so replaying the feed in
+// seq order reproduces every past state of a node.
+type Change struct {
+	Seq    int64     `json:"seq"`
+	Op     string    `json:"op"`
+	ID     string    `json:"id"`
+	Before *Node     `json:"before,omitempty"`
+	After  *Node     `json:"after,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// changeKey zero-pads the seq so the feed iterates in seq order.
+func changeKey(seq int64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", changePrefix, seq))
+}
+
+func loadSeq(db *leveldb.DB) (int64, error) {
+	return loadSeqKey(db, seqKey)
+}
+
+func loadSeqKey(db *leveldb.DB, key []byte) (int64, error) {
+	data, err := db.Get(key, nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, fmt.Errorf("invalid seq record %s", key)
+	}
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+// ReplicationSeq returns the last primary seq applied by a replica.
+func (s *Store) ReplicationSeq() (int64, error) {
+	return loadSeqKey(s.db, replicationSeqKey)
+}
+
+// SetReplicationSeq records seq as the last primary seq applied. Buffered
+// writes are flushed first so the seq never runs ahead of the data.
+func (s *Store) SetReplicationSeq(seq int64) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(seq))
+	return s.db.Put(replicationSeqKey, buf[:], nil)
+}
+
+// stageChange adds the changefeed entry for seq to batch. The node write and
+// its entry are then committed together by commitChanges.
+func stageChange(batch *leveldb.Batch, seq int64, op, id string, before, after *Node) error {
+	change := Change{Seq: seq, Op: op, ID: id, Before: before, After: after, Time: time.Now().UTC()}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	batch.Put(changeKey(seq), data)
+	return nil
+}
+
+// commitChanges writes batch with lastSeq as the new changefeed head. s.mu
+// must be held.
+func (s *Store) commitChanges(batch *leveldb.Batch, lastSeq int64) error {
+	var seqBuf [8]byte
+	binary.BigEndian.PutUint64(seqBuf[:], uint64(lastSeq))
+	batch.Put(seqKey, seqBuf[:])
+	if err := s.db.Write(batch, nil); err != nil {
+		return err
+	}
+	s.seq = lastSeq
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+// ChangeNotify returns a channel that is closed once a change after the
+// current LastSeq is committed. Buffered writes only notify when flushed.
+func (s *Store) ChangeNotify() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+// LastSeq returns the seq of the most recent change. Buffered writes are
+// flushed first so they have a seq.
+func (s *Store) LastSeq() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+	return s.seq
+}
+
+// ReplayChanges calls fn for every change with since < seq <= until in seq
+// order, stopping early if fn returns false. until <= 0 means no upper bound.
+func (s *Store) ReplayChanges(since, until int64, fn func(*Change) bool) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	r := &util.Range{Start: changeKey(since + 1), Limit: []byte(changePrefix + "\xff")}
+	if until > 0 {
+		r.Limit = changeKey(until + 1)
+	}
+	iter := s.db.NewIterator(r, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var change Change
+		if err := json.Unmarshal(iter.Value(), &change); err != nil {
+			return fmt.Errorf("failed to decode change %s: %v", iter.Key(), err)
+		}
+		if !fn(&change) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+// RecentlyCreated returns the IDs of up to n nodes most recently created,
+// newest first, read backwards from the creation index without decoding any
+// node record.
+func (s *Store) RecentlyCreated(n int) ([]string, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(createdIndexPrefix)), nil)
+	defer iter.Release()
+	for ok := iter.Last(); ok && len(ids) < n; ok = iter.Prev() {
+		key := iter.Key()
+		if i := bytes.IndexByte(key, 0); i >= 0 {
+			ids = append(ids, string(key[i+1:]))
+		}
+	}
+	return ids, iter.Error()
+}
+
+// Changes returns up to limit changes with seq > since, in seq order.
+func (s *Store) Changes(since int64, limit int) ([]Change, error) {
+	changes := []Change{}
+	err := s.ReplayChanges(since, 0, func(c *Change) bool {
+		changes = append(changes, *c)
+		return limit <= 0 || len(changes) < limit
+	})
+	return changes, err
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+)
+
+// Snapshot is a read-only view of the node records as of a single point in
+// time. Writes committed after it was taken are not visible through it. It
+// pins old data in LevelDB, so Release it as soon as it is no longer needed.
+type Snapshot struct {
+	snap *leveldb.Snapshot
+	seq  int64
+}
+
+// Snapshot flushes buffered writes and takes a snapshot of the store.
+func (s *Store) Snapshot() (*Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(); err != nil {
+		return nil, err
+	}
+	if err := s.injectFault(FaultRead); err != nil {
+		return nil, err
+	}
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{snap: snap, seq: s.seq}, nil
+}
+
+// Seq returns the changefeed seq the snapshot reflects; changes after it
+// can be read with Changes(Seq(), ...).
+func (sn *Snapshot) Seq() int64 {
+	return sn.seq
+}
+
+// Iterator walks the node records in the snapshot in key order.
+func (sn *Snapshot) Iterator() iterator.Iterator {
+	return &nodeIterator{Iterator: sn.snap.NewIterator(nil, nil)}
+}
+
+// GetNode returns the node with the given ID as of the snapshot, or nil if
+// it did not exist.
+func (sn *Snapshot) GetNode(id string) (*Node, error) {
+	if isReservedKey([]byte(id)) {
+		return nil, nil
+	}
+	data, err := sn.snap.Get([]byte(id), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var node Node
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// Release frees the snapshot. It is safe to call more than once.
+func (sn *Snapshot) Release() {
+	sn.snap.Release()
+}
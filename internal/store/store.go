@@ -1,65 +1,918 @@
-package store
-
-import (
-	"encoding/json"
-	"errors"
-	"path/filepath"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/iterator"
-)
-
-type Store struct {
-	db *leveldb.DB
-}
-
-type Node struct {
-	ID               string   `json:"id"`
-	Data             string   `json:"data"`
-	Parents          []string `json:"parents"`
-	Weight           float64  `json:"weight"`
-	CumulativeWeight float64  `json:"cumulative_weight"`
-}
-
-func New(path string) (*Store, error) {
-	db, err := leveldb.OpenFile(filepath.Clean(path), nil)
-	if err != nil {
-		return nil, err
-	}
-	return &Store{db: db}, nil
-}
-
-func (s *Store) Close() error {
-	return s.db.Close()
-}
-
-func (s *Store) AddNode(node *Node) error {
-	data, err := json.Marshal(node)
-	if err != nil {
-		return err
-	}
-	return s.db.Put([]byte(node.ID), data, nil)
-}
-
-func (s *Store) GetNode(id string) (*Node, error) {
-	data, err := s.db.Get([]byte(id), nil)
-	if err != nil {
-		if errors.Is(err, leveldb.ErrNotFound) {
-			return nil, nil
-		}
-		return nil, err
-	}
-	var node Node
-	if err := json.Unmarshal(data, &node); err != nil {
-		return nil, err
-	}
-	return &node, nil
-}
-
-func (s *Store) Iterator() iterator.Iterator {
-	return s.db.NewIterator(nil, nil)
-}
-
-func (s *Store) DeleteNode(id string) error {
-	return s.db.Delete([]byte(id), nil)
-}
\ No newline at end of file
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Secondary indexes live under IndexPrefix and are derived entirely from the
+// node records, so they can always be dropped and rebuilt.
+const (
+	IndexPrefix      = "index:"
+	childIndexPrefix = IndexPrefix + "child:"
+	hashIndexPrefix  = IndexPrefix + "hash:"
+	typeIndexPrefix  = IndexPrefix + "type:"
+	// createdIndexPrefix orders nodes by CreatedAt for RecentlyCreated.
+	createdIndexPrefix = IndexPrefix + "created:"
+
+	idempotencyPrefix = "idempotency:"
+	changePrefix      = "change:"
+	metaPrefix        = "meta:"
+	peerPrefix        = "peer:"
+	tombstonePrefix   = "tombstone:"
+)
+
+// reservedPrefixes are the key spaces that never hold node records.
+var reservedPrefixes = []string{IndexPrefix, idempotencyPrefix, changePrefix, metaPrefix, peerPrefix, tombstonePrefix}
+
+type Store struct {
+	db *leveldb.DB
+
+	// mu serializes node writes so each is assigned the next changefeed seq.
+	mu  sync.Mutex
+	seq int64
+	// changed is closed and replaced each time seq advances.
+	changed chan struct{}
+	// nodes counts the node records on disk, so NodeCount need not scan.
+	nodes int
+
+	buffer  *writeBuffer
+	cache   *nodeCache
+	fault   func(op string) error
+	unclean bool
+}
+
+type Node struct {
+	ID               string    `json:"id"`
+	Data             string    `json:"data"`
+	Parents          []string  `json:"parents"`
+	Weight           float64   `json:"weight"`
+	CumulativeWeight float64   `json:"cumulative_weight"`
+	Type             string    `json:"type,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// Option configures optional Store behaviour in New.
+type Option func(*Store)
+
+func New(path string, opts ...Option) (*Store, error) {
+	db, err := leveldb.OpenFile(filepath.Clean(path), nil)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := loadSeq(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	unclean, err := db.Has(openMarkerKey, nil)
+	if err == nil {
+		err = db.Put(openMarkerKey, nil, nil)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	nodes, err := countNodes(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &Store{db: db, seq: seq, changed: make(chan struct{}), nodes: nodes, unclean: unclean}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.buffer != nil {
+		s.buffer.start(s)
+	}
+	return s, nil
+}
+
+// Close flushes any buffered writes before closing the database.
+func (s *Store) Close() error {
+	if s.buffer != nil {
+		s.buffer.stop()
+		if err := s.Flush(); err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+	if err := s.db.Delete(openMarkerKey, nil); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
+
+// openMarkerKey is present while a Store has the database open, so finding
+// it on open means the previous process did not Close cleanly.
+var openMarkerKey = []byte(metaPrefix + "open")
+
+// UncleanShutdown reports whether the previous process that opened the
+// store exited without closing it.
+func (s *Store) UncleanShutdown() bool {
+	return s.unclean
+}
+
+// Operations passed to a fault injector.
+const (
+	FaultRead  = "read"
+	FaultWrite = "write"
+)
+
+// WithFaultInjector calls fn before every read and write of a node record
+// and before an index rebuild's write, and fails the operation with its
+// error when non-nil. It is meant for chaos and failure testing.
+func WithFaultInjector(fn func(op string) error) Option {
+	return func(s *Store) {
+		s.fault = fn
+	}
+}
+
+func (s *Store) injectFault(op string) error {
+	if s.fault == nil {
+		return nil
+	}
+	return s.fault(op)
+}
+
+var pingKey = []byte(metaPrefix + "ping")
+
+// Ping checks that the database can be read and written.
+func (s *Store) Ping() error {
+	if err := s.injectFault(FaultRead); err != nil {
+		return err
+	}
+	if _, err := s.db.Get(seqKey, nil); err != nil && !errors.Is(err, leveldb.ErrNotFound) {
+		return err
+	}
+	if err := s.injectFault(FaultWrite); err != nil {
+		return err
+	}
+	return s.db.Put(pingKey, []byte(time.Now().UTC().Format(time.RFC3339)), nil)
+}
+
+// AddNode writes node, stamping UpdatedAt with the current time. Every
+// rewrite of a record, including cumulative weight updates, advances it.
+// A zero CreatedAt is taken from the stored record, or is set to the same
+// time for a new node; a CreatedAt already set, as on a node merged from a
+// peer, is kept.
+func (s *Store) AddNode(node *Node) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.stamp(node, time.Now().UTC()); err != nil {
+		return err
+	}
+	if s.buffer != nil {
+		return s.buffer.add(s, node)
+	}
+	return s.putNodes([]*Node{node})
+}
+
+// AddNodes writes nodes in a single batch, stamping each UpdatedAt like
+// AddNode. With a write buffer they are queued together and reach LevelDB
+// in the same flush.
+func (s *Store) AddNodes(nodes []*Node) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	for _, node := range nodes {
+		if err := s.stamp(node, now); err != nil {
+			return err
+		}
+	}
+	if s.buffer != nil {
+		return s.buffer.add(s, nodes...)
+	}
+	return s.putNodes(nodes)
+}
+
+// PutNode writes node as given, keeping its CreatedAt and UpdatedAt, for a
+// replica copying a record from its primary. Indexes, the changefeed and the
+// cache are updated as for AddNode.
+func (s *Store) PutNode(node *Node) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buffer != nil {
+		return s.buffer.add(s, node)
+	}
+	return s.putNodes([]*Node{node})
+}
+
+// stamp sets node's timestamps for a write at now. s.mu must be held.
+func (s *Store) stamp(node *Node, now time.Time) error {
+	node.UpdatedAt = now
+	if !node.CreatedAt.IsZero() {
+		return nil
+	}
+	node.CreatedAt = now
+	old, ok := (*Node)(nil), false
+	if s.buffer != nil {
+		old, ok = s.buffer.pending[node.ID]
+	}
+	if !ok {
+		var err error
+		if old, err = s.diskNode(node.ID); err != nil {
+			return err
+		}
+	}
+	if old != nil && !old.CreatedAt.IsZero() {
+		node.CreatedAt = old.CreatedAt
+	}
+	return nil
+}
+
+// putNodes writes nodes, their child index entries and one changefeed entry
+// per node in a single batch. s.mu must be held.
+func (s *Store) putNodes(nodes []*Node) error {
+	if err := s.injectFault(FaultWrite); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	seq := s.seq
+	created := map[string]bool{}
+	for _, node := range nodes {
+		seq++
+		isNew, err := s.stagePut(batch, seq, node)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			created[node.ID] = true
+		}
+	}
+	err := s.commitChanges(batch, seq)
+	if err == nil {
+		s.nodes += len(created)
+	}
+	if s.cache != nil {
+		ids := make([]string, len(nodes))
+		for i, node := range nodes {
+			ids[i] = node.ID
+		}
+		s.cache.invalidate(ids...)
+	}
+	return err
+}
+
+// stagePut adds node, its index entries and its changefeed entry at seq to
+// batch. It reports whether node is not yet on disk. s.mu must be held.
+func (s *Store) stagePut(batch *leveldb.Batch, seq int64, node *Node) (bool, error) {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return false, err
+	}
+	old, err := s.diskNode(node.ID)
+	if err != nil {
+		return false, err
+	}
+
+	if old != nil {
+		for _, p := range old.Parents {
+			batch.Delete(childKey(p, node.ID))
+		}
+		batch.Delete(hashKey(ContentHash(old), node.ID))
+		if old.Type != "" {
+			batch.Delete(typeKey(old.Type, node.ID))
+		}
+		if !old.CreatedAt.IsZero() {
+			batch.Delete(createdKey(old))
+		}
+	} else {
+		// Re-adding a deleted node supersedes its tombstone.
+		batch.Delete(tombstoneKey(node.ID))
+	}
+	batch.Put([]byte(node.ID), data)
+	for _, p := range node.Parents {
+		batch.Put(childKey(p, node.ID), nil)
+	}
+	batch.Put(hashKey(ContentHash(node), node.ID), nil)
+	if node.Type != "" {
+		batch.Put(typeKey(node.Type, node.ID), nil)
+	}
+	if !node.CreatedAt.IsZero() {
+		batch.Put(createdKey(node), nil)
+	}
+	return old == nil, stageChange(batch, seq, ChangePut, node.ID, old, node)
+}
+
+// GetNode returns the node with the given ID, or nil if it does not exist.
+// Buffered writes are visible before they are flushed.
+func (s *Store) GetNode(id string) (*Node, error) {
+	if s.buffer != nil {
+		s.mu.Lock()
+		node, ok := s.buffer.pending[id]
+		s.mu.Unlock()
+		if ok {
+			return cloneNode(node), nil
+		}
+	}
+	return s.diskNode(id)
+}
+
+// Has reports whether a node with the given ID exists without reading or
+// decoding its record.
+func (s *Store) Has(id string) (bool, error) {
+	if isReservedKey([]byte(id)) {
+		return false, nil
+	}
+	if s.buffer != nil {
+		s.mu.Lock()
+		_, ok := s.buffer.pending[id]
+		s.mu.Unlock()
+		if ok {
+			return true, nil
+		}
+	}
+	if err := s.injectFault(FaultRead); err != nil {
+		return false, err
+	}
+	return s.db.Has([]byte(id), nil)
+}
+
+func (s *Store) diskNode(id string) (*Node, error) {
+	var epoch uint64
+	if s.cache != nil {
+		var cached *Node
+		if cached, epoch = s.cache.get(id); cached != nil {
+			return cached, nil
+		}
+	}
+	if err := s.injectFault(FaultRead); err != nil {
+		return nil, err
+	}
+	data, err := s.db.Get([]byte(id), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var node Node
+	if err := json.Unmarshal(data, &node); err != nil {
+		return nil, err
+	}
+	if s.cache != nil {
+		s.cache.add(&node, epoch)
+	}
+	return &node, nil
+}
+
+// NodeCount returns the number of nodes stored, buffered writes included,
+// without scanning the records.
+func (s *Store) NodeCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.nodes
+	if s.buffer != nil {
+		n += len(s.buffer.created)
+	}
+	return n
+}
+
+// countNodes counts the node records in db, reading keys only.
+func countNodes(db *leveldb.DB) (int, error) {
+	iter := &nodeIterator{Iterator: db.NewIterator(nil, nil)}
+	defer iter.Release()
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	return n, iter.Error()
+}
+
+// Iterator walks the node records in key order, skipping index entries.
+// Buffered writes are included.
+func (s *Store) Iterator() iterator.Iterator {
+	return s.iterate(nil)
+}
+
+// IteratorFrom walks the node records with keys strictly greater than after.
+func (s *Store) IteratorFrom(after string) iterator.Iterator {
+	start := append([]byte(after), 0)
+	return s.iterate(&util.Range{Start: start})
+}
+
+// IteratorPrefix walks the node records whose keys start with prefix and are
+// strictly greater than after. Either may be empty.
+func (s *Store) IteratorPrefix(prefix, after string) iterator.Iterator {
+	r := util.BytesPrefix([]byte(prefix))
+	if after != "" {
+		if start := append([]byte(after), 0); bytes.Compare(start, r.Start) > 0 {
+			r.Start = start
+		}
+	}
+	return s.iterate(r)
+}
+
+// iterate walks the node records in r with the buffered writes laid over
+// them. The buffer is copied and the LevelDB iterator opened under s.mu, so
+// a flush cannot run between the two.
+func (s *Store) iterate(r *util.Range) iterator.Iterator {
+	if s.buffer == nil {
+		return &nodeIterator{Iterator: s.db.NewIterator(r, nil)}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued, err := s.buffer.entries(r)
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	hidden := make(map[string]bool, len(s.buffer.pending))
+	for id := range s.buffer.pending {
+		hidden[id] = true
+	}
+	return &mergedIterator{disk: s.db.NewIterator(r, nil), hidden: hidden, queued: queued}
+}
+
+func (s *Store) DeleteNode(id string) error {
+	return s.deleteNode(id, nil)
+}
+
+// deleteNode removes id and, when ts is non-nil, records ts in the same
+// batch.
+func (s *Store) deleteNode(id string, ts *Tombstone) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	existed, staged, err := s.stageDelete(batch, s.seq+1, id, ts)
+	if err != nil {
+		return err
+	}
+	if err := s.injectFault(FaultWrite); err != nil {
+		return err
+	}
+	if !staged {
+		// Nothing was deleted, so there is no change to record.
+		return s.db.Write(batch, nil)
+	}
+	err = s.commitChanges(batch, s.seq+1)
+	if err == nil && existed {
+		s.nodes--
+	}
+	if s.cache != nil {
+		s.cache.invalidate(id)
+	}
+	return err
+}
+
+// stageDelete adds the removal of id and its index entries to batch, with
+// ts when non-nil. It reports whether id is stored and whether it staged a
+// changefeed entry at seq, which it does unless a tombstone is left for a
+// node that is not stored. s.mu must be held and the write buffer flushed.
+func (s *Store) stageDelete(batch *leveldb.Batch, seq int64, id string, ts *Tombstone) (bool, bool, error) {
+	old, err := s.diskNode(id)
+	if err != nil {
+		return false, false, err
+	}
+
+	batch.Delete([]byte(id))
+	if old != nil {
+		for _, p := range old.Parents {
+			batch.Delete(childKey(p, id))
+		}
+		batch.Delete(hashKey(ContentHash(old), id))
+		if old.Type != "" {
+			batch.Delete(typeKey(old.Type, id))
+		}
+		if !old.CreatedAt.IsZero() {
+			batch.Delete(createdKey(old))
+		}
+	}
+	if ts != nil {
+		data, err := json.Marshal(ts)
+		if err != nil {
+			return false, false, err
+		}
+		batch.Put(tombstoneKey(id), data)
+	}
+	if old == nil && ts != nil {
+		return false, false, nil
+	}
+	return old != nil, true, stageChange(batch, seq, ChangeDelete, id, old, nil)
+}
+
+// NodesByHash returns the IDs of the nodes whose ContentHash is hash, in ID
+// order.
+func (s *Store) NodesByHash(hash string) ([]string, error) {
+	return s.indexedIDs(hashKey(hash, ""), 0, func(b *writeBuffer) []string {
+		return b.matching(func(n *Node) bool { return ContentHash(n) == hash })
+	})
+}
+
+// NodesByType returns the IDs of the nodes of type typ in ID order.
+func (s *Store) NodesByType(typ string) ([]string, error) {
+	return s.indexedIDs(typeKey(typ, ""), 0, func(b *writeBuffer) []string {
+		return b.matching(func(n *Node) bool { return n.Type == typ })
+	})
+}
+
+// GetChildren returns the IDs of the nodes listing parentID as a parent, in
+// ID order.
+func (s *Store) GetChildren(parentID string) ([]string, error) {
+	return s.indexedIDs(childKey(parentID, ""), 0, func(b *writeBuffer) []string {
+		return b.childrenOf(parentID)
+	})
+}
+
+// HasChildren reports whether any node lists parentID as a parent. It reads
+// at most one index entry that is not superseded by a buffered write.
+func (s *Store) HasChildren(parentID string) (bool, error) {
+	ids, err := s.indexedIDs(childKey(parentID, ""), 1, func(b *writeBuffer) []string {
+		return b.childrenOf(parentID)
+	})
+	return len(ids) > 0, err
+}
+
+// indexedIDs returns up to limit IDs, or all of them when limit is 0, from
+// the index entries under prefix. A buffered node replaces its entries on
+// disk, and queued returns the buffered IDs that belong under prefix. With a
+// buffer the read holds s.mu, so no flush moves nodes out of the buffer
+// part way through it.
+func (s *Store) indexedIDs(prefix []byte, limit int, queued func(b *writeBuffer) []string) ([]string, error) {
+	var buffered []string
+	if s.buffer != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		buffered = queued(s.buffer)
+		if limit > 0 && len(buffered) >= limit {
+			return buffered[:limit], nil
+		}
+	}
+	iter := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	ids := []string{}
+	for (limit == 0 || len(ids)+len(buffered) < limit) && iter.Next() {
+		id := string(iter.Key()[len(prefix):])
+		if s.buffer != nil {
+			if _, ok := s.buffer.pending[id]; ok {
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if len(buffered) > 0 {
+		ids = append(ids, buffered...)
+		sort.Strings(ids)
+	}
+	return ids, nil
+}
+
+// RebuildIndexes drops every index entry and recomputes them from the node
+// records. The drop and rebuild are committed as one batch, so readers see
+// either the old or the new index, never a partial one. The count returned is
+// the number of parent-child edges indexed.
+func (s *Store) RebuildIndexes() (int, error) {
+	return s.RebuildIndexesWithProgress(nil)
+}
+
+// indexBuildProgressEvery is how many nodes RebuildIndexesWithProgress
+// indexes between progress callbacks.
+const indexBuildProgressEvery = 10000
+
+// RebuildIndexesWithProgress is RebuildIndexes, calling progress with the
+// number of nodes indexed so far every indexBuildProgressEvery nodes.
+func (s *Store) RebuildIndexesWithProgress(progress func(nodes int)) (int, error) {
+	if err := s.Flush(); err != nil {
+		return 0, err
+	}
+	batch := new(leveldb.Batch)
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(IndexPrefix)), nil)
+	for iter.Next() {
+		batch.Delete(append([]byte{}, iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+
+	entries, count := 0, 0
+	nodes := s.Iterator()
+	for nodes.Next() {
+		var node Node
+		if err := json.Unmarshal(nodes.Value(), &node); err != nil {
+			continue
+		}
+		for _, p := range node.Parents {
+			batch.Put(childKey(p, node.ID), nil)
+			entries++
+		}
+		batch.Put(hashKey(ContentHash(&node), node.ID), nil)
+		if node.Type != "" {
+			batch.Put(typeKey(node.Type, node.ID), nil)
+		}
+		if !node.CreatedAt.IsZero() {
+			batch.Put(createdKey(&node), nil)
+		}
+		count++
+		if progress != nil && count%indexBuildProgressEvery == 0 {
+			progress(count)
+		}
+	}
+	nodes.Release()
+	if err := nodes.Error(); err != nil {
+		return 0, err
+	}
+	batch.Put(indexVersionKey, []byte{indexVersion})
+
+	if err := s.injectFault(FaultWrite); err != nil {
+		return 0, err
+	}
+	return entries, s.db.Write(batch, nil)
+}
+
+// indexVersion is bumped whenever the index layout changes, so stores written
+// by an older build are re-indexed on startup.
+const indexVersion = 4
+
+var indexVersionKey = []byte(metaPrefix + "index_version")
+
+// IndexesCurrent reports whether the indexes were last rebuilt with the
+// current layout. A store that has never been rebuilt reports false.
+func (s *Store) IndexesCurrent() (bool, error) {
+	v, err := s.db.Get(indexVersionKey, nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(v) == 1 && v[0] == indexVersion, nil
+}
+
+// IdempotencyRecord is the response saved for an Idempotency-Key so a retry
+// can be answered without re-processing the request.
+type IdempotencyRecord struct {
+	RequestHash string    `json:"request_hash"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// GetIdempotencyRecord returns the record saved for key, or nil if there is
+// none or it has expired. Expired records are deleted on read.
+func (s *Store) GetIdempotencyRecord(key string) (*IdempotencyRecord, error) {
+	data, err := s.db.Get([]byte(idempotencyPrefix+key), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rec IdempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	if time.Now().After(rec.ExpiresAt) {
+		return nil, s.db.Delete([]byte(idempotencyPrefix+key), nil)
+	}
+	return &rec, nil
+}
+
+func (s *Store) PutIdempotencyRecord(key string, rec *IdempotencyRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(idempotencyPrefix+key), data, nil)
+}
+
+// PurgeIdempotencyRecords deletes every record that expired before now and
+// returns how many were removed.
+func (s *Store) PurgeIdempotencyRecords(now time.Time) (int, error) {
+	batch := new(leveldb.Batch)
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(idempotencyPrefix)), nil)
+	for iter.Next() {
+		var rec IdempotencyRecord
+		if err := json.Unmarshal(iter.Value(), &rec); err != nil || now.After(rec.ExpiresAt) {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	return batch.Len(), s.db.Write(batch, nil)
+}
+
+// PutPeerState saves the opaque sync state of a peer. Buffered writes are
+// flushed first so the state never runs ahead of the nodes it describes.
+func (s *Store) PutPeerState(addr string, state []byte) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.db.Put([]byte(peerPrefix+addr), state, nil)
+}
+
+// PeerStates returns every saved peer state keyed by peer address.
+func (s *Store) PeerStates() (map[string][]byte, error) {
+	states := map[string][]byte{}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(peerPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		addr := strings.TrimPrefix(string(iter.Key()), peerPrefix)
+		states[addr] = append([]byte{}, iter.Value()...)
+	}
+	return states, iter.Error()
+}
+
+// deferredWeightPrefix marks nodes whose weight has not yet been added to
+// their ancestors.
+const deferredWeightPrefix = metaPrefix + "deferred_weight:"
+
+// ClearWeightDeferred removes the deferred marks of ids.
+func (s *Store) ClearWeightDeferred(ids ...string) error {
+	batch := new(leveldb.Batch)
+	for _, id := range ids {
+		batch.Delete([]byte(deferredWeightPrefix + id))
+	}
+	return s.db.Write(batch, nil)
+}
+
+// IsWeightDeferred reports whether id carries a deferred mark.
+func (s *Store) IsWeightDeferred(id string) (bool, error) {
+	return s.db.Has([]byte(deferredWeightPrefix+id), nil)
+}
+
+// DeferredWeights returns the IDs of every node with a deferred mark.
+func (s *Store) DeferredWeights() ([]string, error) {
+	ids := []string{}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(deferredWeightPrefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		ids = append(ids, strings.TrimPrefix(string(iter.Key()), deferredWeightPrefix))
+	}
+	return ids, iter.Error()
+}
+
+// childKey separates parent and child with a NUL byte so that IDs containing
+// ':' cannot make one parent's prefix match another's.
+func childKey(parentID, childID string) []byte {
+	return []byte(childIndexPrefix + parentID + "\x00" + childID)
+}
+
+func hashKey(hash, id string) []byte {
+	return []byte(hashIndexPrefix + hash + "\x00" + id)
+}
+
+func typeKey(typ, id string) []byte {
+	return []byte(typeIndexPrefix + typ + "\x00" + id)
+}
+
+// createdKey sorts by creation time, with the ID breaking ties. CreatedAt is
+// written as fixed-width nanoseconds so the keys order as the times do.
+func createdKey(node *Node) []byte {
+	return []byte(fmt.Sprintf("%s%020d\x00%s", createdIndexPrefix, node.CreatedAt.UnixNano(), node.ID))
+}
+
+func isReservedKey(key []byte) bool {
+	return ReservedPrefix(string(key)) != ""
+}
+
+// ReservedPrefix returns the reserved key prefix id starts with, or "" if
+// id can be a node key.
+func ReservedPrefix(id string) string {
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+type nodeIterator struct {
+	iterator.Iterator
+}
+
+func (it *nodeIterator) Next() bool {
+	for it.Iterator.Next() {
+		if !isReservedKey(it.Key()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compact flushes buffered writes and compacts the whole keyspace, reclaiming
+// space left by deletes and overwrites.
+func (s *Store) Compact() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.db.CompactRange(util.Range{})
+}
+
+// ApproximateSize returns LevelDB's estimate of the on-disk bytes used by
+// every key. Data still in the memtable is not included.
+func (s *Store) ApproximateSize() (int64, error) {
+	sizes, err := s.db.SizeOf([]util.Range{{Start: nil, Limit: []byte{0xff, 0xff, 0xff, 0xff}}})
+	if err != nil {
+		return 0, err
+	}
+	return sizes.Sum(), nil
+}
+
+// LevelStats describes the SST files in one LevelDB level.
+type LevelStats struct {
+	Level int   `json:"level"`
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// StorageStats is an on-disk size report built from LevelDB's table
+// metadata, without reading any values.
+type StorageStats struct {
+	ApproxBytes int64        `json:"approx_bytes"`
+	Levels      []LevelStats `json:"levels"`
+	// Fragmentation is the fraction of table bytes above the deepest
+	// non-empty level. Those tables may hold overwritten or deleted versions
+	// that only compaction reclaims, so it estimates reclaimable space; it
+	// is 0 right after a full compaction.
+	Fragmentation float64 `json:"fragmentation"`
+}
+
+// StorageStats reports the approximate store size and the SST files per
+// level. Empty levels are omitted.
+func (s *Store) StorageStats() (*StorageStats, error) {
+	size, err := s.ApproximateSize()
+	if err != nil {
+		return nil, err
+	}
+	tables, err := s.db.GetProperty("leveldb.sstables")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &StorageStats{ApproxBytes: size, Levels: []LevelStats{}}
+	var current *LevelStats
+	for _, line := range strings.Split(tables, "\n") {
+		var level int
+		var num, tableBytes int64
+		if n, _ := fmt.Sscanf(line, "--- level %d ---", &level); n == 1 {
+			stats.Levels = append(stats.Levels, LevelStats{Level: level})
+			current = &stats.Levels[len(stats.Levels)-1]
+			continue
+		}
+		if n, _ := fmt.Sscanf(line, "%d:%d[", &num, &tableBytes); n == 2 && current != nil {
+			current.Files++
+			current.Bytes += tableBytes
+		}
+	}
+
+	nonEmpty := stats.Levels[:0]
+	var total int64
+	for _, l := range stats.Levels {
+		if l.Files > 0 {
+			nonEmpty = append(nonEmpty, l)
+			total += l.Bytes
+		}
+	}
+	stats.Levels = nonEmpty
+	if total > 0 {
+		deepest := stats.Levels[len(stats.Levels)-1].Bytes
+		stats.Fragmentation = float64(total-deepest) / float64(total)
+	}
+	return stats, nil
+}
+
+// ContentHash is the hex SHA-256 of a node's data, parents and weight, with
+// the weight rounded as it is stored.
+func ContentHash(node *Node) string {
+	parents := node.Parents
+	if parents == nil {
+		parents = []string{}
+	}
+	data, _ := json.Marshal(struct {
+		Data    string   `json:"data"`
+		Parents []string `json:"parents"`
+		Weight  float64  `json:"weight"`
+	}{node.Data, parents, RoundWeight(node.Weight)})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
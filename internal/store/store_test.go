@@ -0,0 +1,899 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestStore(t testing.TB, opts ...Option) *Store {
+	tmpDir, err := os.MkdirTemp("", "leveldb-store-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	st, err := New(tmpDir, opts...)
+	if err != nil {
+		t.Fatalf("Failed to initialize store: %v", err)
+	}
+	t.Cleanup(func() {
+		st.Close()
+		os.RemoveAll(tmpDir)
+	})
+	return st
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	st := newTestStore(t)
+
+	nodes := []Node{
+		{ID: "a", Parents: []string{}},
+		{ID: "b", Parents: []string{"a"}},
+		{ID: "c", Parents: []string{"a"}},
+	}
+	for _, n := range nodes {
+		if err := st.AddNode(&n); err != nil {
+			t.Fatalf("Failed to add node %s: %v", n.ID, err)
+		}
+	}
+
+	// Drift the index: drop a real entry and add a stale one.
+	if err := st.db.Delete(childKey("a", "b"), nil); err != nil {
+		t.Fatalf("Failed to delete index entry: %v", err)
+	}
+	if err := st.db.Put(childKey("a", "ghost"), nil, nil); err != nil {
+		t.Fatalf("Failed to write index entry: %v", err)
+	}
+
+	entries, err := st.RebuildIndexes()
+	if err != nil {
+		t.Fatalf("Failed to rebuild indexes: %v", err)
+	}
+	if entries != 2 {
+		t.Errorf("Expected 2 index entries, got %d", entries)
+	}
+
+	children, err := st.GetChildren("a")
+	if err != nil {
+		t.Fatalf("Failed to get children: %v", err)
+	}
+	if len(children) != 2 || children[0] != "b" || children[1] != "c" {
+		t.Errorf("Expected children [b c], got %v", children)
+	}
+}
+
+func TestChildIndexFollowsOverwrites(t *testing.T) {
+	st := newTestStore(t)
+
+	st.AddNode(&Node{ID: "a", Parents: []string{}})
+	st.AddNode(&Node{ID: "b", Parents: []string{}})
+	st.AddNode(&Node{ID: "c", Parents: []string{"a"}, Weight: 1.0})
+
+	// A weight update rewrites c without touching its parents.
+	if err := st.AddNode(&Node{ID: "c", Parents: []string{"a"}, Weight: 1.0, CumulativeWeight: 2.0}); err != nil {
+		t.Fatalf("Failed to rewrite node: %v", err)
+	}
+	if children, _ := st.GetChildren("a"); len(children) != 1 || children[0] != "c" {
+		t.Errorf("Expected children of a [c] after weight update, got %v", children)
+	}
+
+	st.AddNode(&Node{ID: "c", Parents: []string{"b"}, Weight: 1.0})
+	if children, _ := st.GetChildren("a"); len(children) != 0 {
+		t.Errorf("Expected no children of a after reparenting, got %v", children)
+	}
+	if children, _ := st.GetChildren("b"); len(children) != 1 || children[0] != "c" {
+		t.Errorf("Expected children of b [c] after reparenting, got %v", children)
+	}
+
+	st.DeleteNode("c")
+	if children, _ := st.GetChildren("b"); len(children) != 0 {
+		t.Errorf("Expected no children of b after delete, got %v", children)
+	}
+}
+
+func TestIteratorSkipsIndexEntries(t *testing.T) {
+	st := newTestStore(t)
+
+	st.AddNode(&Node{ID: "a", Parents: []string{}})
+	st.AddNode(&Node{ID: "b", Parents: []string{"a"}})
+
+	iter := st.Iterator()
+	defer iter.Release()
+	count := 0
+	for iter.Next() {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 node records, got %d", count)
+	}
+}
+
+func TestPutNodeKeepsTimestamps(t *testing.T) {
+	st := newTestStore(t, WithNodeCache(10))
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	updated := created.Add(time.Hour)
+
+	st.AddNode(&Node{ID: "p", Parents: []string{}})
+	st.GetNode("c")
+	if err := st.PutNode(&Node{ID: "c", Parents: []string{"p"}, CreatedAt: created, UpdatedAt: updated}); err != nil {
+		t.Fatalf("PutNode failed: %v", err)
+	}
+	c, err := st.GetNode("c")
+	if err != nil || !c.CreatedAt.Equal(created) || !c.UpdatedAt.Equal(updated) {
+		t.Errorf("Expected timestamps %v and %v kept, got %+v, err: %v", created, updated, c, err)
+	}
+	if children, _ := st.GetChildren("p"); len(children) != 1 || children[0] != "c" {
+		t.Errorf("Expected children of p [c], got %v", children)
+	}
+	if st.LastSeq() != 2 {
+		t.Errorf("Expected PutNode to record a change, got seq %d", st.LastSeq())
+	}
+}
+
+func TestApply(t *testing.T) {
+	var failWrites atomic.Bool
+	st := newTestStore(t, WithFaultInjector(func(op string) error {
+		if op == FaultWrite && failWrites.Load() {
+			return errors.New("input/output error")
+		}
+		return nil
+	}))
+	st.AddNode(&Node{ID: "p", Parents: []string{}})
+	st.AddNode(&Node{ID: "old", Parents: []string{"p"}})
+
+	failWrites.Store(true)
+	if err := st.Apply(&Update{Nodes: []*Node{{ID: "c", Parents: []string{"p"}}}, DeferWeights: []string{"c"}}); err == nil {
+		t.Fatal("Expected the update to fail")
+	}
+	if c, _ := st.GetNode("c"); c != nil {
+		t.Errorf("Expected no node after a failed update, got %+v", c)
+	}
+	if ids, _ := st.DeferredWeights(); len(ids) != 0 {
+		t.Errorf("Expected no mark after a failed update, got %v", ids)
+	}
+
+	failWrites.Store(false)
+	err := st.Apply(&Update{
+		Nodes:        []*Node{{ID: "c", Parents: []string{"p"}}},
+		Delete:       "old",
+		Tombstone:    &Tombstone{ID: "old", DeletedAt: time.Now()},
+		DeferWeights: []string{"c"},
+	})
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if c, _ := st.GetNode("c"); c == nil || c.UpdatedAt.IsZero() {
+		t.Errorf("Expected c stored and stamped, got %+v", c)
+	}
+	if old, _ := st.GetNode("old"); old != nil {
+		t.Errorf("Expected old deleted, got %+v", old)
+	}
+	if ts, _ := st.GetTombstone("old"); ts == nil {
+		t.Errorf("Expected a tombstone for old")
+	}
+	if ids, _ := st.DeferredWeights(); len(ids) != 1 || ids[0] != "c" {
+		t.Errorf("Expected c marked deferred, got %v", ids)
+	}
+	if children, _ := st.GetChildren("p"); len(children) != 1 || children[0] != "c" {
+		t.Errorf("Expected children of p [c], got %v", children)
+	}
+	if seq := st.LastSeq(); seq != 4 {
+		t.Errorf("Expected a change each for c and old, got seq %d", seq)
+	}
+
+	if err := st.Apply(&Update{ClearDeferred: []string{"c"}}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if ids, _ := st.DeferredWeights(); len(ids) != 0 || st.LastSeq() != 4 {
+		t.Errorf("Expected the mark cleared without a change, got %v at seq %d", ids, st.LastSeq())
+	}
+}
+
+func TestChangefeed(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "leveldb-store-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	st, err := New(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to initialize store: %v", err)
+	}
+	st.AddNode(&Node{ID: "a", Parents: []string{}, Weight: 1})
+	st.AddNode(&Node{ID: "a", Parents: []string{}, Weight: 2})
+	st.DeleteNode("a")
+	st.Close()
+
+	st, err = New(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer st.Close()
+	if st.LastSeq() != 3 {
+		t.Fatalf("Expected seq 3 after reopen, got %d", st.LastSeq())
+	}
+
+	var changes []Change
+	st.ReplayChanges(0, 0, func(c *Change) bool {
+		changes = append(changes, *c)
+		return true
+	})
+	if len(changes) != 3 {
+		t.Fatalf("Expected 3 changes, got %d", len(changes))
+	}
+	if changes[0].Before != nil || changes[0].After.Weight != 1 {
+		t.Errorf("Unexpected create change: %+v", changes[0])
+	}
+	if changes[1].Before.Weight != 1 || changes[1].After.Weight != 2 {
+		t.Errorf("Unexpected update change: %+v", changes[1])
+	}
+	if changes[2].Op != ChangeDelete || changes[2].Before.Weight != 2 || changes[2].After != nil {
+		t.Errorf("Unexpected delete change: %+v", changes[2])
+	}
+
+	iter := st.Iterator()
+	defer iter.Release()
+	if iter.Next() {
+		t.Errorf("Expected changefeed entries to be hidden from the node iterator, got %s", iter.Key())
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "leveldb-store-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	st, err := New(tmpDir, WithWriteBuffer(3, time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to initialize store: %v", err)
+	}
+
+	st.AddNode(&Node{ID: "a", Parents: []string{}})
+	st.AddNode(&Node{ID: "b", Parents: []string{"a"}})
+
+	if n, _ := st.diskNode("b"); n != nil {
+		t.Fatalf("Expected b to still be buffered")
+	}
+	if n, err := st.GetNode("b"); err != nil || n == nil || n.Parents[0] != "a" {
+		t.Fatalf("Expected buffered b to be readable, got %+v, err: %v", n, err)
+	}
+	children, _ := st.GetChildren("a")
+	if len(children) != 1 || children[0] != "b" {
+		t.Errorf("Expected the child index to see buffered b, got %v", children)
+	}
+	if n, _ := st.diskNode("b"); n != nil {
+		t.Errorf("Expected reading children not to flush the buffer")
+	}
+
+	st.AddNode(&Node{ID: "c", Parents: []string{"b"}})
+	st.AddNode(&Node{ID: "d", Parents: []string{"c"}})
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	st, err = New(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer st.Close()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if n, _ := st.GetNode(id); n == nil {
+			t.Errorf("Expected %s to be flushed on close", id)
+		}
+	}
+	if st.LastSeq() != 4 {
+		t.Errorf("Expected seq 4, got %d", st.LastSeq())
+	}
+}
+
+func TestWriteBufferFailedFlush(t *testing.T) {
+	var failing atomic.Bool
+	st := newTestStore(t, WithWriteBuffer(2, time.Hour), WithFaultInjector(func(op string) error {
+		if op == FaultWrite && failing.Load() {
+			return errors.New("disk full")
+		}
+		return nil
+	}))
+
+	if err := st.AddNode(&Node{ID: "a", Parents: []string{}}); err != nil {
+		t.Fatalf("Failed to buffer a: %v", err)
+	}
+	failing.Store(true)
+	if err := st.AddNode(&Node{ID: "b", Parents: []string{"a"}}); err == nil {
+		t.Fatalf("Expected the flush triggered by b to fail")
+	}
+	if n, _ := st.GetNode("b"); n != nil {
+		t.Errorf("Expected failed b to be dropped from the buffer")
+	}
+	if has, _ := st.HasChildren("a"); has {
+		t.Errorf("Expected failed b to be dropped from the buffer's child index")
+	}
+
+	failing.Store(false)
+	if err := st.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if n, _ := st.diskNode("a"); n == nil {
+		t.Errorf("Expected a to be written by the next flush")
+	}
+	if n, _ := st.diskNode("b"); n != nil {
+		t.Errorf("Expected b, reported as failed, not to be written")
+	}
+}
+
+func TestWriteBufferAddNodes(t *testing.T) {
+	var failing atomic.Bool
+	st := newTestStore(t, WithWriteBuffer(3, time.Hour), WithFaultInjector(func(op string) error {
+		if op == FaultWrite && failing.Load() {
+			return errors.New("disk full")
+		}
+		return nil
+	}))
+	st.AddNode(&Node{ID: "g", Parents: []string{}})
+
+	failing.Store(true)
+	if err := st.AddNodes([]*Node{{ID: "x", Parents: []string{"g"}}, {ID: "y", Parents: []string{"x"}}, {ID: "z", Parents: []string{"y"}}}); err == nil {
+		t.Fatalf("Expected the batch's flush to fail")
+	}
+	for _, id := range []string{"x", "y", "z"} {
+		if n, _ := st.GetNode(id); n != nil {
+			t.Errorf("Expected %s from the failed batch to be dropped", id)
+		}
+	}
+	failing.Store(false)
+
+	batch := []*Node{
+		{ID: "a", Parents: []string{"g"}},
+		{ID: "b", Parents: []string{"a"}},
+		{ID: "c", Parents: []string{"b"}},
+		{ID: "d", Parents: []string{"c"}},
+	}
+	if err := st.AddNodes(batch); err != nil {
+		t.Fatalf("AddNodes failed: %v", err)
+	}
+	for _, n := range batch {
+		if disk, _ := st.diskNode(n.ID); disk == nil {
+			t.Errorf("Expected %s written with the rest of the batch", n.ID)
+		}
+	}
+	if st.LastSeq() != 5 {
+		t.Errorf("Expected g and the batch in one flush at seq 5, got %d", st.LastSeq())
+	}
+}
+
+func TestWriteBufferReads(t *testing.T) {
+	st := newTestStore(t, WithWriteBuffer(100, time.Hour))
+	for _, n := range []*Node{
+		{ID: "a", Parents: []string{}},
+		{ID: "c", Parents: []string{"a"}, Type: "old"},
+		{ID: "e", Parents: []string{"a"}},
+	} {
+		if err := st.AddNode(n); err != nil {
+			t.Fatalf("Failed to add %s: %v", n.ID, err)
+		}
+	}
+	if err := st.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// b and d are new; c moves from a to b and changes type.
+	for _, n := range []*Node{
+		{ID: "b", Parents: []string{"a"}, Data: "x"},
+		{ID: "c", Parents: []string{"b"}, Type: "new"},
+		{ID: "d", Parents: []string{"b"}, Type: "new"},
+	} {
+		if err := st.AddNode(n); err != nil {
+			t.Fatalf("Failed to buffer %s: %v", n.ID, err)
+		}
+	}
+	seq := st.LastSeq()
+
+	if children, _ := st.GetChildren("a"); !reflect.DeepEqual(children, []string{"b", "e"}) {
+		t.Errorf("Expected a's children [b e], got %v", children)
+	}
+	if children, _ := st.GetChildren("b"); !reflect.DeepEqual(children, []string{"c", "d"}) {
+		t.Errorf("Expected b's children [c d], got %v", children)
+	}
+	if has, _ := st.HasChildren("c"); has {
+		t.Errorf("Expected c to have no children")
+	}
+	if has, _ := st.HasChildren("b"); !has {
+		t.Errorf("Expected b to have buffered children")
+	}
+	if ids, _ := st.NodesByType("old"); len(ids) != 0 {
+		t.Errorf("Expected c's old type to be superseded, got %v", ids)
+	}
+	if ids, _ := st.NodesByType("new"); !reflect.DeepEqual(ids, []string{"c", "d"}) {
+		t.Errorf("Expected type new on [c d], got %v", ids)
+	}
+	if ids, _ := st.NodesByHash(ContentHash(&Node{Data: "x", Parents: []string{"a"}})); !reflect.DeepEqual(ids, []string{"b"}) {
+		t.Errorf("Expected buffered b by hash, got %v", ids)
+	}
+
+	iter := st.Iterator()
+	var forward []string
+	for iter.Next() {
+		var n Node
+		if err := json.Unmarshal(iter.Value(), &n); err != nil {
+			t.Fatalf("Failed to decode %s: %v", iter.Key(), err)
+		}
+		forward = append(forward, n.ID+":"+n.Type)
+	}
+	if want := []string{"a:", "b:", "c:new", "d:new", "e:"}; !reflect.DeepEqual(forward, want) {
+		t.Errorf("Expected merged scan %v, got %v", want, forward)
+	}
+	var backward []string
+	for ok := iter.Seek([]byte("c")); ok; ok = iter.Prev() {
+		backward = append(backward, string(iter.Key()))
+	}
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(backward, want) {
+		t.Errorf("Expected %v walking back from c, got %v", want, backward)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		t.Errorf("Iterator failed: %v", err)
+	}
+
+	if st.LastSeq() != seq {
+		t.Errorf("Expected reads not to flush the buffer")
+	}
+}
+
+func TestNodesByHash(t *testing.T) {
+	st := newTestStore(t)
+
+	a := &Node{ID: "a", Data: "x", Parents: []string{}}
+	st.AddNode(a)
+	st.AddNode(&Node{ID: "b", Data: "x", Parents: []string{}})
+	hash := ContentHash(a)
+
+	if ids, err := st.NodesByHash(hash); err != nil || len(ids) != 2 {
+		t.Fatalf("Expected a and b, got %v, err: %v", ids, err)
+	}
+
+	// Changing content moves the node to its new hash.
+	st.AddNode(&Node{ID: "b", Data: "y", Parents: []string{}})
+	if ids, _ := st.NodesByHash(hash); len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("Expected only a under the old hash, got %v", ids)
+	}
+
+	st.DeleteNode("a")
+	if _, err := st.RebuildIndexes(); err != nil {
+		t.Fatalf("Failed to rebuild indexes: %v", err)
+	}
+	if ids, _ := st.NodesByHash(ContentHash(&Node{Data: "y", Parents: []string{}})); len(ids) != 1 || ids[0] != "b" {
+		t.Errorf("Expected rebuilt hash index for b, got %v", ids)
+	}
+}
+
+func TestHasChildren(t *testing.T) {
+	st := newTestStore(t)
+
+	st.AddNode(&Node{ID: "a", Parents: []string{}})
+	st.AddNode(&Node{ID: "ab", Parents: []string{}})
+	st.AddNode(&Node{ID: "c", Parents: []string{"ab"}})
+
+	for id, want := range map[string]bool{"a": false, "ab": true, "c": false, "missing": false} {
+		if got, err := st.HasChildren(id); err != nil || got != want {
+			t.Errorf("Expected HasChildren(%s) %v, got %v, err: %v", id, want, got, err)
+		}
+	}
+
+	st.DeleteNode("c")
+	if got, _ := st.HasChildren("ab"); got {
+		t.Errorf("Expected ab to have no children after deleting c")
+	}
+}
+
+func TestStorageStats(t *testing.T) {
+	st := newTestStore(t)
+
+	stats, err := st.StorageStats()
+	if err != nil {
+		t.Fatalf("StorageStats failed: %v", err)
+	}
+	if len(stats.Levels) != 0 || stats.Fragmentation != 0 {
+		t.Errorf("Expected no tables in an empty store, got %+v", stats)
+	}
+
+	for i := 0; i < 200; i++ {
+		st.AddNode(&Node{ID: fmt.Sprintf("n%03d", i), Parents: []string{}, Data: strings.Repeat("x", 100)})
+	}
+	if err := st.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	stats, err = st.StorageStats()
+	if err != nil {
+		t.Fatalf("StorageStats failed: %v", err)
+	}
+	if stats.ApproxBytes <= 0 || len(stats.Levels) == 0 || stats.Levels[0].Files == 0 || stats.Levels[0].Bytes <= 0 {
+		t.Errorf("Expected tables after compaction, got %+v", stats)
+	}
+	if stats.Fragmentation != 0 {
+		t.Errorf("Expected no fragmentation after a full compaction, got %f", stats.Fragmentation)
+	}
+}
+
+func TestNodesByType(t *testing.T) {
+	st := newTestStore(t)
+
+	st.AddNode(&Node{ID: "a", Parents: []string{}, Type: "vote"})
+	st.AddNode(&Node{ID: "b", Parents: []string{}, Type: "vote"})
+	st.AddNode(&Node{ID: "c", Parents: []string{}, Type: "checkpoint"})
+	st.AddNode(&Node{ID: "d", Parents: []string{}})
+
+	if ids, err := st.NodesByType("vote"); err != nil || len(ids) != 2 || ids[0] != "a" || ids[1] != "b" {
+		t.Errorf("Expected votes [a b], got %v, err: %v", ids, err)
+	}
+
+	st.AddNode(&Node{ID: "b", Parents: []string{}, Type: "checkpoint"})
+	st.DeleteNode("a")
+	if ids, _ := st.NodesByType("vote"); len(ids) != 0 {
+		t.Errorf("Expected no votes after retyping b and deleting a, got %v", ids)
+	}
+	if ids, _ := st.NodesByType("checkpoint"); len(ids) != 2 {
+		t.Errorf("Expected checkpoints [b c], got %v", ids)
+	}
+
+	if _, err := st.RebuildIndexes(); err != nil {
+		t.Fatalf("RebuildIndexes failed: %v", err)
+	}
+	if ids, _ := st.NodesByType("checkpoint"); len(ids) != 2 {
+		t.Errorf("Expected checkpoints [b c] after a rebuild, got %v", ids)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	st := newTestStore(t)
+	if err := st.AddNode(&Node{ID: "a", Parents: []string{}}); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+
+	snap, err := st.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	defer snap.Release()
+	seq := snap.Seq()
+
+	if err := st.AddNode(&Node{ID: "b", Parents: []string{"a"}}); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+	if err := st.DeleteNode("a"); err != nil {
+		t.Fatalf("DeleteNode failed: %v", err)
+	}
+
+	ids := []string{}
+	iter := snap.Iterator()
+	for iter.Next() {
+		ids = append(ids, string(iter.Key()))
+	}
+	iter.Release()
+	if len(ids) != 1 || ids[0] != "a" {
+		t.Errorf("Expected the snapshot to hold only a, got %v", ids)
+	}
+	if node, err := snap.GetNode("b"); err != nil || node != nil {
+		t.Errorf("Expected b to be invisible in the snapshot, got %v, %v", node, err)
+	}
+	if node, err := snap.GetNode("a"); err != nil || node == nil {
+		t.Errorf("Expected deleted a to be visible in the snapshot, got %v, %v", node, err)
+	}
+	if seq != 1 || st.LastSeq() != 3 {
+		t.Errorf("Expected snapshot seq 1 and head 3, got %d and %d", seq, st.LastSeq())
+	}
+}
+
+func TestUncleanShutdown(t *testing.T) {
+	dir := t.TempDir()
+	st, err := New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if st.UncleanShutdown() {
+		t.Errorf("Expected a new store to report a clean shutdown")
+	}
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	st, err = New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if st.UncleanShutdown() {
+		t.Errorf("Expected a clean shutdown after Close")
+	}
+	// Close the database behind the store's back, as a crash would.
+	st.db.Close()
+
+	st, err = New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer st.Close()
+	if !st.UncleanShutdown() {
+		t.Errorf("Expected an unclean shutdown to be detected")
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	st := newTestStore(t)
+	for _, n := range []*Node{{ID: "g", Parents: []string{}}, {ID: "a", Parents: []string{"g"}}} {
+		if err := st.AddNode(n); err != nil {
+			t.Fatalf("AddNode failed: %v", err)
+		}
+	}
+	deletedAt := time.Now().Add(-time.Hour)
+	if err := st.TombstoneNode("a", deletedAt); err != nil {
+		t.Fatalf("TombstoneNode failed: %v", err)
+	}
+	if node, _ := st.GetNode("a"); node != nil {
+		t.Errorf("Expected a tombstoned node to be hidden, got %+v", node)
+	}
+	if has, _ := st.HasChildren("g"); has {
+		t.Errorf("Expected g to be a tip again")
+	}
+	ts, err := st.GetTombstone("a")
+	if err != nil || ts == nil || !ts.DeletedAt.Equal(deletedAt.UTC()) {
+		t.Fatalf("Expected a tombstone dated %v, got %+v, %v", deletedAt, ts, err)
+	}
+	count := 0
+	iter := st.Iterator()
+	for iter.Next() {
+		count++
+	}
+	iter.Release()
+	if count != 1 {
+		t.Errorf("Expected scans to skip tombstones, saw %d records", count)
+	}
+
+	// A tombstone for a node never stored adds no changefeed entry.
+	seq := st.LastSeq()
+	if err := st.TombstoneNode("never", time.Now()); err != nil {
+		t.Fatalf("TombstoneNode failed: %v", err)
+	}
+	if st.LastSeq() != seq {
+		t.Errorf("Expected no change for a missing node, seq moved from %d to %d", seq, st.LastSeq())
+	}
+	if all, _ := st.Tombstones(""); len(all) != 2 || all[0].ID != "a" || all[1].ID != "never" {
+		t.Errorf("Expected tombstones a and never, got %+v", all)
+	}
+
+	if err := st.AddNode(&Node{ID: "a", Parents: []string{"g"}}); err != nil {
+		t.Fatalf("AddNode failed: %v", err)
+	}
+	if ts, _ := st.GetTombstone("a"); ts != nil {
+		t.Errorf("Expected re-adding a to clear its tombstone, got %+v", ts)
+	}
+
+	if n, err := st.PurgeTombstones(time.Now().Add(-time.Minute)); err != nil || n != 0 {
+		t.Errorf("Expected the fresh tombstone to survive, purged %d, %v", n, err)
+	}
+	if n, err := st.PurgeTombstones(time.Now().Add(time.Minute)); err != nil || n != 1 {
+		t.Errorf("Expected one tombstone purged, got %d, %v", n, err)
+	}
+}
+
+func TestNodeCache(t *testing.T) {
+	st := newTestStore(t, WithNodeCache(2))
+	for _, id := range []string{"a", "b", "c"} {
+		if err := st.AddNode(&Node{ID: id, Data: id, Parents: []string{}}); err != nil {
+			t.Fatalf("Failed to add %s: %v", id, err)
+		}
+	}
+	// Writes look up the previous record too, so count from here.
+	base := *st.CacheStats()
+	stats := func() CacheStats {
+		got := *st.CacheStats()
+		got.Hits -= base.Hits
+		got.Misses -= base.Misses
+		return got
+	}
+
+	if n, _ := st.GetNode("a"); n == nil || n.Data != "a" {
+		t.Fatalf("Expected a, got %+v", n)
+	}
+	n, _ := st.GetNode("a")
+	n.Data = "modified"
+	n.Parents = append(n.Parents, "x")
+	if got := stats(); got.Hits != 1 || got.Misses != 1 || got.Size != 1 {
+		t.Errorf("Expected 1 hit, 1 miss and 1 entry, got %+v", got)
+	}
+	if n, _ := st.GetNode("a"); n.Data != "a" || len(n.Parents) != 0 {
+		t.Errorf("Expected the cached copy unaffected by callers, got %+v", n)
+	}
+
+	// b and c evict a, the least recently read.
+	st.GetNode("b")
+	st.GetNode("c")
+	st.GetNode("a")
+	if got := stats(); got.Misses != 4 || got.Size != 2 {
+		t.Errorf("Expected a evicted and missed again, got %+v", got)
+	}
+
+	if err := st.AddNode(&Node{ID: "a", Data: "updated", Parents: []string{}}); err != nil {
+		t.Fatalf("Failed to update a: %v", err)
+	}
+	if n, _ := st.GetNode("a"); n == nil || n.Data != "updated" {
+		t.Errorf("Expected the update to invalidate a, got %+v", n)
+	}
+	if err := st.DeleteNode("a"); err != nil {
+		t.Fatalf("Failed to delete a: %v", err)
+	}
+	if n, _ := st.GetNode("a"); n != nil {
+		t.Errorf("Expected the delete to invalidate a, got %+v", n)
+	}
+
+	if newTestStore(t).CacheStats() != nil {
+		t.Errorf("Expected no cache stats without a cache")
+	}
+}
+
+// BenchmarkAddNodes compares writing a 10k node chain one AddNode at a time
+// with writing it in a single AddNodes batch.
+func BenchmarkAddNodes(b *testing.B) {
+	const n = 10000
+	chain := func() []*Node {
+		nodes := make([]*Node, n)
+		for i := range nodes {
+			parents := []string{}
+			if i > 0 {
+				parents = []string{fmt.Sprintf("n%05d", i-1)}
+			}
+			nodes[i] = &Node{ID: fmt.Sprintf("n%05d", i), Parents: parents, Weight: 1.0, CumulativeWeight: 1.0}
+		}
+		return nodes
+	}
+
+	b.Run("Single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			st, nodes := newTestStore(b), chain()
+			b.StartTimer()
+			for _, node := range nodes {
+				if err := st.AddNode(node); err != nil {
+					b.Fatalf("AddNode failed: %v", err)
+				}
+			}
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			st, nodes := newTestStore(b), chain()
+			b.StartTimer()
+			if err := st.AddNodes(nodes); err != nil {
+				b.Fatalf("AddNodes failed: %v", err)
+			}
+		}
+	})
+}
+
+// BenchmarkGetNode reads the same 100 nodes over and over, with and without
+// the node cache.
+func BenchmarkGetNode(b *testing.B) {
+	const n = 100
+	for _, bc := range []struct {
+		name string
+		opts []Option
+	}{
+		{"Uncached", nil},
+		{"Cached", []Option{WithNodeCache(n)}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			st := newTestStore(b, bc.opts...)
+			for i := 0; i < n; i++ {
+				node := &Node{ID: fmt.Sprintf("n%03d", i), Data: strings.Repeat("x", 256), Parents: []string{}, Weight: 1.0}
+				if err := st.AddNode(node); err != nil {
+					b.Fatalf("AddNode failed: %v", err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if node, err := st.GetNode(fmt.Sprintf("n%03d", i%n)); err != nil || node == nil {
+					b.Fatalf("GetNode failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRecentlyCreated(t *testing.T) {
+	st := newTestStore(t)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := st.AddNode(&Node{ID: id, Parents: []string{}}); err != nil {
+			t.Fatalf("Failed to add %s: %v", id, err)
+		}
+	}
+	// Updating a keeps its creation time; deleting b drops it.
+	a, err := st.GetNode("a")
+	if err != nil {
+		t.Fatalf("Failed to read a: %v", err)
+	}
+	a.Weight = 2.0
+	if err := st.PutNode(a); err != nil {
+		t.Fatalf("Failed to update a: %v", err)
+	}
+	if err := st.DeleteNode("b"); err != nil {
+		t.Fatalf("Failed to delete b: %v", err)
+	}
+
+	check := func(when string) {
+		ids, err := st.RecentlyCreated(10)
+		if err != nil {
+			t.Fatalf("Failed to read recent nodes %s: %v", when, err)
+		}
+		if len(ids) != 2 || ids[0] != "c" || ids[1] != "a" {
+			t.Errorf("Expected [c a] %s, got %v", when, ids)
+		}
+	}
+	check("after writes")
+	if _, err := st.RebuildIndexes(); err != nil {
+		t.Fatalf("Failed to rebuild indexes: %v", err)
+	}
+	check("after a rebuild")
+
+	ids, err := st.RecentlyCreated(1)
+	if err != nil || len(ids) != 1 || ids[0] != "c" {
+		t.Errorf("Expected [c] for n=1, got %v, %v", ids, err)
+	}
+}
+
+func TestNodeCount(t *testing.T) {
+	dir := t.TempDir()
+	st, err := New(dir, WithWriteBuffer(100, time.Hour))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	expect := func(when string, want int) {
+		t.Helper()
+		if got := st.NodeCount(); got != want {
+			t.Errorf("Expected %d nodes %s, got %d", want, when, got)
+		}
+	}
+
+	for _, id := range []string{"a", "b", "a"} {
+		if err := st.AddNode(&Node{ID: id, Parents: []string{}}); err != nil {
+			t.Fatalf("Failed to add %s: %v", id, err)
+		}
+	}
+	expect("while buffered", 2)
+	if err := st.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	expect("after a flush", 2)
+	if err := st.AddNode(&Node{ID: "b", Parents: []string{}, Weight: 2.0}); err != nil {
+		t.Fatalf("Failed to update b: %v", err)
+	}
+	expect("after an update", 2)
+	if err := st.DeleteNode("a"); err != nil {
+		t.Fatalf("Failed to delete a: %v", err)
+	}
+	if err := st.DeleteNode("missing"); err != nil {
+		t.Fatalf("Failed to delete a missing node: %v", err)
+	}
+	expect("after deletes", 1)
+	if err := st.Apply(&Update{Nodes: []*Node{{ID: "c", Parents: []string{"b"}}}, Delete: "b"}); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	expect("after Apply", 1)
+	if err := st.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	st, err = New(dir)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer st.Close()
+	expect("after reopening", 1)
+}
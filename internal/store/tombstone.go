@@ -0,0 +1,84 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Tombstone records that a node was deliberately deleted, so sync can tell a
+// deletion apart from a node it has never seen.
+type Tombstone struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+func tombstoneKey(id string) []byte {
+	return []byte(tombstonePrefix + id)
+}
+
+// TombstoneNode deletes id like DeleteNode and leaves a tombstone dated at
+// in the same batch. Adding the node again removes the tombstone.
+func (s *Store) TombstoneNode(id string, at time.Time) error {
+	return s.deleteNode(id, &Tombstone{ID: id, DeletedAt: at.UTC()})
+}
+
+// GetTombstone returns the tombstone of id, or nil if it has none.
+func (s *Store) GetTombstone(id string) (*Tombstone, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	data, err := s.db.Get(tombstoneKey(id), nil)
+	if err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ts Tombstone
+	if err := json.Unmarshal(data, &ts); err != nil {
+		return nil, err
+	}
+	return &ts, nil
+}
+
+// Tombstones returns every tombstone whose node ID starts with prefix, in ID
+// order.
+func (s *Store) Tombstones(prefix string) ([]Tombstone, error) {
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	out := []Tombstone{}
+	iter := s.db.NewIterator(util.BytesPrefix(tombstoneKey(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		var ts Tombstone
+		if err := json.Unmarshal(iter.Value(), &ts); err != nil {
+			ts = Tombstone{ID: strings.TrimPrefix(string(iter.Key()), tombstonePrefix)}
+		}
+		out = append(out, ts)
+	}
+	return out, iter.Error()
+}
+
+// PurgeTombstones deletes every tombstone dated before cutoff and returns
+// how many were removed.
+func (s *Store) PurgeTombstones(cutoff time.Time) (int, error) {
+	batch := new(leveldb.Batch)
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(tombstonePrefix)), nil)
+	for iter.Next() {
+		var ts Tombstone
+		if err := json.Unmarshal(iter.Value(), &ts); err != nil || ts.DeletedAt.Before(cutoff) {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return 0, err
+	}
+	return batch.Len(), s.db.Write(batch, nil)
+}
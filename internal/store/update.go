@@ -0,0 +1,90 @@
+package store
+
+import (
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Update is a set of writes that Apply commits in one LevelDB batch, so
+// after a crash either all of them are visible or none is.
+type Update struct {
+	// Nodes are written as AddNodes writes them, stamping UpdatedAt.
+	Nodes []*Node
+	// Delete, when non-empty, is removed as DeleteNode removes it, leaving
+	// Tombstone when that is non-nil.
+	Delete    string
+	Tombstone *Tombstone
+	// DeferWeights and ClearDeferred set and remove deferred weight marks.
+	DeferWeights  []string
+	ClearDeferred []string
+}
+
+// Apply commits u in a single batch. Buffered writes are flushed first, so
+// u never lands ahead of writes accepted before it.
+func (s *Store) Apply(u *Update) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flushLocked(); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, node := range u.Nodes {
+		if err := s.stamp(node, now); err != nil {
+			return err
+		}
+	}
+	if err := s.injectFault(FaultWrite); err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	seq := s.seq
+	touched := make([]string, 0, len(u.Nodes)+1)
+	created := map[string]bool{}
+	for _, node := range u.Nodes {
+		seq++
+		isNew, err := s.stagePut(batch, seq, node)
+		if err != nil {
+			return err
+		}
+		if isNew {
+			created[node.ID] = true
+		}
+		touched = append(touched, node.ID)
+	}
+	removed := 0
+	if u.Delete != "" {
+		existed, staged, err := s.stageDelete(batch, seq+1, u.Delete, u.Tombstone)
+		if err != nil {
+			return err
+		}
+		if staged {
+			seq++
+		}
+		if existed {
+			removed = 1
+		}
+		touched = append(touched, u.Delete)
+	}
+	for _, id := range u.DeferWeights {
+		batch.Put([]byte(deferredWeightPrefix+id), nil)
+	}
+	for _, id := range u.ClearDeferred {
+		batch.Delete([]byte(deferredWeightPrefix + id))
+	}
+
+	var err error
+	if seq == s.seq {
+		err = s.db.Write(batch, nil)
+	} else {
+		err = s.commitChanges(batch, seq)
+	}
+	if err == nil {
+		s.nodes += len(created) - removed
+	}
+	if s.cache != nil && len(touched) > 0 {
+		s.cache.invalidate(touched...)
+	}
+	return err
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"encoding/json"
+	"math"
+	"sync/atomic"
+)
+
+// weightDecimals is the number of decimals weights are rounded to when
+// encoded, or -1 to encode them unchanged.
+var weightDecimals atomic.Int32
+
+func init() {
+	weightDecimals.Store(-1)
+}
+
+// SetWeightPrecision rounds Weight and CumulativeWeight to decimals places
+// whenever a node is encoded, both when it is stored and when it is returned,
+// so accumulated float noise such as 2.9999999999996 never leaves the
+// process. A negative value disables rounding, which is the default.
+func SetWeightPrecision(decimals int) {
+	weightDecimals.Store(int32(decimals))
+}
+
+// RoundWeight rounds w to the configured precision.
+func RoundWeight(w float64) float64 {
+	d := weightDecimals.Load()
+	if d < 0 {
+		return w
+	}
+	scale := math.Pow(10, float64(d))
+	return math.Round(w*scale) / scale
+}
+
+func (n Node) MarshalJSON() ([]byte, error) {
+	type plain Node
+	p := plain(n)
+	p.Weight = RoundWeight(p.Weight)
+	p.CumulativeWeight = RoundWeight(p.CumulativeWeight)
+	return json.Marshal(p)
+}
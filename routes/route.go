@@ -1,15 +1,48 @@
-package routes
-
-import (
-	"github.com/gorilla/mux"
-	"github.com/sivaram/dag-leveldb/api/http"
-)
-
-// RegisterRoutes registers all routes with the given router and handler
-func RegisterRoutes(r *mux.Router, handler *http.Handler) {
-	r.HandleFunc("/nodes", handler.AddNode).Methods("POST")
-	r.HandleFunc("/sync", handler.SyncNodes).Methods("POST")
-	r.HandleFunc("/nodes/{id}", handler.GetNode).Methods("GET")
-	r.HandleFunc("/nodes", handler.GetNodes).Methods("GET")
-	r.HandleFunc("/nodes/{id}", handler.DeleteNode).Methods("DELETE")
-}
+package routes
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/sivaram/dag-leveldb/api/http"
+)
+
+// RegisterRoutes registers all routes with the given router and handler
+func RegisterRoutes(r *mux.Router, handler *http.Handler) {
+	r.Use(handler.RequireAuth)
+	r.HandleFunc("/nodes", handler.AddNode).Methods("POST")
+	r.HandleFunc("/nodes/get-many", handler.GetManyNodes).Methods("POST")
+	r.HandleFunc("/nodes/exists", handler.NodesExist).Methods("POST")
+	r.HandleFunc("/sync", handler.SyncNodes).Methods("POST")
+	r.HandleFunc("/import", handler.ImportNDJSON).Methods("POST")
+	r.HandleFunc("/import/json", handler.ImportJSON).Methods("POST")
+	r.HandleFunc("/export", handler.ExportNDJSON).Methods("GET")
+	r.HandleFunc("/export/json", handler.ExportJSON).Methods("GET")
+	r.HandleFunc("/export/csv", handler.ExportCSV).Methods("GET")
+	r.HandleFunc("/export/dot", handler.ExportDOT).Methods("GET")
+	r.HandleFunc("/nodes/genesis", handler.GetGenesisNodes).Methods("GET")
+	r.HandleFunc("/nodes/confirmed", handler.GetConfirmedNodes).Methods("GET")
+	r.HandleFunc("/nodes/topo", handler.GetTopologicalOrder).Methods("GET")
+	r.HandleFunc("/nodes/{id}", handler.GetNode).Methods("GET")
+	r.HandleFunc("/nodes/{id}", handler.UpdateNode).Methods("PATCH")
+	r.HandleFunc("/nodes/{id}/ancestors", handler.GetAncestors).Methods("GET")
+	r.HandleFunc("/nodes/{id}/descendants", handler.GetDescendants).Methods("GET")
+	r.HandleFunc("/nodes/{id}/heaviest-path", handler.GetHeaviestPath).Methods("GET")
+	r.HandleFunc("/nodes/{id}/path/{target}", handler.GetPath).Methods("GET")
+	r.HandleFunc("/nodes", handler.GetNodes).Methods("GET")
+	r.HandleFunc("/tips", handler.GetTips).Methods("GET")
+	r.HandleFunc("/tips/all", handler.GetAllTips).Methods("GET")
+	r.HandleFunc("/tips/params", handler.GetTipParams).Methods("GET")
+	r.HandleFunc("/peers", handler.GetPeers).Methods("GET")
+	r.HandleFunc("/stats", handler.GetStats).Methods("GET")
+	r.HandleFunc("/metrics", handler.Metrics).Methods("GET")
+	r.HandleFunc("/healthz", handler.Healthz).Methods("GET")
+	r.HandleFunc("/readyz", handler.Readyz).Methods("GET")
+	r.HandleFunc("/changes", handler.GetChanges).Methods("GET")
+	r.HandleFunc("/tombstones", handler.GetTombstones).Methods("GET")
+	r.HandleFunc("/subscribe", handler.Subscribe).Methods("GET")
+	r.HandleFunc("/nodes/by-hash/{hash}", handler.DeleteNodeByHash).Methods("DELETE")
+	r.HandleFunc("/nodes/{id}", handler.DeleteNode).Methods("DELETE")
+	r.HandleFunc("/admin/rebuild-indexes", handler.RebuildIndexes).Methods("POST")
+	r.HandleFunc("/admin/weight-consistency", handler.CheckWeightConsistency).Methods("GET")
+	r.HandleFunc("/admin/verify-structure", handler.VerifyStructure).Methods("GET")
+	r.HandleFunc("/admin/maintenance/{operation}", handler.RunMaintenance).Methods("POST")
+}